@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// App owns the Redis and Mongo clients shared by the handlers and background
+// jobs. Both pool their connections; they are created once at startup and
+// closed on shutdown.
+type App struct {
+	Redis redis.UniversalClient
+	Mongo *mongo.Client
+
+	// Fallbacks for while Redis or Mongo is unreachable; see degraded.go.
+	stores  *datastores
+	local   *lruCache
+	limits  *localLimiter
+	symbols *symbolMap
+}
+
+func newApp(ctx context.Context, cfg Config) *App {
+	return &App{
+		Redis:   initializeRedisLocalClient(ctx, cfg),
+		Mongo:   initializeMongoLocalClient(ctx, cfg),
+		stores:  &datastores{down: make(map[string]time.Time)},
+		local:   newLRUCache(cfg.Degraded.CacheSize),
+		limits:  newLocalLimiter(cfg.Degraded.CacheSize),
+		symbols: &symbolMap{},
+	}
+}
+
+// Close closes the clients, once nothing uses them anymore.
+func (a *App) Close(ctx context.Context) {
+	err := a.Redis.Close()
+	if err != nil {
+		cacheLog.Warn(ctx, "error closing redis", "error", err)
+	}
+	if a.Mongo == nil {
+		return
+	}
+	err = a.Mongo.Disconnect(ctx)
+	if err != nil {
+		storeLog.Warn(ctx, "error closing mongo", "error", err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	apiKeyCachePrefix string = "apikey:"
+	rateKeyPrefix     string = "ratelimit:"
+	quotaKeyPrefix    string = "quota:"
+	scopeRead         string = "read"
+	scopePortfolio    string = "portfolio"
+	scopeAdmin        string = "admin"
+)
+
+// A key lookup is cached for at least apiKeyCacheTtlMin, so a cache_ttl of 0
+// can't leave entries in Redis for good. Unknown keys are cached for at most
+// apiKeyNegativeTtl: anyone can send them, and a key issued meanwhile should
+// work soon.
+const (
+	apiKeyCacheTtlMin = time.Second
+	apiKeyNegativeTtl = 10 * time.Second
+)
+
+type apiKeyKey struct{}
+
+// ApiKey is a client key as stored in the auth.keys collection. Only the
+// SHA-256 of the key is kept; the key itself is shown once, when issued.
+// A zero RateLimit or DailyQuota uses the configured default, a negative one
+// means unlimited.
+type ApiKey struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name       string             `bson:"name" json:"name"`
+	Hash       string             `bson:"hash" json:"hash,omitempty"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	RateLimit  int                `bson:"rateLimit" json:"rateLimit"`
+	DailyQuota int                `bson:"dailyQuota" json:"dailyQuota"`
+	Revoked    bool               `bson:"revoked" json:"revoked"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	RevokedAt  *time.Time         `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+}
+
+type IssuedKey struct {
+	Key string `json:"key"`
+	ApiKey
+}
+
+// rateState is what the X-RateLimit-* headers report: the per-minute window
+// and the daily quota of the key.
+type rateState struct {
+	Limit          int
+	Remaining      int
+	Reset          int64
+	DailyLimit     int
+	DailyRemaining int
+}
+
+// authenticate checks the API key of every route but the OpenAPI document and
+// the operational endpoints against the scope of the route, and counts the request against
+// the key's rate limit and daily quota.
+func (a *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Auth.Enabled || r.URL.Path == "/api/openapi.json" || operationalPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		apiKey, state, code, msg := a.authorize(ctx, requestApiKey(r), routeScope(r))
+		if state != nil {
+			state.setHeaders(w.Header())
+		}
+		if code != 0 {
+			if code == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", strconv.FormatInt(state.retryAfter(), 10))
+			}
+			writeErrorFor(w, r, code, msg)
+			return
+		}
+		meter(r, func(event *UsageEvent) {
+			event.ApiKey, event.KeyName = apiKey.usageId(), apiKey.Name
+		})
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, apiKeyKey{}, apiKey)))
+	})
+}
+
+// authorize looks key up and counts a request for it. It returns the HTTP
+// status and message to answer with when the request is refused, else 0.
+func (a *App) authorize(ctx context.Context, key string, scope string) (*ApiKey, *rateState, int, string) {
+	if key == "" {
+		return nil, nil, http.StatusUnauthorized, "API key required"
+	}
+	apiKey, err := a.loadApiKey(ctx, key)
+	if err != nil {
+		return nil, nil, http.StatusServiceUnavailable, "Error checking API key"
+	}
+	if apiKey == nil || apiKey.Revoked {
+		return nil, nil, http.StatusUnauthorized, "Invalid API key"
+	}
+	if !apiKey.hasScope(scope) {
+		return nil, nil, http.StatusForbidden, "API key lacks the " + scope + " scope"
+	}
+	state, code, msg := a.chargeRequests(ctx, apiKey, 1)
+	if code != 0 {
+		return nil, state, code, msg
+	}
+	return apiKey, state, 0, ""
+}
+
+// chargeRequests counts n requests for apiKey, e.g. the items of a gRPC batch.
+// It returns the HTTP status and message to answer with when they are
+// refused, else 0.
+func (a *App) chargeRequests(ctx context.Context, apiKey *ApiKey, n int) (*rateState, int, string) {
+	state, err := countRequest(ctx, a.Redis, apiKey, n)
+	if err != nil && cfg.Auth.FailOpen {
+		cacheLog.Warn(ctx, "error counting API key request, letting it through", "key", apiKey.Prefix, "error", err)
+		return nil, 0, ""
+	}
+	if err != nil {
+		cacheLog.Warn(ctx, "error counting API key request, refusing it", "key", apiKey.Prefix, "error", err)
+		return nil, http.StatusServiceUnavailable, "Error counting API key request"
+	}
+	if state == nil {
+		return nil, 0, ""
+	}
+	if state.Limit >= 0 && state.Remaining < 0 {
+		return state, http.StatusTooManyRequests, "Rate limit exceeded"
+	}
+	if state.DailyLimit >= 0 && state.DailyRemaining < 0 {
+		return state, http.StatusTooManyRequests, "Daily quota exceeded"
+	}
+	return state, 0, ""
+}
+
+// loadApiKey returns the key from the Redis cache or else from Mongo, caching
+// unknown keys as well so they don't reach Mongo on every request. The admin
+// key of the config is built in.
+func (a *App) loadApiKey(ctx context.Context, key string) (*ApiKey, error) {
+	if cfg.Auth.AdminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.Auth.AdminKey)) == 1 {
+		return &ApiKey{Name: "admin", Scopes: []string{scopeAdmin}, RateLimit: -1, DailyQuota: -1}, nil
+	}
+	hash := hashApiKey(key)
+	cached, err := a.Redis.Get(ctx, apiKeyCachePrefix+hash).Result()
+	countCache("apikey", err == nil)
+	if err == nil {
+		if cached == "" {
+			return nil, nil
+		}
+		var apiKey ApiKey
+		if json.Unmarshal([]byte(cached), &apiKey) == nil {
+			return &apiKey, nil
+		}
+	}
+	var apiKey ApiKey
+	err = a.Mongo.Database("auth").Collection("keys").FindOne(ctx, bson.M{"hash": hash}).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		a.Redis.Set(ctx, apiKeyCachePrefix+hash, "", apiKeyCacheTtl(false))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(apiKey)
+	if err == nil {
+		a.Redis.Set(ctx, apiKeyCachePrefix+hash, payload, apiKeyCacheTtl(true))
+	}
+	return &apiKey, nil
+}
+
+// apiKeyCacheTtl is how long the lookup of a key is cached, found or not.
+func apiKeyCacheTtl(found bool) time.Duration {
+	ttl := time.Duration(cfg.Auth.CacheTtl) * time.Second
+	if ttl < apiKeyCacheTtlMin {
+		ttl = apiKeyCacheTtlMin
+	}
+	if !found && ttl > apiKeyNegativeTtl {
+		ttl = apiKeyNegativeTtl
+	}
+	return ttl
+}
+
+// countRequest counts n requests in the key's current minute and day. It
+// returns nil for keys without limits. Whether requests go through when
+// Redis can't count is up to auth.fail_open.
+func countRequest(ctx context.Context, rds redis.UniversalClient, apiKey *ApiKey, n int) (*rateState, error) {
+	state := &rateState{Limit: apiKey.RateLimit, DailyLimit: apiKey.DailyQuota}
+	if state.Limit == 0 {
+		state.Limit = cfg.Auth.RateLimit
+	}
+	if state.DailyLimit == 0 {
+		state.DailyLimit = cfg.Auth.DailyQuota
+	}
+	if state.Limit < 0 && state.DailyLimit < 0 {
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	minute := now.Unix() / 60
+	state.Reset = (minute + 1) * 60
+	id := apiKey.Id.Hex()
+	rateKey := rateKeyPrefix + id + ":" + strconv.FormatInt(minute, 10)
+	quotaKey := quotaKeyPrefix + id + ":" + now.Format(historyDateForm)
+	pipe := rds.TxPipeline()
+	rate := pipe.IncrBy(ctx, rateKey, int64(n))
+	pipe.Expire(ctx, rateKey, time.Minute)
+	used := pipe.Get(ctx, quotaKey)
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	state.Remaining = state.Limit - int(rate.Val())
+	// Requests refused by the rate limit don't use up the quota.
+	if state.Limit >= 0 && state.Remaining < 0 {
+		usedQuota, _ := used.Int()
+		state.DailyRemaining = state.DailyLimit - usedQuota
+		return state, nil
+	}
+	pipe = rds.TxPipeline()
+	quota := pipe.IncrBy(ctx, quotaKey, int64(n))
+	pipe.Expire(ctx, quotaKey, 48*time.Hour)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state.DailyRemaining = state.DailyLimit - int(quota.Val())
+	// Nor do those refused by the quota itself.
+	if state.DailyLimit >= 0 && state.DailyRemaining < 0 {
+		rds.DecrBy(ctx, quotaKey, int64(n))
+	}
+	return state, nil
+}
+
+func (s *rateState) setHeaders(header http.Header) {
+	if s.Limit >= 0 {
+		header.Set("X-RateLimit-Limit", strconv.Itoa(s.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(maxInt(s.Remaining, 0)))
+		header.Set("X-RateLimit-Reset", strconv.FormatInt(s.Reset, 10))
+	}
+	if s.DailyLimit >= 0 {
+		header.Set("X-RateLimit-Daily-Limit", strconv.Itoa(s.DailyLimit))
+		header.Set("X-RateLimit-Daily-Remaining", strconv.Itoa(maxInt(s.DailyRemaining, 0)))
+	}
+}
+
+// retryAfter is the number of seconds until the exceeded limit resets.
+func (s *rateState) retryAfter() int64 {
+	now := time.Now().UTC()
+	if s.Limit >= 0 && s.Remaining < 0 {
+		return s.Reset - now.Unix()
+	}
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return int64(tomorrow.Sub(now).Seconds()) + 1
+}
+
+// usageId identifies the key in usage events: its id, or its name for the
+// built-in admin key.
+func (k *ApiKey) usageId() string {
+	if k.Id.IsZero() {
+		return k.Name
+	}
+	return k.Id.Hex()
+}
+
+func (k *ApiKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func routeScope(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2")
+	switch {
+	case strings.HasPrefix(path, "/api/admin/") || strings.HasPrefix(path, "/admin/"):
+		return scopeAdmin
+	case strings.Contains(path, "/watchlists") || strings.Contains(path, "/portfolios"):
+		return scopePortfolio
+	}
+	return scopeRead
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newApiKey() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "upk_" + hex.EncodeToString(b), nil
+}
+
+// adminKeyCreateHandler issues a key. The response is the only time the key
+// itself is shown.
+func (a *App) adminKeyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "can't read body")
+		return
+	}
+	var apiKey ApiKey
+	if json.Unmarshal(body, &apiKey) != nil || apiKey.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if len(apiKey.Scopes) == 0 {
+		apiKey.Scopes = []string{scopeRead}
+	}
+	for _, scope := range apiKey.Scopes {
+		if scope != scopeRead && scope != scopePortfolio && scope != scopeAdmin {
+			writeError(w, http.StatusBadRequest, "Unknown scope "+scope)
+			return
+		}
+	}
+	key, err := newApiKey()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error generating API key")
+		return
+	}
+	apiKey.Id = primitive.NewObjectID()
+	apiKey.Hash = hashApiKey(key)
+	apiKey.Prefix = key[:12]
+	apiKey.Revoked = false
+	apiKey.CreatedAt = time.Now().UTC()
+	apiKey.RevokedAt = nil
+	ctx := r.Context()
+	co := a.Mongo
+	_, err = co.Database("auth").Collection("keys").InsertOne(ctx, apiKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error saving API key")
+		return
+	}
+	// A key that was looked up before being issued is cached as unknown.
+	rds := a.Redis
+	rds.Del(ctx, apiKeyCachePrefix+apiKey.Hash)
+	apiKey.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, IssuedKey{key, apiKey})
+}
+
+func (a *App) adminKeyListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	co := a.Mongo
+	res := make([]ApiKey, 0)
+	cursor, err := co.Database("auth").Collection("keys").Find(ctx, bson.M{},
+		options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err == nil {
+		err = cursor.All(ctx, &res)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading API keys")
+		return
+	}
+	for i := range res {
+		res[i].Hash = ""
+	}
+	writeJSON(w, res)
+}
+
+// adminKeyRevokeHandler revokes a key by id, dropping it from the cache so the
+// revocation applies at once.
+func (a *App) adminKeyRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, "API key "+mux.Vars(r)["id"]+" doesn't exist")
+		return
+	}
+	ctx := r.Context()
+	co := a.Mongo
+	now := time.Now().UTC()
+	var apiKey ApiKey
+	err = co.Database("auth").Collection("keys").FindOneAndUpdate(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"revoked": true, "revokedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "API key "+id.Hex()+" doesn't exist")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error revoking API key")
+		return
+	}
+	rds := a.Redis
+	rds.Del(ctx, apiKeyCachePrefix+apiKey.Hash)
+	apiKey.Hash = ""
+	writeJSON(w, apiKey)
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAuthorizeCounting(t *testing.T) {
+	fake, rds := newFakeRedis(t)
+	app := &App{Redis: rds}
+	apiKey := ApiKey{Id: primitive.NewObjectID(), Name: "client", Prefix: "upk_test", Scopes: []string{scopeRead}, RateLimit: 2, DailyQuota: 10}
+	cached, _ := json.Marshal(apiKey)
+	fake.strings[apiKeyCachePrefix+hashApiKey("upk_test")] = string(cached)
+	saved := cfg.Auth
+	defer func() { cfg.Auth = saved }()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, state, code, msg := app.authorize(ctx, "upk_test", scopeRead)
+		if code != 0 || state.Remaining != 1-i || state.DailyRemaining != 9-i {
+			t.Fatalf("request %d: %d %s, state %+v", i, code, msg, state)
+		}
+	}
+	// Refused requests don't use up the daily quota.
+	if _, state, code, msg := app.authorize(ctx, "upk_test", scopeRead); code != http.StatusTooManyRequests || state.DailyRemaining != 8 {
+		t.Fatalf("third request: %d %s, state %+v, want 429 with 8 left for the day", code, msg, state)
+	}
+	quotaKey := quotaKeyPrefix + apiKey.Id.Hex() + ":" + time.Now().UTC().Format(historyDateForm)
+	fake.mu.Lock()
+	fake.strings[rateKeyPrefix+apiKey.Id.Hex()+":"+strconv.FormatInt(time.Now().Unix()/60, 10)] = "0"
+	fake.strings[quotaKey] = "10"
+	fake.mu.Unlock()
+	if _, _, code, msg := app.authorize(ctx, "upk_test", scopeRead); code != http.StatusTooManyRequests {
+		t.Fatalf("request over the quota: %d %s, want 429", code, msg)
+	}
+	fake.mu.Lock()
+	used := fake.strings[quotaKey]
+	fake.mu.Unlock()
+	if used != "10" {
+		t.Fatalf("quota counter %s after a refused request, want 10", used)
+	}
+	if _, _, code, _ := app.authorize(ctx, "upk_test", scopePortfolio); code != http.StatusForbidden {
+		t.Fatalf("portfolio scope: %d, want 403", code)
+	}
+
+	fake.mu.Lock()
+	fake.failing["INCRBY"] = true
+	fake.mu.Unlock()
+	cfg.Auth.FailOpen = true
+	if key, state, code, msg := app.authorize(ctx, "upk_test", scopeRead); code != 0 || key == nil || state != nil {
+		t.Fatalf("fail open: %d %s, want the request through uncounted", code, msg)
+	}
+	cfg.Auth.FailOpen = false
+	if _, _, code, msg := app.authorize(ctx, "upk_test", scopeRead); code != http.StatusServiceUnavailable {
+		t.Fatalf("fail closed: %d %s, want 503", code, msg)
+	}
+}
+
+func TestAdminKey(t *testing.T) {
+	saved := cfg.Auth
+	defer func() { cfg.Auth = saved }()
+	cfg.Auth.AdminKey = "upk_admin"
+	app := &App{}
+	apiKey, err := app.loadApiKey(context.Background(), "upk_admin")
+	if err != nil || apiKey == nil || !apiKey.hasScope(scopeAdmin) {
+		t.Fatalf("admin key: %v, %v", apiKey, err)
+	}
+}
+
+func TestApiKeyCacheTtl(t *testing.T) {
+	saved := cfg.Auth
+	defer func() { cfg.Auth = saved }()
+	for _, tc := range []struct {
+		cacheTtl int
+		found    time.Duration
+		unknown  time.Duration
+	}{
+		{60, time.Minute, apiKeyNegativeTtl},
+		{5, 5 * time.Second, 5 * time.Second},
+		{0, apiKeyCacheTtlMin, apiKeyCacheTtlMin},
+		{-1, apiKeyCacheTtlMin, apiKeyCacheTtlMin},
+	} {
+		cfg.Auth.CacheTtl = tc.cacheTtl
+		if got := apiKeyCacheTtl(true); got != tc.found {
+			t.Errorf("cache_ttl %d: found keys cached %s, want %s", tc.cacheTtl, got, tc.found)
+		}
+		if got := apiKeyCacheTtl(false); got != tc.unknown {
+			t.Errorf("cache_ttl %d: unknown keys cached %s, want %s", tc.cacheTtl, got, tc.unknown)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Package client is the Go client of the Upbit info API. It talks to the
+// /api/v2 routes, whose bodies are an envelope of data and error.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// APIKey is sent as X-API-Key.
+	APIKey string
+	// Header is sent with every request.
+	Header http.Header
+	// Retries is how many times a request is retried after a transport error,
+	// a 429 or a 5xx answer. Backoff is the first delay, doubled each retry,
+	// unless the server sends Retry-After.
+	Retries int
+	Backoff time.Duration
+}
+
+type envelope struct {
+	Data  json.RawMessage `json:"data"`
+	Error *Error          `json:"error"`
+}
+
+// New returns a client of the service at baseURL, e.g. http://localhost:1928,
+// with a 10s timeout per request and two retries. Set APIKey when the service
+// requires one.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Header:     make(http.Header),
+		Retries:    2,
+		Backoff:    200 * time.Millisecond,
+	}
+}
+
+// Do calls a route of the v2 API and decodes the data of its envelope into
+// out. A body, if any, is sent as JSON. Routes without a typed method can be
+// called through Do directly.
+func (c *Client) Do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := c.do(ctx, method, u, payload)
+		// Transport errors and timeouts of a single attempt are retried.
+		retry := err != nil
+		if err == nil {
+			err = decode(res, out)
+			apiErr, ok := err.(*Error)
+			retry = ok && apiErr.Temporary()
+		}
+		if !retry || attempt >= c.Retries || ctx.Err() != nil {
+			return err
+		}
+		delay := c.Backoff << uint(attempt)
+		if apiErr, ok := err.(*Error); ok && apiErr.RetryAfter > 0 {
+			delay = apiErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method string, u string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range c.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+func decode(res *http.Response, out interface{}) error {
+	defer res.Body.Close()
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var body envelope
+	err = json.Unmarshal(raw, &body)
+	if err != nil && res.StatusCode < 400 {
+		return err
+	}
+	if body.Error == nil && res.StatusCode >= 400 {
+		// Not an answer of the service, e.g. from a proxy in front of it.
+		body.Error = &Error{Code: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+	}
+	if body.Error != nil {
+		body.Error.Status = res.StatusCode
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			body.Error.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return body.Error
+	}
+	if out == nil || len(body.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body.Data, out)
+}
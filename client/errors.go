@@ -0,0 +1,57 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The service's error codes, matched with errors.Is against an *Error.
+var (
+	ErrBadRequest    = errors.New("bad request")
+	ErrUnauthorized  = errors.New("missing or invalid API key")
+	ErrForbidden     = errors.New("API key lacks the scope")
+	ErrNotFound      = errors.New("not found")
+	ErrNotAcceptable = errors.New("format not acceptable")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrUnavailable   = errors.New("service unavailable")
+)
+
+// Error is the error body of the service. Status is the HTTP status it came
+// with, which for /api/v2 equals Code.
+type Error struct {
+	Code       int           `json:"code"`
+	Message    string        `json:"message"`
+	Status     int           `json:"-"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("upbit: %d %s", e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.Code == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.Code == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.Code == http.StatusForbidden
+	case ErrNotFound:
+		return e.Code == http.StatusNotFound
+	case ErrNotAcceptable:
+		return e.Code == http.StatusNotAcceptable
+	case ErrRateLimited:
+		return e.Code == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return e.Code >= 500
+	}
+	return false
+}
+
+// Temporary reports whether the request may succeed when retried.
+func (e *Error) Temporary() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// Data is a row of /api/v2/{symbol}/info. Pointer fields are nil when no
+// provider supplied them.
+type Data struct {
+	Symbol               string     `json:"symbol"`
+	CurrencyCode         string     `json:"currencyCode"`
+	Price                float64    `json:"price"`
+	MarketCap            float64    `json:"marketCap"`
+	AccTradePrice24H     *float64   `json:"accTradePrice24h"`
+	CirculatingSupply    float64    `json:"circulatingSupply"`
+	MaxSupply            *float64   `json:"maxSupply"`
+	Provider             *string    `json:"provider"`
+	LastUpdatedTimestamp string     `json:"lastUpdatedTimestamp"`
+	KoreanName           *string    `json:"koreanName"`
+	EnglishName          *string    `json:"englishName"`
+	UpbitWarning         bool       `json:"upbitWarning"`
+	Consensus            *Consensus `json:"consensus"`
+}
+
+type Consensus struct {
+	Method     string   `json:"method"`
+	Price      float64  `json:"price"`
+	Spread     float64  `json:"spread"`
+	Sources    int      `json:"sources"`
+	Providers  []string `json:"providers"`
+	Rejected   []string `json:"rejected"`
+	Confidence float64  `json:"confidence"`
+}
+
+type InfoOptions struct {
+	// Currency lists the currency codes to price in; empty means the
+	// service's default currencies.
+	Currency []string
+	// Consensus is median or vwap to get a consensus price.
+	Consensus string
+}
+
+// Info returns the prices and market data of symbol, one row per currency.
+func (c *Client) Info(ctx context.Context, symbol string, opts *InfoOptions) ([]Data, error) {
+	query := url.Values{}
+	if opts != nil {
+		if len(opts.Currency) > 0 {
+			query.Set("currency", strings.Join(opts.Currency, ","))
+		}
+		if opts.Consensus != "" {
+			query.Set("consensus", opts.Consensus)
+		}
+	}
+	var res []Data
+	err := c.Do(ctx, "GET", "/api/v2/"+url.PathEscape(symbol)+"/info", query, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
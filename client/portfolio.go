@@ -0,0 +1,47 @@
+package client
+
+import "context"
+
+type Holding struct {
+	Symbol   string  `json:"symbol"`
+	Quantity float64 `json:"quantity"`
+	// CostBasis is the total paid for the holding, in CostCurrency (USD by
+	// default).
+	CostBasis    *float64 `json:"costBasis,omitempty"`
+	CostCurrency string   `json:"costCurrency,omitempty"`
+}
+
+type PositionValue struct {
+	Symbol               string             `json:"symbol"`
+	Quantity             float64            `json:"quantity"`
+	Price                map[string]float64 `json:"price"`
+	Value                map[string]float64 `json:"value"`
+	Allocation           float64            `json:"allocation"`
+	CostBasis            map[string]float64 `json:"costBasis"`
+	UnrealizedPnl        map[string]float64 `json:"unrealizedPnl"`
+	UnrealizedPnlPercent *float64           `json:"unrealizedPnlPercent"`
+}
+
+type PortfolioValue struct {
+	Positions     []PositionValue    `json:"positions"`
+	Total         map[string]float64 `json:"total"`
+	CostBasis     map[string]float64 `json:"costBasis"`
+	UnrealizedPnl map[string]float64 `json:"unrealizedPnl"`
+	Provider      string             `json:"provider"`
+	Timestamp     int64              `json:"timestamp"`
+}
+
+// PortfolioValue values holdings in the given currencies, or the service's
+// default currencies when none are given.
+func (c *Client) PortfolioValue(ctx context.Context, holdings []Holding, currency []string) (*PortfolioValue, error) {
+	body := struct {
+		Holdings     []Holding `json:"holdings"`
+		CurrencyCode []string  `json:"currencyCode,omitempty"`
+	}{holdings, currency}
+	var res PortfolioValue
+	err := c.Do(ctx, "POST", "/api/v2/portfolio/value", nil, body, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
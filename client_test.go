@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"Upbit/client"
+)
+
+const testApiKey string = "test-key"
+
+// newTestServer serves the real router with the providers answered by a fake
+// upstream and Redis and Mongo unreachable, so every request misses the cache.
+func newTestServer(t *testing.T, wrap func(http.Handler) http.Handler) *httptest.Server {
+	app := newTestApp(t)
+	var h http.Handler = newRouter(app)
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestApp is the App behind newTestServer.
+func newTestApp(t *testing.T) *App {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/coinbase":
+			if r.URL.Query().Get("currency") == "USD" {
+				w.Write([]byte(`{"data":{"currency":"USD","rates":{"USD":"1","KRW":"1400","IDR":"16000","SGD":"1.35","THB":"36","BTC":"0.00002","ETH":"0.0005"}}}`))
+				return
+			}
+			if r.URL.Query().Get("currency") != "BTC" {
+				w.Write([]byte(`{"errors":[{"id":"not_found","message":"Currency is invalid"}]}`))
+				return
+			}
+			w.Write([]byte(`{"data":{"currency":"BTC","rates":{"KRW":"90000000","USD":"65000"}}}`))
+		case "/coinmarketcap":
+			w.Write([]byte(`{"status":{"error_code":0},"data":{"BTC":{"slug":"bitcoin","max_supply":21000000,"circulating_supply":19700000,"total_supply":19700000,"last_updated":"2024-01-01T00:00:00.000Z","quote":{"USD":{"price":65010,"volume_24h":1000,"market_cap":1280000000000}}}}}`))
+		case "/coingecko":
+			price := "65020"
+			if r.URL.Query().Get("vs_currency") == "KRW" {
+				price = "90010000"
+			}
+			w.Write([]byte(`[{"id":"bitcoin","symbol":"btc","name":"Bitcoin","current_price":` + price + `,"market_cap":1280000000000,"total_volume":1000,"circulating_supply":19700000,"max_supply":null,"last_updated":"2024-01-01T00:00:00.000Z"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	apis := []*string{&coinBaseApi, &coinMarketApi, &coinGeckoApi}
+	saved := []string{coinBaseApi, coinMarketApi, coinGeckoApi}
+	savedCfg := cfg
+	coinBaseApi = upstream.URL + "/coinbase"
+	coinMarketApi = upstream.URL + "/coinmarketcap"
+	coinGeckoApi = upstream.URL + "/coingecko"
+	cfg.Redis_Local.Host, cfg.Redis_Local.Port = "127.0.0.1", "1"
+	cfg.Mongo_Local.Host, cfg.Mongo_Local.Port = "127.0.0.1", "1"
+	cfg.Mongo_Local.Database = "id?serverSelectionTimeoutMS=100"
+	cfg.Auth.Enabled, cfg.Auth.AdminKey = true, testApiKey
+	t.Cleanup(func() {
+		for i, api := range apis {
+			*api = saved[i]
+		}
+		cfg = savedCfg
+	})
+
+	app := newApp(context.Background(), cfg)
+	t.Cleanup(func() { app.Close(context.Background()) })
+	return app
+}
+
+func TestClientInfo(t *testing.T) {
+	srv := newTestServer(t, nil)
+	c := client.New(srv.URL)
+	c.APIKey = testApiKey
+	data, err := c.Info(context.Background(), "btc", &client.InfoOptions{Currency: []string{"KRW", "USD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 {
+		t.Fatalf("got %d rows, want 2", len(data))
+	}
+	for _, d := range data {
+		if d.Symbol != "BTC" || d.Price <= 0 {
+			t.Errorf("unexpected row %+v", d)
+		}
+		if d.MaxSupply == nil || *d.MaxSupply != 21000000 {
+			t.Errorf("%s maxSupply = %v, want 21000000", d.CurrencyCode, d.MaxSupply)
+		}
+		if d.Provider == nil {
+			t.Errorf("%s provider is null", d.CurrencyCode)
+		}
+	}
+}
+
+func TestClientInfoNotFound(t *testing.T) {
+	srv := newTestServer(t, nil)
+	c := client.New(srv.URL)
+	c.APIKey = testApiKey
+	_, err := c.Info(context.Background(), "NOPE", nil)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		t.Fatalf("got %#v, want a 404 *client.Error", err)
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	srv := newTestServer(t, nil)
+	_, err := client.New(srv.URL).Info(context.Background(), "BTC", nil)
+	if !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var calls int32
+	srv := newTestServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				http.Error(w, "upstream unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	c := client.New(srv.URL)
+	c.APIKey = testApiKey
+	c.Backoff = time.Millisecond
+	_, err := c.Info(context.Background(), "BTC", &client.InfoOptions{Currency: []string{"USD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("got %d calls, want 2", calls)
+	}
+
+	c.Retries = 0
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Info(context.Background(), "BTC", nil)
+	if !errors.Is(err, client.ErrUnavailable) {
+		t.Fatalf("got %v, want ErrUnavailable", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	srv := newTestServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		})
+	})
+	c := client.New(srv.URL)
+	c.APIKey = testApiKey
+	c.HTTPClient.Timeout = 50 * time.Millisecond
+	c.Retries = 1
+	c.Backoff = time.Millisecond
+	start := time.Now()
+	_, err := c.Info(context.Background(), "BTC", nil)
+	if err == nil {
+		t.Fatal("got no error, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("took %v, want the timeout to stop it", elapsed)
+	}
+}
+
+func TestClientPortfolioValue(t *testing.T) {
+	srv := newTestServer(t, nil)
+	c := client.New(srv.URL)
+	c.APIKey = testApiKey
+	cost := 30000.0
+	res, err := c.PortfolioValue(context.Background(), []client.Holding{
+		{Symbol: "BTC", Quantity: 1, CostBasis: &cost},
+		{Symbol: "eth", Quantity: 25},
+	}, []string{"USD", "KRW"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(res.Total["USD"], 100000) || !near(res.Total["KRW"], 140000000) {
+		t.Errorf("total = %v, want 100000 USD and 140000000 KRW", res.Total)
+	}
+	if !near(res.Positions[0].Allocation, 50) || !near(res.Positions[1].Allocation, 50) {
+		t.Errorf("allocations = %v and %v, want 50 and 50", res.Positions[0].Allocation, res.Positions[1].Allocation)
+	}
+	if !near(res.UnrealizedPnl["USD"], 20000) {
+		t.Errorf("unrealized PnL = %v USD, want 20000", res.UnrealizedPnl["USD"])
+	}
+
+	_, err = c.PortfolioValue(context.Background(), []client.Holding{{Symbol: "NOPE", Quantity: 1}}, nil)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-6*math.Max(1, math.Abs(b))
+}
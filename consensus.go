@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// PriceSource is one provider's price for a currency. Volume is the 24h
+// traded value in the same currency, zero when the provider has none.
+type PriceSource struct {
+	Provider string  `json:"provider"`
+	Price    float64 `json:"price"`
+	Volume   float64 `json:"volume"`
+}
+
+type Consensus struct {
+	Method     string   `json:"method"`
+	Price      float64  `json:"price"`
+	Spread     float64  `json:"spread"`
+	Sources    int      `json:"sources"`
+	Providers  []string `json:"providers"`
+	Rejected   []string `json:"rejected"`
+	Confidence float64  `json:"confidence"`
+}
+
+// consensusMethods lists the accepted ?consensus= values, for error messages.
+const consensusMethods string = "median or vwap"
+
+// consensusMethod returns the consensus method for the request, or "" when
+// the plain provider cascade should answer it. ok is false when the request
+// asks for a method that doesn't exist.
+func consensusMethod(r *http.Request) (string, bool) {
+	return resolveConsensus(r.URL.Query().Get("consensus"))
+}
+
+// resolveConsensus is consensusMethod for a method requested outside HTTP. An
+// unknown method in the config falls back to the median.
+func resolveConsensus(method string) (string, bool) {
+	method = strings.ToLower(method)
+	if method == "" && cfg.Consensus.Enabled {
+		method = strings.ToLower(cfg.Consensus.Method)
+		if method != "vwap" {
+			method = "median"
+		}
+	}
+	switch method {
+	case "", "median", "vwap":
+		return method, true
+	}
+	return "", false
+}
+
+// collectPriceSources gathers every price fetched for the request, keyed by
+// currency code. It must run before the Upbit override of currencyPrice.
+func collectPriceSources(ctx context.Context, rds redis.UniversalClient, symbol string, currencyCode []string, currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) map[string][]PriceSource {
+	sources := make(map[string][]PriceSource)
+	for _, code := range currencyCode {
+		code = normalizeCode(code)
+		if price, ok := currencyPrice[code]; ok && price > 0 {
+			sources[code] = append(sources[code], PriceSource{"coinbase", price, 0})
+		}
+		if info, ok := tokenInfoMap[code]; ok {
+			price, _ := info["price"].(float64)
+			volume, _ := info["totalVolume"].(float64)
+			if price > 0 {
+				sources[code] = append(sources[code], PriceSource{"coingecko", price, volume})
+			}
+		}
+		if code == "USD" {
+			price, _ := tokenInfo["price"].(float64)
+			volume, _ := tokenInfo["volume24h"].(float64)
+			if price > 0 {
+				sources[code] = append(sources[code], PriceSource{"coinmarketcap", price, volume})
+			}
+		}
+		if ticker, ok := getUpbitTicker(ctx, rds, symbol, code); ok {
+			sources[code] = append(sources[code], PriceSource{"upbit", ticker.TradePrice, ticker.AccTradePrice24H})
+		}
+	}
+	return sources
+}
+
+// consensusMaxAge bounds how long an agreed price stands in for a fetch
+// whose sources don't agree.
+const consensusMaxAge = 10 * time.Minute
+
+// agreedPrices keeps the last price the sources agreed on per symbol and
+// currency, see computeConsensus.
+var agreedPrices = &agreedBook{prices: make(map[string]agreedPrice)}
+
+type agreedPrice struct {
+	price float64
+	at    time.Time
+}
+
+type agreedBook struct {
+	mu     sync.Mutex
+	prices map[string]agreedPrice
+}
+
+func (b *agreedBook) get(key string) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	agreed, ok := b.prices[key]
+	if !ok || time.Since(agreed.at) > consensusMaxAge {
+		return 0
+	}
+	return agreed.price
+}
+
+func (b *agreedBook) set(key string, price float64) {
+	b.mu.Lock()
+	b.prices[key] = agreedPrice{price, time.Now()}
+	b.mu.Unlock()
+}
+
+func applyConsensus(res []Data, sources map[string][]PriceSource, method string) {
+	if method == "" {
+		return
+	}
+	for i := range res {
+		key := res[i].Symbol + "-" + res[i].CurrencyCode
+		consensus, ok := computeConsensus(sources[res[i].CurrencyCode], method, cfg.Consensus.Threshold, agreedPrices.get(key))
+		if !ok {
+			continue
+		}
+		if consensus.Sources >= 2 {
+			agreedPrices.set(key, consensus.Price)
+		}
+		if consensus.Price > 0 {
+			res[i].Price = consensus.Price
+		}
+		res[i].Consensus = &consensus
+	}
+}
+
+// computeConsensus discards the sources deviating from the median by more
+// than threshold and prices the rest by median or volume weight. When two or
+// more sources are fetched but fewer than two of them agree, there is no
+// telling the glitch from the good price: Sources and Confidence are 0, every
+// source is rejected and Price is previous, the last agreed price, or 0 when
+// there is none. Confidence falls with the share of rejected sources, with
+// the spread of the kept ones relative to the threshold, and when fewer than
+// three sources agree.
+func computeConsensus(sources []PriceSource, method string, threshold float64, previous float64) (Consensus, bool) {
+	if len(sources) == 0 {
+		return Consensus{}, false
+	}
+	if threshold <= 0 {
+		threshold = 0.05
+	}
+	var prices []float64
+	for _, source := range sources {
+		prices = append(prices, source.Price)
+	}
+	median := medianOf(prices)
+
+	consensus := Consensus{Method: method, Providers: []string{}, Rejected: []string{}}
+	var kept []PriceSource
+	for _, source := range sources {
+		if math.Abs(source.Price-median)/median > threshold {
+			consensus.Rejected = append(consensus.Rejected, source.Provider)
+			continue
+		}
+		kept = append(kept, source)
+		consensus.Providers = append(consensus.Providers, source.Provider)
+	}
+	if len(kept) == 0 || (len(sources) > 1 && len(kept) < 2) {
+		consensus.Providers = []string{}
+		consensus.Rejected = []string{}
+		for _, source := range sources {
+			consensus.Rejected = append(consensus.Rejected, source.Provider)
+		}
+		consensus.Price = previous
+		return consensus, true
+	}
+
+	low, high := kept[0].Price, kept[0].Price
+	var keptPrices []float64
+	var weighted, volume float64
+	for _, source := range kept {
+		keptPrices = append(keptPrices, source.Price)
+		low = math.Min(low, source.Price)
+		high = math.Max(high, source.Price)
+		weighted += source.Price * source.Volume
+		volume += source.Volume
+	}
+	consensus.Price = medianOf(keptPrices)
+	if method == "vwap" && volume > 0 {
+		consensus.Price = weighted / volume
+	}
+	consensus.Sources = len(kept)
+	consensus.Spread = (high - low) / consensus.Price * 100
+
+	confidence := float64(len(kept)) / float64(len(sources))
+	confidence *= math.Max(0, 1-consensus.Spread/(threshold*100))
+	if len(kept) < 3 {
+		confidence *= float64(len(kept)) / 3
+	}
+	consensus.Confidence = math.Round(confidence*100) / 100
+	return consensus, true
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestComputeConsensus(t *testing.T) {
+	agreeing := []PriceSource{{"coinbase", 100, 0}, {"coingecko", 101, 30}, {"coinmarketcap", 102, 10}}
+	outlier := []PriceSource{{"coinbase", 100, 10}, {"coingecko", 101, 30}, {"upbit", 150, 0}}
+	for _, tc := range []struct {
+		name       string
+		sources    []PriceSource
+		method     string
+		previous   float64
+		price      float64
+		count      int
+		providers  string
+		rejected   string
+		confidence float64
+	}{
+		{"median", agreeing, "median", 0, 101, 3, "coinbase,coingecko,coinmarketcap", "", 0.6},
+		{"vwap", agreeing, "vwap", 0, (101*30 + 102*10) / 40.0, 3, "coinbase,coingecko,coinmarketcap", "", 0.6},
+		{"vwap without volume", []PriceSource{{"coinbase", 100, 0}, {"coingecko", 102, 0}}, "vwap", 0, 101, 2, "coinbase,coingecko", "", 0.4},
+		{"outlier rejected", outlier, "median", 0, 100.5, 2, "coinbase,coingecko", "upbit", 0.36},
+		{"outlier rejected by vwap", outlier, "vwap", 0, 100.75, 2, "coinbase,coingecko", "upbit", 0.36},
+		{"single source", []PriceSource{{"coinbase", 100, 0}}, "median", 0, 100, 1, "coinbase", "", 0.33},
+		{"two disagreeing", []PriceSource{{"coinbase", 1000, 0}, {"upbit", 100, 0}}, "median", 0, 0, 0, "", "coinbase,upbit", 0},
+		{"two disagreeing after an agreed price", []PriceSource{{"coinbase", 1000, 0}, {"upbit", 100, 0}}, "median", 99, 99, 0, "", "coinbase,upbit", 0},
+		{"one of three agreeing", []PriceSource{{"coinbase", 100, 0}, {"coingecko", 200, 0}, {"upbit", 1000, 0}}, "median", 0, 0, 0, "", "coinbase,coingecko,upbit", 0},
+		{"spread beyond the threshold", []PriceSource{{"coinbase", 100, 0}, {"coingecko", 104.9, 0}, {"upbit", 100, 0}}, "median", 0, 100, 3, "coinbase,coingecko,upbit", "", 0.02},
+	} {
+		got, ok := computeConsensus(tc.sources, tc.method, 0.05, tc.previous)
+		if !ok {
+			t.Errorf("%s: no consensus", tc.name)
+			continue
+		}
+		if math.Abs(got.Price-tc.price) > 1e-9 || got.Sources != tc.count || got.Confidence != tc.confidence ||
+			strings.Join(got.Providers, ",") != tc.providers || strings.Join(got.Rejected, ",") != tc.rejected {
+			t.Errorf("%s: got %+v", tc.name, got)
+		}
+	}
+	if _, ok := computeConsensus(nil, "median", 0.05, 0); ok {
+		t.Errorf("consensus without sources")
+	}
+}
+
+func TestApplyConsensusKeepsAgreedPrice(t *testing.T) {
+	res := []Data{{Symbol: "CTEST", CurrencyCode: "USD", Price: 100}}
+	applyConsensus(res, map[string][]PriceSource{"USD": {{"coinbase", 100, 0}, {"coingecko", 102, 0}}}, "median")
+	if res[0].Price != 101 {
+		t.Fatalf("agreed price %v, want 101", res[0].Price)
+	}
+	// A 10x glitch on one of two sources doesn't get through.
+	res = []Data{{Symbol: "CTEST", CurrencyCode: "USD", Price: 1000}}
+	applyConsensus(res, map[string][]PriceSource{"USD": {{"coinbase", 1000, 0}, {"upbit", 100, 0}}}, "median")
+	if res[0].Price != 101 || res[0].Consensus.Sources != 0 || res[0].Consensus.Confidence != 0 {
+		t.Fatalf("got %v with %+v, want the agreed 101 at no confidence", res[0].Price, res[0].Consensus)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// degradedHeader lists, comma separated, the datastores unreachable when the
+// request came in, whose in-process fallbacks answer instead.
+const degradedHeader string = "X-Degraded"
+
+const (
+	defaultLocalCacheSize     = 10000
+	defaultProbeInterval      = 5 * time.Second
+	datastoreProbeTimeout     = 2 * time.Second
+	defaultSymbolSnapshotPath = "data/symbols.json"
+)
+
+// lruCache stands in for the Redis caches while Redis is unreachable. Every
+// write goes to both, so it is warm when Redis goes away.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	if size <= 0 {
+		size = defaultLocalCacheSize
+	}
+	return &lruCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.items, key)
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lruCache) set(key string, value string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value = &lruEntry{key, value, time.Now().Add(ttl)}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key, value, time.Now().Add(ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// localLimiter stands in for the Redis sliding windows while Redis is
+// unreachable. Each replica then limits on its own, which is stricter than
+// letting every request through.
+type localLimiter struct {
+	mu      sync.Mutex
+	size    int
+	windows map[string]*localWindow
+}
+
+type localWindow struct {
+	hits    []time.Time
+	expires time.Time
+}
+
+func newLocalLimiter(size int) *localLimiter {
+	if size <= 0 {
+		size = defaultLocalCacheSize
+	}
+	return &localLimiter{size: size, windows: make(map[string]*localWindow)}
+}
+
+// allow is the slidingWindow script over the in-process windows.
+func (l *localLimiter) allow(key string, rule RateLimitRule, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	window := time.Duration(rule.Window) * time.Second
+	w, ok := l.windows[key]
+	if !ok {
+		if len(l.windows) >= l.size {
+			l.sweep(now)
+		}
+		w = &localWindow{}
+		l.windows[key] = w
+	}
+	kept := w.hits[:0]
+	for _, hit := range w.hits {
+		if hit.After(now.Add(-window)) {
+			kept = append(kept, hit)
+		}
+	}
+	w.hits = kept
+	if len(w.hits) >= rule.Requests {
+		wait := w.hits[0].Add(window).Sub(now)
+		return false, int((wait + time.Second - 1) / time.Second)
+	}
+	w.hits = append(w.hits, now)
+	w.expires = now.Add(window)
+	return true, 0
+}
+
+// sweep drops the windows whose requests have all left them.
+func (l *localLimiter) sweep(now time.Time) {
+	for key, w := range l.windows {
+		if !now.Before(w.expires) {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// symbolMap is the CoinGecko symbol list kept in memory, for lookups while
+// Mongo is unreachable.
+type symbolMap struct {
+	mu  sync.RWMutex
+	ids map[string][]SymbolId
+}
+
+func (m *symbolMap) load(symbolIds []SymbolId) {
+	ids := make(map[string][]SymbolId)
+	for _, symbolId := range symbolIds {
+		ids[symbolId.Symbol] = append(ids[symbolId.Symbol], symbolId)
+	}
+	m.mu.Lock()
+	m.ids = ids
+	m.mu.Unlock()
+}
+
+func (m *symbolMap) get(symbol string) []SymbolId {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ids[symbol]
+}
+
+func (m *symbolMap) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.ids)
+}
+
+// datastores tracks which of redis and mongo are unreachable, and since when.
+type datastores struct {
+	mu   sync.Mutex
+	down map[string]time.Time
+}
+
+func (d *datastores) markDown(ctx context.Context, name string, err error) {
+	d.mu.Lock()
+	_, already := d.down[name]
+	if !already {
+		d.down[name] = time.Now().UTC()
+	}
+	d.mu.Unlock()
+	if !already {
+		serverLog.Warn(ctx, "datastore unreachable, serving degraded", "datastore", name, "error", err)
+		datastoreDown.WithLabelValues(name).Set(1)
+	}
+}
+
+func (d *datastores) markUp(ctx context.Context, name string) {
+	d.mu.Lock()
+	_, was := d.down[name]
+	delete(d.down, name)
+	d.mu.Unlock()
+	if was {
+		serverLog.Info(ctx, "datastore reachable again", "datastore", name)
+		datastoreDown.WithLabelValues(name).Set(0)
+	}
+}
+
+func (d *datastores) isDown(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.down[name]
+	return ok
+}
+
+// since returns the datastores down with the time they were found so.
+func (d *datastores) since() map[string]time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	since := make(map[string]time.Time, len(d.down))
+	for name, t := range d.down {
+		since[name] = t
+	}
+	return since
+}
+
+func (d *datastores) names() []string {
+	var names []string
+	for name := range d.since() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unreachable tells the network, timeout and connection errors of an
+// unreachable datastore from the errors it answers with, such as a missing
+// key or WRONGTYPE, and from requests that went away.
+func unreachable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	var selectionErr topology.ServerSelectionError
+	var checkoutErr topology.WaitQueueTimeoutError
+	switch {
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.Is(err, redis.ErrClosed), errors.Is(err, mongo.ErrClientDisconnected),
+		mongo.IsNetworkError(err), mongo.IsTimeout(err),
+		errors.As(err, &selectionErr), errors.As(err, &checkoutErr):
+		return true
+	}
+	// go-redis doesn't export its pool timeout, nor the error of a sentinel
+	// group that can't be reached.
+	msg := err.Error()
+	return strings.HasPrefix(msg, "redis: connection pool timeout") ||
+		strings.HasPrefix(msg, "redis: all sentinels specified in configuration are unreachable")
+}
+
+// cacheGet reads key from Redis or, while Redis is unreachable, from the
+// local cache.
+func (a *App) cacheGet(ctx context.Context, key string) (string, bool) {
+	if !a.stores.isDown("redis") {
+		rds := a.Redis
+		res, err := rds.Get(ctx, key).Result()
+		if err == nil {
+			return res, true
+		}
+		if !unreachable(ctx, err) {
+			return "", false
+		}
+		cacheLog.Warn(ctx, "error reading the cache", "key", key, "error", err)
+		countError("redis")
+		a.stores.markDown(ctx, "redis", err)
+	}
+	return a.local.get(key)
+}
+
+// cacheExists is cacheGet for callers only asking whether key is cached.
+func (a *App) cacheExists(ctx context.Context, key string) bool {
+	if !a.stores.isDown("redis") {
+		rds := a.Redis
+		n, err := rds.Exists(ctx, key).Result()
+		if err == nil {
+			return n > 0
+		}
+		if !unreachable(ctx, err) {
+			return false
+		}
+		a.stores.markDown(ctx, "redis", err)
+	}
+	_, ok := a.local.get(key)
+	return ok
+}
+
+// cacheSet writes key to the local cache and, unless it is unreachable, to
+// Redis.
+func (a *App) cacheSet(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	a.local.set(key, string(value), ttl)
+	if a.stores.isDown("redis") {
+		return
+	}
+	rds := a.Redis
+	err := rds.Set(ctx, key, value, ttl).Err()
+	if err != nil {
+		cacheLog.Warn(ctx, "error writing the cache", "key", key, "error", err)
+		countError("redis")
+		if unreachable(ctx, err) {
+			a.stores.markDown(ctx, "redis", err)
+		}
+	}
+}
+
+// runDatastoreProbe pings Redis and Mongo every probe interval until ctx is
+// done, so that a datastore found unreachable is used again once it is back.
+func (a *App) runDatastoreProbe(ctx context.Context) {
+	interval := time.Duration(cfg.Degraded.ProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.probeDatastores(ctx)
+		}
+	}
+}
+
+func (a *App) probeDatastores(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, datastoreProbeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, check := range []func(context.Context) error{a.checkRedis, a.checkMongo} {
+		wg.Add(1)
+		go func(check func(context.Context) error) {
+			defer wg.Done()
+			check(ctx)
+		}(check)
+	}
+	wg.Wait()
+}
+
+// loadSymbols fills the in-memory symbol list from the local snapshot or,
+// when there is none, from Mongo.
+func (a *App) loadSymbols(ctx context.Context) {
+	path := symbolSnapshotPath()
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		var symbolIds []SymbolId
+		err = json.Unmarshal(b, &symbolIds)
+		if err == nil && len(symbolIds) > 0 {
+			a.symbols.load(symbolIds)
+			syncLog.Info(ctx, "loaded the symbol snapshot", "path", path, "symbols", len(symbolIds))
+			return
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		syncLog.Warn(ctx, "error reading the symbol snapshot", "path", path, "error", err)
+	}
+	co := a.Mongo
+	if co == nil {
+		return
+	}
+	cursor, err := symbolCollection(co).Find(ctx, bson.M{})
+	if err != nil {
+		storeLog.Warn(ctx, "error finding CoinGecko symbols", "error", err)
+		return
+	}
+	var symbolIds []SymbolId
+	err = cursor.All(ctx, &symbolIds)
+	if err != nil || len(symbolIds) == 0 {
+		storeLog.Warn(ctx, "no CoinGecko symbols to keep in memory", "error", err)
+		return
+	}
+	a.symbols.load(symbolIds)
+	saveSymbolSnapshot(ctx, symbolIds)
+}
+
+// saveSymbolSnapshot writes the symbol list next to the binary, through a
+// temporary file so that a crash never leaves it half written.
+func saveSymbolSnapshot(ctx context.Context, symbolIds []SymbolId) {
+	path := symbolSnapshotPath()
+	b, err := json.Marshal(symbolIds)
+	if err != nil {
+		syncLog.Warn(ctx, "error encoding the symbol snapshot", "error", err)
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", b, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		syncLog.Warn(ctx, "error writing the symbol snapshot", "path", path, "error", err)
+	}
+}
+
+func symbolSnapshotPath() string {
+	if cfg.Degraded.SymbolSnapshot != "" {
+		return cfg.Degraded.SymbolSnapshot
+	}
+	return defaultSymbolSnapshotPath
+}
+
+// flagDegraded sets degradedHeader on the responses served while a datastore
+// is unreachable.
+func (a *App) flagDegraded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if names := a.stores.names(); len(names) > 0 {
+			w.Header().Set(degradedHeader, strings.Join(names, ","))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// flagDegradedRPC is flagDegraded for gRPC, as x-degraded header metadata.
+func (a *App) flagDegradedRPC(ctx context.Context) {
+	if names := a.stores.names(); len(names) > 0 {
+		grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(degradedHeader), strings.Join(names, ",")))
+	}
+}
+
+// degradedFrom reads back the datastores flagDegraded listed on w.
+func degradedFrom(w http.ResponseWriter) []string {
+	header := w.Header().Get(degradedHeader)
+	if header == "" {
+		return nil
+	}
+	return strings.Split(header, ",")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.set("a", "1", time.Minute)
+	c.set("b", "2", time.Minute)
+	if v, ok := c.get("a"); !ok || v != "1" {
+		t.Fatalf("get a = %q, %v", v, ok)
+	}
+	// b is now the least recently used and goes first.
+	c.set("c", "3", time.Minute)
+	if _, ok := c.get("b"); ok {
+		t.Error("b outlived the size limit")
+	}
+	c.set("a", "4", time.Minute)
+	for key, want := range map[string]string{"a": "4", "c": "3"} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("get %s = %q, %v, want %q", key, v, ok, want)
+		}
+	}
+	// d evicts c, then is dropped as expired on read.
+	c.set("d", "5", -time.Second)
+	if _, ok := c.get("d"); ok {
+		t.Error("expired entry served")
+	}
+	if c.order.Len() != 1 || len(c.items) != 1 {
+		t.Errorf("%d entries listed, %d indexed, want 1", c.order.Len(), len(c.items))
+	}
+}
+
+func TestLocalLimiter(t *testing.T) {
+	l := newLocalLimiter(1)
+	rule := RateLimitRule{Requests: 2, Window: 10}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("k", rule, now.Add(time.Duration(i)*time.Second)); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	ok, wait := l.allow("k", rule, now.Add(2*time.Second))
+	if ok || wait != 8 {
+		t.Fatalf("third request: allowed %v, wait %d, want refused for 8s", ok, wait)
+	}
+	if ok, _ := l.allow("k", rule, now.Add(10*time.Second)); !ok {
+		t.Fatal("request refused after the first one left the window")
+	}
+	// A new key beyond the size sweeps the windows gone idle.
+	if ok, _ := l.allow("other", rule, now.Add(time.Minute)); !ok || len(l.windows) != 1 {
+		t.Fatalf("allowed %v with %d windows, want 1", ok, len(l.windows))
+	}
+}
+
+func TestAllowRequestWithoutRedis(t *testing.T) {
+	app := newTestApp(t)
+	rule := RateLimitRule{Requests: 1, Window: 60}
+	ctx := context.Background()
+	if ok, _ := app.allowRequest(ctx, "k", rule); !ok {
+		t.Fatal("first request refused")
+	}
+	if !app.stores.isDown("redis") {
+		t.Fatal("redis not marked down")
+	}
+	ok, wait := app.allowRequest(ctx, "k", rule)
+	if ok || wait <= 0 {
+		t.Fatalf("second request: allowed %v, wait %d, want the local limit", ok, wait)
+	}
+}
+
+func TestGetSymbolIdFromSnapshot(t *testing.T) {
+	app := newTestApp(t)
+	path := filepath.Join(t.TempDir(), "symbols.json")
+	cfg.Degraded.SymbolSnapshot = path
+	err := ioutil.WriteFile(path, []byte(`[{"id":"bitcoin","symbol":"btc","name":"Bitcoin"},{"id":"ethereum","symbol":"eth","name":"Ethereum"}]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	app.loadSymbols(ctx)
+	if app.symbols.len() != 2 {
+		t.Fatalf("%d symbols loaded, want 2", app.symbols.len())
+	}
+	if id := app.getSymbolId(ctx, " BTC"); id != "bitcoin" {
+		t.Fatalf("id = %q, want bitcoin from the snapshot", id)
+	}
+	if !app.stores.isDown("mongo") {
+		t.Error("mongo not marked down")
+	}
+	if id := app.getSymbolId(ctx, "NOPE"); id != "" {
+		t.Errorf("id = %q for an unknown symbol", id)
+	}
+}
+
+func TestFlagDegraded(t *testing.T) {
+	app := &App{stores: &datastores{down: make(map[string]time.Time)}}
+	h := app.flagDegraded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	header := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Header().Get(degradedHeader)
+	}
+	ctx := context.Background()
+	if got := header(); got != "" {
+		t.Fatalf("flagged %q with every datastore up", got)
+	}
+	app.stores.markDown(ctx, "redis", errors.New("refused"))
+	app.stores.markDown(ctx, "mongo", errors.New("refused"))
+	if got := header(); got != "mongo,redis" {
+		t.Fatalf("flagged %q, want mongo,redis", got)
+	}
+	app.stores.markUp(ctx, "mongo")
+	if got := header(); got != "redis" {
+		t.Fatalf("flagged %q, want redis", got)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	f, rds := newFakeRedis(t)
+	rds.HSet(context.Background(), "h", "field", "1")
+	_, wrongType := rds.Get(context.Background(), "h").Result()
+	if wrongType == nil || wrongType.Error()[:9] != "WRONGTYPE" {
+		t.Fatalf("GET of a hash answered %v", wrongType)
+	}
+	f.failing["GET"] = true
+	_, answered := rds.Get(context.Background(), "k").Result()
+	closed, stopped := newFakeRedis(t)
+	closed.close()
+	_, refused := stopped.Get(context.Background(), "k").Result()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"no error", context.Background(), nil, false},
+		{"missing key", context.Background(), redis.Nil, false},
+		{"no documents", context.Background(), mongo.ErrNoDocuments, false},
+		{"redis error answer", context.Background(), answered, false},
+		{"wrong type", context.Background(), wrongType, false},
+		{"connection refused", context.Background(), refused, true},
+		{"connection dropped", context.Background(), io.EOF, true},
+		{"deadline", context.Background(), context.DeadlineExceeded, true},
+		{"client closed", context.Background(), redis.ErrClosed, true},
+		{"pool timeout", context.Background(), errors.New("redis: connection pool timeout"), true},
+		{"no mongo server", context.Background(), topology.ServerSelectionError{Wrapped: topology.ErrServerSelectionTimeout}, true},
+		{"request gone", cancelled, refused, false},
+	} {
+		if got := unreachable(tc.ctx, tc.err); got != tc.want {
+			t.Errorf("%s (%v): unreachable %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestCacheGetErrorAnswer(t *testing.T) {
+	app := newTestApp(t)
+	f, rds := newFakeRedis(t)
+	app.Redis = rds
+	app.stores.markUp(context.Background(), "redis")
+	f.failing["GET"] = true
+	if _, hit := app.cacheGet(context.Background(), "k"); hit {
+		t.Error("hit on an error answer")
+	}
+	if app.stores.isDown("redis") {
+		t.Error("redis marked down for an error it answered with")
+	}
+}
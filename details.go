@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+)
+
+type Roi struct {
+	Times      float64 `json:"times"`
+	Currency   string  `json:"currency"`
+	Percentage float64 `json:"percentage"`
+}
+
+// Details is the extended market data of a symbol in one currency. Fields no
+// provider supplied are null.
+type Details struct {
+	Symbol                       string     `json:"symbol"`
+	CurrencyCode                 string     `json:"currencyCode"`
+	Id                           string     `json:"id"`
+	Name                         string     `json:"name"`
+	Image                        string     `json:"image"`
+	Price                        *float64   `json:"price"`
+	MarketCap                    *float64   `json:"marketCap"`
+	MarketCapRank                *float64   `json:"marketCapRank"`
+	FullyDilutedValuation        *float64   `json:"fullyDilutedValuation"`
+	TotalVolume                  *float64   `json:"totalVolume"`
+	High24H                      *float64   `json:"high24h"`
+	Low24H                       *float64   `json:"low24h"`
+	PriceChange24H               *float64   `json:"priceChange24h"`
+	PriceChangePercentage24H     *float64   `json:"priceChangePercentage24h"`
+	MarketCapChange24H           *float64   `json:"marketCapChange24h"`
+	MarketCapChangePercentage24H *float64   `json:"marketCapChangePercentage24h"`
+	CirculatingSupply            *float64   `json:"circulatingSupply"`
+	TotalSupply                  *float64   `json:"totalSupply"`
+	MaxSupply                    *float64   `json:"maxSupply"`
+	Ath                          *float64   `json:"ath"`
+	AthChangePercentage          *float64   `json:"athChangePercentage"`
+	AthDate                      *time.Time `json:"athDate"`
+	Atl                          *float64   `json:"atl"`
+	AtlChangePercentage          *float64   `json:"atlChangePercentage"`
+	AtlDate                      *time.Time `json:"atlDate"`
+	Roi                          *Roi       `json:"roi"`
+	LastUpdated                  *time.Time `json:"lastUpdated"`
+	Providers                    []string   `json:"providers"`
+}
+
+// detailsHandler answers /api/{symbol}/details for the currencies given in
+// the body as for /info, or in ?currency=. CoinGecko is the primary source;
+// CoinMarketCap fills what it also reports (USD figures and supplies),
+// Coinbase the missing prices and Upbit the price and volume of its markets.
+func (a *App) detailsHandler(w http.ResponseWriter, r *http.Request) {
+	symbolPro := normalizeCode(mux.Vars(r)["symbol"])
+	currencyCode := splitParam(r.URL.Query().Get("currency"))
+	if len(currencyCode) == 0 {
+		currencyCode = currencyCodeDefault
+		body, err := ioutil.ReadAll(r.Body)
+		var requestBody RequestBody
+		if err == nil && json.Unmarshal(body, &requestBody) == nil && len(requestBody.CurrencyCode) > 0 {
+			currencyCode = requestBody.CurrencyCode
+		}
+	}
+	meterCodes(r, nil, currencyCode)
+	if !a.allowUpstream(w, r, len(currencyCode)+2) {
+		return
+	}
+	ctx := r.Context()
+	rds := a.Redis
+
+	tokenInfoMap, coinGeckoErr := a.getCoinGeckoInfo(ctx, nil, symbolPro, currencyCode)
+	tokenInfo, coinMarketErr := getCoinMarketInfo(ctx, nil, symbolPro)
+	rates, coinBaseErr := getCoinBaseRates(ctx, symbolPro)
+	if coinGeckoErr != nil && coinMarketErr != nil && coinBaseErr != nil {
+		writeError(w, http.StatusNotFound, "cryptocurrency "+symbolPro+" doesn't exist")
+		return
+	}
+
+	res := make([]Details, 0)
+	for _, code := range currencyCode {
+		code = normalizeCode(code)
+		details := Details{Symbol: symbolPro, CurrencyCode: code, Providers: []string{}}
+		if market, ok := tokenInfoMap[code]["market"].(string); ok {
+			details.mergeCoinGecko(gjson.Parse(market))
+		}
+		if listing, ok := tokenInfo["listing"].(string); ok && coinMarketErr == nil {
+			details.mergeCoinMarket(gjson.Parse(listing))
+		}
+		if rate := rates[code]; rate > 0 && details.Price == nil {
+			details.Price = &rate
+			details.Providers = append(details.Providers, "coinbase")
+		}
+		if ticker, ok := getUpbitTicker(ctx, rds, symbolPro, code); ok {
+			price, volume := ticker.TradePrice, ticker.AccTradePrice24H
+			details.Price = &price
+			if details.TotalVolume == nil {
+				details.TotalVolume = &volume
+			}
+			details.Providers = append(details.Providers, "upbit")
+		}
+		res = append(res, details)
+	}
+	writeJSON(w, res)
+}
+
+// mergeCoinGecko takes the fields of the raw CoinGecko market. Numbers
+// CoinGecko sent, zeros included, are kept; missing and null ones stay null.
+func (d *Details) mergeCoinGecko(market gjson.Result) {
+	d.Id = market.Get("id").String()
+	d.Name = market.Get("name").String()
+	d.Image = market.Get("image").String()
+	d.Price = number(market, "current_price")
+	d.MarketCap = number(market, "market_cap")
+	d.MarketCapRank = number(market, "market_cap_rank")
+	d.FullyDilutedValuation = number(market, "fully_diluted_valuation")
+	d.TotalVolume = number(market, "total_volume")
+	d.High24H = number(market, "high_24h")
+	d.Low24H = number(market, "low_24h")
+	d.PriceChange24H = number(market, "price_change_24h")
+	d.PriceChangePercentage24H = number(market, "price_change_percentage_24h")
+	d.MarketCapChange24H = number(market, "market_cap_change_24h")
+	d.MarketCapChangePercentage24H = number(market, "market_cap_change_percentage_24h")
+	d.CirculatingSupply = number(market, "circulating_supply")
+	d.TotalSupply = number(market, "total_supply")
+	d.MaxSupply = number(market, "max_supply")
+	d.Ath = number(market, "ath")
+	d.AthChangePercentage = number(market, "ath_change_percentage")
+	d.AthDate = timestamp(market, "ath_date")
+	d.Atl = number(market, "atl")
+	d.AtlChangePercentage = number(market, "atl_change_percentage")
+	d.AtlDate = timestamp(market, "atl_date")
+	d.LastUpdated = timestamp(market, "last_updated")
+	if roi := market.Get("roi"); roi.IsObject() {
+		var value Roi
+		if json.Unmarshal([]byte(roi.Raw), &value) == nil {
+			d.Roi = &value
+		}
+	}
+	d.Providers = append(d.Providers, "coingecko")
+}
+
+// mergeCoinMarket fills the fields still null from the raw CoinMarketCap
+// listing, and credits CoinMarketCap only when it filled one.
+func (d *Details) mergeCoinMarket(listing gjson.Result) {
+	filled := false
+	fill := func(field **float64, path string) {
+		if *field == nil {
+			*field = number(listing, path)
+			filled = filled || *field != nil
+		}
+	}
+	fill(&d.CirculatingSupply, "circulating_supply")
+	fill(&d.TotalSupply, "total_supply")
+	fill(&d.MaxSupply, "max_supply")
+	fill(&d.MarketCapRank, "cmc_rank")
+	if d.CurrencyCode == "USD" {
+		fill(&d.Price, "quote.USD.price")
+		fill(&d.MarketCap, "quote.USD.market_cap")
+		fill(&d.TotalVolume, "quote.USD.volume_24h")
+		fill(&d.PriceChangePercentage24H, "quote.USD.percent_change_24h")
+		fill(&d.FullyDilutedValuation, "quote.USD.fully_diluted_market_cap")
+	}
+	if d.LastUpdated == nil {
+		d.LastUpdated = timestamp(listing, "last_updated")
+		filled = filled || d.LastUpdated != nil
+	}
+	if filled {
+		d.Providers = append(d.Providers, "coinmarketcap")
+	}
+}
+
+// number returns the number at path, nil when the provider left it out or
+// sent null.
+func number(raw gjson.Result, path string) *float64 {
+	value := raw.Get(path)
+	if value.Type != gjson.Number {
+		return nil
+	}
+	n := value.Float()
+	return &n
+}
+
+func timestamp(raw gjson.Result, path string) *time.Time {
+	value, err := time.Parse(time.RFC3339, raw.Get(path).String())
+	if err != nil {
+		return nil
+	}
+	return &value
+}
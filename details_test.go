@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDetailsDefaultCurrencies(t *testing.T) {
+	srv := newTestServer(t, nil)
+	for _, body := range []string{"", "{}", `{"currencyCode":[]}`} {
+		req, _ := http.NewRequest("POST", srv.URL+"/api/BTC/details", strings.NewReader(body))
+		req.Header.Set("X-API-Key", testApiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []Details
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("body %q: %v", body, err)
+		}
+		var codes []string
+		for _, details := range res {
+			codes = append(codes, details.CurrencyCode)
+		}
+		if !reflect.DeepEqual(codes, currencyCodeDefault) {
+			t.Errorf("body %q: currencies %v, want %v", body, codes, currencyCodeDefault)
+		}
+	}
+}
+
+func TestMergeCoinGecko(t *testing.T) {
+	market := gjson.Parse(`{"id":"bitcoin","name":"Bitcoin","current_price":65020,"price_change_24h":0,"market_cap_rank":1,"max_supply":null,"ath_date":"2024-03-14T07:10:36.635Z","roi":{"times":2.5,"currency":"usd","percentage":250}}`)
+	var d Details
+	d.mergeCoinGecko(market)
+	if d.Id != "bitcoin" || d.Name != "Bitcoin" {
+		t.Errorf("id %q name %q", d.Id, d.Name)
+	}
+	if d.Price == nil || *d.Price != 65020 {
+		t.Errorf("price %v, want 65020", d.Price)
+	}
+	if d.PriceChange24H == nil || *d.PriceChange24H != 0 {
+		t.Errorf("priceChange24h %v, want a real 0", d.PriceChange24H)
+	}
+	if d.MaxSupply != nil {
+		t.Errorf("maxSupply %v, want null", *d.MaxSupply)
+	}
+	if d.TotalVolume != nil {
+		t.Errorf("totalVolume %v, want null when missing", *d.TotalVolume)
+	}
+	if d.AthDate == nil || d.AthDate.Year() != 2024 {
+		t.Errorf("athDate %v", d.AthDate)
+	}
+	if d.Roi == nil || d.Roi.Times != 2.5 {
+		t.Errorf("roi %v", d.Roi)
+	}
+	if !reflect.DeepEqual(d.Providers, []string{"coingecko"}) {
+		t.Errorf("providers %v", d.Providers)
+	}
+}
+
+func TestMergeCoinMarket(t *testing.T) {
+	price := 65020.0
+	complete := Details{Price: &price, CirculatingSupply: &price, TotalSupply: &price, MaxSupply: &price, MarketCapRank: &price}
+	for _, tc := range []struct {
+		name      string
+		details   Details
+		listing   string
+		providers []string
+		check     func(Details) bool
+	}{
+		{"fills USD", Details{CurrencyCode: "USD"}, `{"quote":{"USD":{"price":65010,"percent_change_24h":0}}}`, []string{"coinmarketcap"},
+			func(d Details) bool {
+				return *d.Price == 65010 && d.PriceChangePercentage24H != nil && *d.PriceChangePercentage24H == 0 && d.MarketCap == nil
+			}},
+		{"no USD quote in KRW", Details{CurrencyCode: "KRW"}, `{"quote":{"USD":{"price":65010}}}`, nil,
+			func(d Details) bool { return d.Price == nil }},
+		{"keeps CoinGecko", complete, `{"circulating_supply":1,"total_supply":1,"max_supply":1,"cmc_rank":2}`, nil,
+			func(d Details) bool { return *d.CirculatingSupply == price && *d.MarketCapRank == price }},
+		{"null supplies", Details{CurrencyCode: "KRW"}, `{"max_supply":null,"total_supply":null}`, nil,
+			func(d Details) bool { return d.MaxSupply == nil && d.TotalSupply == nil }},
+		{"zero supply", Details{CurrencyCode: "KRW"}, `{"circulating_supply":0}`, []string{"coinmarketcap"},
+			func(d Details) bool { return d.CirculatingSupply != nil && *d.CirculatingSupply == 0 }},
+	} {
+		d := tc.details
+		d.mergeCoinMarket(gjson.Parse(tc.listing))
+		if !reflect.DeepEqual(d.Providers, tc.providers) {
+			t.Errorf("%s: providers %v, want %v", tc.name, d.Providers, tc.providers)
+		}
+		if !tc.check(d) {
+			t.Errorf("%s: unexpected details %+v", tc.name, d)
+		}
+	}
+}
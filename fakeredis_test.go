@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedis is a minimal RESP server keeping strings, hashes and streams in
+// memory. It knows only the commands the tests need; expiry is ignored, only
+// the TTLs given to SET are recorded.
+type fakeRedis struct {
+	mu      sync.Mutex
+	lis     net.Listener
+	strings map[string]string
+	hashes  map[string]map[string]string
+	streams map[string][][]string
+	ttls    map[string]time.Duration
+	nextId  int
+	// failing commands answer with an error, as if redis broke halfway.
+	failing map[string]bool
+}
+
+// newFakeRedis serves a fakeRedis for the test and returns a client of it.
+func newFakeRedis(t *testing.T) (*fakeRedis, redis.UniversalClient) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		lis:     lis,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		streams: make(map[string][][]string),
+		ttls:    make(map[string]time.Duration),
+		failing: make(map[string]bool),
+	}
+	go f.serve()
+	rds := redis.NewClient(&redis.Options{Addr: lis.Addr().String(), MaxRetries: -1})
+	t.Cleanup(func() {
+		rds.Close()
+		f.close()
+	})
+	return f, rds
+}
+
+// close stops the server, as if redis went away.
+func (f *fakeRedis) close() {
+	f.lis.Close()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.lis.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := ""
+		switch {
+		case strings.EqualFold(args[0], "MULTI"):
+			queued, reply = [][]string{}, "+OK\r\n"
+		case strings.EqualFold(args[0], "EXEC"):
+			replies := fmt.Sprintf("*%d\r\n", len(queued))
+			for _, cmd := range queued {
+				replies += f.exec(cmd)
+			}
+			queued, reply = nil, replies
+		case queued != nil:
+			queued, reply = append(queued, args), "+QUEUED\r\n"
+		default:
+			reply = f.exec(args)
+		}
+		_, err = conn.Write([]byte(reply))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected an array")
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing[strings.ToUpper(args[0])] {
+		return "-ERR " + args[0] + " failed\r\n"
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if _, ok := f.hashes[args[1]]; ok {
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		}
+		v, ok := f.strings[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "SET":
+		f.strings[args[1]] = args[2]
+		delete(f.ttls, args[1])
+		if len(args) > 4 {
+			n, _ := strconv.Atoi(args[4])
+			unit := time.Second
+			if strings.ToUpper(args[3]) == "PX" {
+				unit = time.Millisecond
+			}
+			f.ttls[args[1]] = time.Duration(n) * unit
+		}
+		return "+OK\r\n"
+	case "INCR", "INCRBY", "DECRBY":
+		by := 1
+		if len(args) > 2 {
+			by, _ = strconv.Atoi(args[2])
+		}
+		if strings.ToUpper(args[0]) == "DECRBY" {
+			by = -by
+		}
+		n, _ := strconv.Atoi(f.strings[args[1]])
+		f.strings[args[1]] = strconv.Itoa(n + by)
+		return fmt.Sprintf(":%d\r\n", n+by)
+	case "EXPIRE":
+		return ":1\r\n"
+	case "EXISTS":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := f.strings[key]; ok {
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "HSET":
+		h, ok := f.hashes[args[1]]
+		if !ok {
+			h = make(map[string]string)
+			f.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		return fmt.Sprintf(":%d\r\n", (len(args)-2)/2)
+	case "HGET":
+		v, ok := f.hashes[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "XADD":
+		i := 2
+		for i < len(args) && args[i] != "*" {
+			i++
+		}
+		f.nextId++
+		id := strconv.Itoa(f.nextId) + "-0"
+		f.streams[args[1]] = append(f.streams[args[1]], append([]string{id}, args[i+1:]...))
+		return bulk(id)
+	case "XRANGE":
+		var entries []string
+		for _, entry := range f.streams[args[1]] {
+			if (args[2] != "-" && compareStreamId(entry[0], args[2]) < 0) || (args[3] != "+" && compareStreamId(entry[0], args[3]) > 0) {
+				continue
+			}
+			fields := ""
+			for _, v := range entry[1:] {
+				fields += bulk(v)
+			}
+			entries = append(entries, fmt.Sprintf("*2\r\n%s*%d\r\n%s", bulk(entry[0]), len(entry)-1, fields))
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(entries), strings.Join(entries, ""))
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func bulk(v string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+}
+
+// addEvent appends a price event for symbol as publishPrice would and returns
+// its id.
+func (f *fakeRedis) addEvent(symbol string, data []Data) string {
+	payload, _ := json.Marshal(data)
+	id := f.exec([]string{"XADD", priceStreamPrefix + symbol, "*", "data", string(payload)})
+	return strings.Split(id, "\r\n")[1]
+}
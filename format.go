@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	formatJSON     string = "json"
+	formatCSV      string = "csv"
+	formatMsgpack  string = "msgpack"
+	formatProtobuf string = "protobuf"
+)
+
+var formatTypes = map[string]string{
+	formatJSON:     "application/json",
+	formatCSV:      "text/csv; charset=utf-8",
+	formatMsgpack:  "application/msgpack",
+	formatProtobuf: "application/x-protobuf",
+}
+
+var errNotAcceptable = errors.New("format not available for this route")
+
+// negotiateFormat picks the response format from ?format= or else from the
+// Accept header, defaulting to JSON. It returns "" for an unknown ?format=.
+func negotiateFormat(r *http.Request) string {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case "":
+	case "proto":
+		return formatProtobuf
+	case formatJSON, formatCSV, formatMsgpack, formatProtobuf:
+		return format
+	default:
+		return ""
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		switch mediaType {
+		case "text/csv":
+			return formatCSV
+		case "application/msgpack", "application/x-msgpack":
+			return formatMsgpack
+		case "application/x-protobuf", "application/protobuf":
+			return formatProtobuf
+		case "application/json":
+			return formatJSON
+		}
+	}
+	return formatJSON
+}
+
+// setProtoMessage hands over the proto/upbit.proto message of the route's
+// body; routes without one answer Protobuf requests with 406.
+func setProtoMessage(r *http.Request, m proto.Message) {
+	blocks, ok := r.Context().Value(blocksKey{}).(*responseBlocks)
+	if !ok {
+		return
+	}
+	blocks.mu.Lock()
+	blocks.proto = m
+	blocks.mu.Unlock()
+}
+
+// encodeFormat encodes a decoded JSON body, or for Protobuf the route's
+// message, projected down to paths like the JSON body. A list body is the
+// repeated first field of the message.
+func encodeFormat(format string, body interface{}, m proto.Message, paths [][]string) ([]byte, error) {
+	switch format {
+	case formatCSV:
+		return encodeCSV(body)
+	case formatMsgpack:
+		return msgpack.Marshal(msgpackValue(body))
+	case formatProtobuf:
+		if m == nil {
+			return nil, errNotAcceptable
+		}
+		if len(paths) > 0 {
+			if _, ok := body.([]interface{}); ok {
+				list := m.ProtoReflect().Descriptor().Fields().Get(0).JSONName()
+				var listPaths [][]string
+				for _, path := range paths {
+					listPaths = append(listPaths, append([]string{list}, path...))
+				}
+				paths = listPaths
+			}
+			projectProto(m.ProtoReflect(), paths)
+		}
+		return proto.Marshal(m)
+	}
+	return json.Marshal(body)
+}
+
+// projectProto clears the fields of m outside paths, matching the JSON names
+// of the fields as project does the keys of a JSON body.
+func projectProto(m protoreflect.Message, paths [][]string) {
+	var cleared []protoreflect.FieldDescriptor
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		var tails [][]string
+		whole := false
+		for _, path := range paths {
+			if path[0] != fd.JSONName() {
+				continue
+			}
+			if len(path) == 1 {
+				whole = true
+			} else {
+				tails = append(tails, path[1:])
+			}
+		}
+		switch {
+		case whole:
+		case len(tails) > 0 && fd.Message() != nil && fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				projectProto(list.Get(i).Message(), tails)
+			}
+		case len(tails) > 0 && fd.Message() != nil && !fd.IsMap():
+			projectProto(v.Message(), tails)
+		default:
+			cleared = append(cleared, fd)
+		}
+		return true
+	})
+	for _, fd := range cleared {
+		m.Clear(fd)
+	}
+}
+
+// encodeCSV writes one row per object with a header row of every key seen,
+// in order of first appearance. Nested values are written as JSON.
+func encodeCSV(body interface{}) ([]byte, error) {
+	rows, ok := body.([]interface{})
+	if !ok {
+		rows = []interface{}{body}
+	}
+	var header []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		object, _ := row.(jsonObject)
+		for _, field := range object {
+			if !seen[field.Key] {
+				seen[field.Key] = true
+				header = append(header, field.Key)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(header)
+	for _, row := range rows {
+		object, _ := row.(jsonObject)
+		record := make([]string, len(header))
+		for i, key := range header {
+			value, _ := object.get(key)
+			record[i] = csvCell(value)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+func csvCell(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	}
+	cell, _ := json.Marshal(v)
+	return string(cell)
+}
+
+// msgpackValue readies a decoded JSON value for msgpack.Marshal: integral
+// numbers become integers, others float64. Blocks built in the middleware
+// are plain Go values and go through their JSON form first.
+func msgpackValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil, bool, string:
+		return value
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := value.Float64()
+		return f
+	case []interface{}:
+		res := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			res = append(res, msgpackValue(item))
+		}
+		return res
+	case jsonObject:
+		res := make(jsonObject, 0, len(value))
+		for _, field := range value {
+			res = append(res, jsonField{field.Key, msgpackValue(field.Value)})
+		}
+		return res
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	decoded, err := decodeOrdered(raw)
+	if err != nil {
+		return nil
+	}
+	return msgpackValue(decoded)
+}
+
+// EncodeMsgpack writes the object as a map in its key order.
+func (o jsonObject) EncodeMsgpack(enc *msgpack.Encoder) error {
+	err := enc.EncodeMapLen(len(o))
+	if err != nil {
+		return err
+	}
+	for _, field := range o {
+		err = enc.EncodeString(field.Key)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(field.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
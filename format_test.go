@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	upbitpb "Upbit/proto"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	body := `{"symbol":"BTC","small":7,"negative":-5,"wide":-40000,"big":9007199254740993,` +
+		`"price":65000.5,"ok":true,"off":false,"none":null,"name":"` + long + `",` +
+		`"list":[1,"two",{"three":3}],"nested":{"a":{"b":[]}}}`
+	decoded, err := decodeOrdered([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encodeFormat(formatMsgpack, decoded, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got interface{}
+	err = msgpack.Unmarshal(encoded, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want interface{}
+	json.Unmarshal([]byte(body), &want)
+	// Integers come back as int8 to uint64; JSON reads every number as float64.
+	normalized, _ := json.Marshal(got)
+	var gotJSON interface{}
+	json.Unmarshal(normalized, &gotJSON)
+	if !reflect.DeepEqual(gotJSON, want) {
+		t.Fatalf("got %s, want %s", normalized, body)
+	}
+	if big := got.(map[string]interface{})["big"]; big != uint64(9007199254740993) {
+		t.Errorf("big = %v (%T), want the exact integer", big, big)
+	}
+
+	// Keys keep the order of the JSON body.
+	dec := msgpack.NewDecoder(bytes.NewReader(encoded))
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for i := 0; i < n; i++ {
+		key, _ := dec.DecodeString()
+		keys = append(keys, key)
+		dec.Skip()
+	}
+	if strings.Join(keys, ",") != "symbol,small,negative,wide,big,price,ok,off,none,name,list,nested" {
+		t.Errorf("keys in order %v", keys)
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	maxSupply := 21000000.0
+	data := []Data{
+		{Symbol: "BTC", CurrencyCode: "KRW", Price: 90000000, MarketCap: 1.2e15, AccTradePrice24H: 123.5,
+			CirculatingSupply: 19700000, Provider: "upbit", LastUpdatedTimestamp: "2024-01-01T00:00:00Z",
+			KoreanName: "비트코인", UpbitWarning: true,
+			Consensus: &Consensus{Method: "median", Price: 89990000, Spread: 0.5, Sources: 3,
+				Providers: []string{"coinbase", "upbit"}, Rejected: []string{}, Confidence: 0.9}},
+		{Symbol: "BTC", CurrencyCode: "USD", Price: 65000, MaxSupply: maxSupply},
+	}
+	body, _ := json.Marshal(data)
+	decoded, err := decodeOrdered(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encodeFormat(formatProtobuf, decoded, &upbitpb.DataList{Data: protoData(data)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list upbitpb.DataList
+	err = proto.Unmarshal(encoded, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Data) != 2 {
+		t.Fatalf("got %d rows, want 2", len(list.Data))
+	}
+	krw, usd := list.Data[0], list.Data[1]
+	if krw.Symbol != "BTC" || krw.CurrencyCode != "KRW" || krw.Price != 90000000 || krw.MarketCap != 1.2e15 ||
+		krw.GetAccTradePrice_24H() != 123.5 || krw.MaxSupply != nil || krw.KoreanName != "비트코인" || !krw.UpbitWarning {
+		t.Errorf("unexpected KRW row %v", krw)
+	}
+	c := krw.Consensus
+	if c == nil || c.Method != "median" || c.Sources != 3 || strings.Join(c.Providers, ",") != "coinbase,upbit" || c.Confidence != 0.9 {
+		t.Errorf("unexpected consensus %v", c)
+	}
+	if usd.GetMaxSupply() != 21000000 || usd.AccTradePrice_24H != nil || usd.Consensus != nil {
+		t.Errorf("unexpected USD row %v", usd)
+	}
+
+	// ?fields= projects the message like the JSON body, by JSON field name.
+	projected, err := encodeFormat(formatProtobuf, decoded, &upbitpb.DataList{Data: protoData(data)},
+		[][]string{{"currencyCode"}, {"accTradePrice24h"}, {"consensus", "method"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list.Reset()
+	err = proto.Unmarshal(projected, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	krw = list.Data[0]
+	if krw.Symbol != "" || krw.Price != 0 || krw.CurrencyCode != "KRW" || krw.GetAccTradePrice_24H() != 123.5 ||
+		krw.Consensus.GetMethod() != "median" || krw.Consensus.GetPrice() != 0 {
+		t.Errorf("unexpected projected row %v", krw)
+	}
+
+	_, err = encodeFormat(formatProtobuf, decoded, nil, nil)
+	if err != errNotAcceptable {
+		t.Errorf("route without a message: got %v, want errNotAcceptable", err)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	srv := newTestServer(t, nil)
+	req, _ := http.NewRequest("GET", srv.URL+"/api/v2/BTC/info?format=xml", nil)
+	req.Header.Set("X-API-Key", testApiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+}
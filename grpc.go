@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	upbitpb "Upbit/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/upbit.proto
+
+// grpcMaxBatchDefault caps BatchGetInfo when grpc.max_batch isn't set.
+const grpcMaxBatchDefault int = 20
+
+// upbitServer implements the Upbit service of proto/upbit.proto, generated
+// into Upbit/proto.
+type upbitServer struct {
+	upbitpb.UnimplementedUpbitServer
+	app *App
+}
+
+// startGrpcServer serves the gRPC API in the background. The server is nil
+// when no port is configured or it can't listen.
+func (a *App) startGrpcServer() *grpc.Server {
+	if cfg.Grpc.Port == "" {
+		return nil
+	}
+	lis, err := net.Listen("tcp", "0.0.0.0:"+cfg.Grpc.Port)
+	if err != nil {
+		serverLog.Error(context.Background(), "error listening for grpc", "port", cfg.Grpc.Port, "error", err)
+		return nil
+	}
+	s := a.newGrpcServer()
+	go func() {
+		err := s.Serve(lis)
+		if err != nil {
+			serverLog.Error(context.Background(), "error serving grpc", "error", err)
+		}
+	}()
+	return s
+}
+
+func (a *App) newGrpcServer() *grpc.Server {
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(recoverUnary, a.authenticateUnary),
+		grpc.ChainStreamInterceptor(recoverStream, a.authenticateStream))
+	upbitpb.RegisterUpbitServer(s, &upbitServer{app: a})
+	return s
+}
+
+// stopGrpcServer lets the RPCs in flight finish, cutting them off once ctx is
+// done.
+func stopGrpcServer(ctx context.Context, s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+func (a *App) authenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = rpcRequestId(ctx)
+	ctx, span := traceRPC(ctx, info.FullMethod)
+	a.flagDegradedRPC(ctx)
+	start := time.Now()
+	apiKey, err := a.authorizeRPC(ctx)
+	var res interface{}
+	if err == nil {
+		res, err = handler(context.WithValue(ctx, apiKeyKey{}, apiKey), req)
+	}
+	finishRPCSpan(span, err)
+	meterRPC(info.FullMethod, apiKey, start, err)
+	logRPC(ctx, info.FullMethod, start, err)
+	return res, err
+}
+
+func (a *App) authenticateStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := rpcRequestId(stream.Context())
+	ctx, span := traceRPC(ctx, info.FullMethod)
+	a.flagDegradedRPC(ctx)
+	start := time.Now()
+	apiKey, err := a.authorizeRPC(ctx)
+	if err == nil {
+		err = handler(srv, &contextStream{stream, context.WithValue(ctx, apiKeyKey{}, apiKey)})
+	}
+	finishRPCSpan(span, err)
+	meterRPC(info.FullMethod, apiKey, start, err)
+	logRPC(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// recoverUnary turns a panic into an Internal error. Unlike net/http, grpc
+// doesn't recover panics, so one would take the process down; it comes first
+// in the chain to cover the other interceptors too.
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = recoveredRPC(ctx, info.FullMethod, p)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func recoverStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = recoveredRPC(stream.Context(), info.FullMethod, p)
+		}
+	}()
+	return handler(srv, stream)
+}
+
+func recoveredRPC(ctx context.Context, method string, p interface{}) error {
+	serverLog.Error(ctx, "rpc panicked", "method", method, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	countError("server")
+	return status.Error(codes.Internal, "Internal error")
+}
+
+// contextStream hands the handler the context carrying the request ID and
+// span.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// rpcRequestId tags the RPC with the x-request-id metadata it came with, or a
+// new one, and sends it back in the response header.
+func rpcRequestId(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-request-id")) > 0 {
+		id = md.Get("x-request-id")[0]
+	}
+	ctx = withRequestId(ctx, id)
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestId(ctx)))
+	return ctx
+}
+
+// traceRPC runs the RPC in a server span, continuing the trace of its
+// traceparent metadata.
+func traceRPC(ctx context.Context, method string) (context.Context, *Span) {
+	if !cfg.Tracing.Enabled {
+		return ctx, nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("traceparent")) > 0 {
+		ctx = withTraceparent(ctx, md.Get("traceparent")[0])
+	}
+	ctx, span := startSpan(ctx, method, spanServer,
+		"rpc.system", "grpc",
+		"rpc.method", method,
+		"request.id", requestId(ctx))
+	grpc.SetHeader(ctx, metadata.Pairs("traceparent", traceparent(span)))
+	return ctx, span
+}
+
+func finishRPCSpan(span *Span, err error) {
+	span.SetAttributes("rpc.grpc.status_code", int(status.Code(err)))
+	span.SetError(err)
+	span.Finish()
+}
+
+func logRPC(ctx context.Context, method string, start time.Time, err error) {
+	serverLog.Info(ctx, "rpc served",
+		"method", method,
+		"code", status.Code(err).String(),
+		"latencyMs", time.Since(start).Milliseconds())
+}
+
+// meterRPC records an RPC as a usage event, with the HTTP status matching its
+// outcome.
+func meterRPC(method string, apiKey *ApiKey, start time.Time, err error) {
+	if !cfg.Usage.Enabled {
+		return
+	}
+	event := UsageEvent{
+		Time:      start.UTC(),
+		Route:     method,
+		Method:    "RPC",
+		Status:    http.StatusOK,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if apiKey != nil {
+		event.ApiKey, event.KeyName = apiKey.usageId(), apiKey.Name
+	}
+	switch status.Code(err) {
+	case codes.OK:
+	case codes.Unauthenticated:
+		event.Status = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		event.Status = http.StatusForbidden
+	case codes.ResourceExhausted:
+		event.Status = http.StatusTooManyRequests
+	case codes.InvalidArgument:
+		event.Status = http.StatusBadRequest
+	case codes.NotFound:
+		event.Status = http.StatusNotFound
+	default:
+		event.Status = http.StatusInternalServerError
+	}
+	recordUsage(event)
+}
+
+// allowUpstreamRPC spends a request of the peer's upstream budget, like
+// allowUpstream does for HTTP clients.
+func (a *App) allowUpstreamRPC(ctx context.Context) bool {
+	if !cfg.RateLimit.Enabled {
+		return true
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		ip = p.Addr.String()
+	}
+	allowed, _ := a.allowRequest(ctx, ipLimitPrefix+"upstream:"+ip, cfg.RateLimit.Upstream)
+	return allowed
+}
+
+// authorizeRPC applies the API key checks of the HTTP API to an RPC, with the
+// key in the x-api-key metadata.
+func (a *App) authorizeRPC(ctx context.Context) (*ApiKey, error) {
+	if !cfg.Auth.Enabled {
+		return nil, nil
+	}
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-api-key")) > 0 {
+		key = md.Get("x-api-key")[0]
+	}
+	apiKey, _, code, msg := a.authorize(ctx, key, scopeRead)
+	switch code {
+	case 0:
+		return apiKey, nil
+	case http.StatusUnauthorized:
+		return nil, status.Error(codes.Unauthenticated, msg)
+	case http.StatusForbidden:
+		return nil, status.Error(codes.PermissionDenied, msg)
+	case http.StatusTooManyRequests:
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+	return nil, status.Error(codes.Unavailable, msg)
+}
+
+// info runs one request through the same code path as the HTTP /info route.
+func (s *upbitServer) info(ctx context.Context, req *upbitpb.InfoRequest) ([]Data, *errResult) {
+	currencyCode := req.CurrencyCode
+	if len(currencyCode) == 0 {
+		currencyCode = currencyCodeDefault
+	}
+	method, ok := resolveConsensus(req.Consensus)
+	if !ok {
+		return nil, &errResult{http.StatusBadRequest, "Unknown consensus method, use " + consensusMethods}
+	}
+	symbol := normalizeCode(req.Symbol)
+	if !s.app.infoCached(ctx, symbol) && !s.app.allowUpstreamRPC(ctx) {
+		return nil, &errResult{http.StatusTooManyRequests, "Too many uncached requests"}
+	}
+	rec := &errorRecorder{header: make(http.Header)}
+	data, _, ok := s.app.getInfo(ctx, rec, symbol, currencyCode, method)
+	if !ok {
+		result := rec.errResult()
+		return nil, &result
+	}
+	decorateMarket(data)
+	return data, nil
+}
+
+func (s *upbitServer) GetInfo(ctx context.Context, req *upbitpb.InfoRequest) (*upbitpb.DataList, error) {
+	if req.Symbol == "" {
+		return nil, status.Error(codes.InvalidArgument, "symbol is required")
+	}
+	if _, ok := resolveConsensus(req.Consensus); !ok {
+		return nil, status.Error(codes.InvalidArgument, "Unknown consensus method, use "+consensusMethods)
+	}
+	data, result := s.info(ctx, req)
+	if result != nil {
+		code := codes.Unavailable
+		switch result.Code {
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusTooManyRequests:
+			code = codes.ResourceExhausted
+		}
+		return nil, status.Error(code, result.Msg)
+	}
+	return &upbitpb.DataList{Data: protoData(data)}, nil
+}
+
+// BatchGetInfo answers each request of the batch like GetInfo. The
+// interceptor charged the key for the first one, the others are charged here.
+func (s *upbitServer) BatchGetInfo(ctx context.Context, req *upbitpb.BatchInfoRequest) (*upbitpb.BatchInfoResponse, error) {
+	maxBatch := cfg.Grpc.MaxBatch
+	if maxBatch <= 0 {
+		maxBatch = grpcMaxBatchDefault
+	}
+	if len(req.Requests) > maxBatch {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("at most %d requests per batch", maxBatch))
+	}
+	if apiKey, ok := ctx.Value(apiKeyKey{}).(*ApiKey); ok && apiKey != nil && len(req.Requests) > 1 {
+		_, code, msg := s.app.chargeRequests(ctx, apiKey, len(req.Requests)-1)
+		switch code {
+		case 0:
+		case http.StatusTooManyRequests:
+			return nil, status.Error(codes.ResourceExhausted, msg)
+		default:
+			return nil, status.Error(codes.Unavailable, msg)
+		}
+	}
+	res := &upbitpb.BatchInfoResponse{}
+	for _, r := range req.Requests {
+		data, result := s.info(ctx, r)
+		item := &upbitpb.InfoResult{Symbol: normalizeCode(r.Symbol), Data: protoData(data)}
+		if result != nil {
+			item.Code, item.Msg = int64(result.Code), result.Msg
+		}
+		res.Results = append(res.Results, item)
+	}
+	return res, nil
+}
+
+func (s *upbitServer) WatchPrices(req *upbitpb.WatchRequest, stream upbitpb.Upbit_WatchPricesServer) error {
+	if len(req.Symbols) == 0 {
+		return status.Error(codes.InvalidArgument, "symbols are required")
+	}
+	ctx := stream.Context()
+	sub := newSubscriber(req.Symbols, req.CurrencyCode, req.LastEventId)
+	hub.add(sub)
+	defer hub.remove(sub)
+	send := func(event PriceEvent) error {
+		if !sub.next(event) {
+			return nil
+		}
+		return stream.Send(&upbitpb.PriceEvent{Id: event.Id, Symbol: event.Symbol, Data: protoData(event.Data)})
+	}
+	for _, event := range sub.replay(ctx, s.app.Redis, sub.watching(), req.LastEventId) {
+		err := send(event)
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hub.closing:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case event := <-sub.events:
+			err := send(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// protoData converts the /info data to their upbitpb messages, leaving unset
+// what is null in JSON.
+func protoData(data []Data) []*upbitpb.Data {
+	res := make([]*upbitpb.Data, 0, len(data))
+	for _, d := range data {
+		m := &upbitpb.Data{
+			Symbol:               d.Symbol,
+			CurrencyCode:         d.CurrencyCode,
+			Price:                d.Price,
+			MarketCap:            d.MarketCap,
+			CirculatingSupply:    d.CirculatingSupply,
+			Provider:             d.Provider,
+			LastUpdatedTimestamp: d.LastUpdatedTimestamp,
+			KoreanName:           d.KoreanName,
+			EnglishName:          d.EnglishName,
+			UpbitWarning:         d.UpbitWarning,
+		}
+		if accTradePrice, ok := d.AccTradePrice24H.(float64); ok {
+			m.AccTradePrice_24H = &accTradePrice
+		}
+		if maxSupply, ok := d.MaxSupply.(float64); ok {
+			m.MaxSupply = &maxSupply
+		}
+		if c := d.Consensus; c != nil {
+			m.Consensus = &upbitpb.Consensus{
+				Method:     c.Method,
+				Price:      c.Price,
+				Spread:     c.Spread,
+				Sources:    int64(c.Sources),
+				Providers:  c.Providers,
+				Rejected:   c.Rejected,
+				Confidence: c.Confidence,
+			}
+		}
+		res = append(res, m)
+	}
+	return res
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	upbitpb "Upbit/proto"
+)
+
+// dialTestGrpc serves app's gRPC API on a local port and dials it with a
+// stock grpc client, so messages go through the standard proto codec.
+func dialTestGrpc(t *testing.T, app *App) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := app.newGrpcServer()
+	go s.Serve(lis)
+	t.Cleanup(s.GracefulStop)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func withTestKey(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "x-api-key", testApiKey)
+}
+
+func TestGrpcGetInfo(t *testing.T) {
+	conn := dialTestGrpc(t, newTestApp(t))
+	ctx := withTestKey(context.Background())
+	res, err := upbitpb.NewUpbitClient(conn).GetInfo(ctx, &upbitpb.InfoRequest{Symbol: "btc", CurrencyCode: []string{"KRW", "USD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 2 {
+		t.Fatalf("got %d rows, want 2", len(res.Data))
+	}
+	for _, d := range res.Data {
+		if d.Symbol != "BTC" || d.Price <= 0 {
+			t.Errorf("unexpected row %v", d)
+		}
+		if d.MaxSupply == nil || *d.MaxSupply != 21000000 {
+			t.Errorf("%s maxSupply = %v, want 21000000", d.CurrencyCode, d.MaxSupply)
+		}
+	}
+}
+
+func TestGrpcErrors(t *testing.T) {
+	client := upbitpb.NewUpbitClient(dialTestGrpc(t, newTestApp(t)))
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		req  *upbitpb.InfoRequest
+		code codes.Code
+	}{
+		{"no key", context.Background(), &upbitpb.InfoRequest{Symbol: "BTC"}, codes.Unauthenticated},
+		{"no symbol", withTestKey(context.Background()), &upbitpb.InfoRequest{}, codes.InvalidArgument},
+		{"unknown consensus", withTestKey(context.Background()), &upbitpb.InfoRequest{Symbol: "BTC", Consensus: "mean"}, codes.InvalidArgument},
+		{"unknown symbol", withTestKey(context.Background()), &upbitpb.InfoRequest{Symbol: "NOPE"}, codes.NotFound},
+	} {
+		_, err := client.GetInfo(tc.ctx, tc.req)
+		if status.Code(err) != tc.code {
+			t.Errorf("%s: got %v, want %s", tc.name, err, tc.code)
+		}
+	}
+}
+
+func TestGrpcBatchGetInfo(t *testing.T) {
+	client := upbitpb.NewUpbitClient(dialTestGrpc(t, newTestApp(t)))
+	res, err := client.BatchGetInfo(withTestKey(context.Background()), &upbitpb.BatchInfoRequest{Requests: []*upbitpb.InfoRequest{
+		{Symbol: "BTC", CurrencyCode: []string{"USD"}},
+		{Symbol: "NOPE"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(res.Results))
+	}
+	if r := res.Results[0]; r.Symbol != "BTC" || r.Code != 0 || len(r.Data) != 1 {
+		t.Errorf("unexpected BTC result %v", r)
+	}
+	if r := res.Results[1]; r.Code != 404 || len(r.Data) != 0 {
+		t.Errorf("unexpected NOPE result %v", r)
+	}
+
+	cfg.Grpc.MaxBatch = 2
+	_, err = client.BatchGetInfo(withTestKey(context.Background()), &upbitpb.BatchInfoRequest{Requests: []*upbitpb.InfoRequest{
+		{Symbol: "BTC"}, {Symbol: "ETH"}, {Symbol: "XRP"},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("batch over grpc.max_batch: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestGrpcBatchCharging(t *testing.T) {
+	app := newTestApp(t)
+	fake, rds := newFakeRedis(t)
+	app.Redis = rds
+	apiKey := ApiKey{Id: primitive.NewObjectID(), Name: "client", Prefix: "upk_batch", Scopes: []string{scopeRead}, RateLimit: -1, DailyQuota: 3}
+	cached, _ := json.Marshal(apiKey)
+	fake.strings[apiKeyCachePrefix+hashApiKey("upk_batch")] = string(cached)
+	client := upbitpb.NewUpbitClient(dialTestGrpc(t, app))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "upk_batch")
+
+	// Each request of a batch counts against the daily quota.
+	_, err := client.BatchGetInfo(ctx, &upbitpb.BatchInfoRequest{Requests: []*upbitpb.InfoRequest{
+		{Symbol: "NOPE"}, {Symbol: "NOPE"}, {Symbol: "NOPE"}, {Symbol: "NOPE"},
+	}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("batch over the quota: got %v, want ResourceExhausted", err)
+	}
+	fake.mu.Lock()
+	used := fake.strings[quotaKeyPrefix+apiKey.Id.Hex()+":"+time.Now().UTC().Format(historyDateForm)]
+	fake.mu.Unlock()
+	// The refused requests are given back, only the first one admitted counts.
+	if used != "1" {
+		t.Errorf("quota counter %q, want 1", used)
+	}
+	_, err = client.BatchGetInfo(ctx, &upbitpb.BatchInfoRequest{Requests: []*upbitpb.InfoRequest{
+		{Symbol: "NOPE"}, {Symbol: "NOPE"},
+	}})
+	if err != nil {
+		t.Fatalf("batch within the quota: %v", err)
+	}
+}
+
+func TestGrpcWatchPrices(t *testing.T) {
+	conn := dialTestGrpc(t, newTestApp(t))
+	ctx, cancel := context.WithTimeout(withTestKey(context.Background()), 5*time.Second)
+	defer cancel()
+	stream, err := upbitpb.NewUpbitClient(conn).WatchPrices(ctx, &upbitpb.WatchRequest{Symbols: []string{"btc"}, CurrencyCode: []string{"USD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscription is in place once the first event gets through.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for seq := 1; ; seq++ {
+			hub.broadcast(PriceEvent{Id: "1-" + strconv.Itoa(seq), Symbol: "BTC", Data: []Data{
+				{Symbol: "BTC", CurrencyCode: "KRW", Price: 90000000},
+				{Symbol: "BTC", CurrencyCode: "USD", Price: 65000, MaxSupply: 21000000.0},
+			}})
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Symbol != "BTC" || len(event.Data) != 1 || event.Data[0].CurrencyCode != "USD" {
+		t.Fatalf("unexpected event %v", event)
+	}
+	if event.Data[0].MaxSupply == nil || *event.Data[0].MaxSupply != 21000000 {
+		t.Errorf("maxSupply = %v, want 21000000", event.Data[0].MaxSupply)
+	}
+}
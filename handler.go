@@ -1,19 +1,21 @@
 package main
 
 import (
+	upbitpb "Upbit/proto"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/tidwall/gjson"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,29 +30,125 @@ var (
 	cfg,_ = OpenConfigFile()
 
 )
-const(
+var(
 	coinBaseApi string = "https://api.coinbase.com/v2/exchange-rates"
 	coinMarketApi string = "https://pro-api.coinmarketcap.com/v1/cryptocurrency/quotes/latest"
 	coinGeckoApi string = "https://api.coingecko.com/api/v3/coins/markets"
 	symbolIdApi string = "https://api.coingecko.com/api/v3/coins/list"
 )
 
+// Modes of redis_local.
+const (
+	redisStandalone string = "standalone"
+	redisSentinel   string = "sentinel"
+	redisCluster    string = "cluster"
+)
+
 type RequestBody struct {
 	CurrencyCode []string
 }
 type Config struct {
 	Redis_Local struct {
-		Host     string `yaml:"host"`
-		Port     string `yaml:"port"`
+		Mode     string   `yaml:"mode"`
+		Host     string   `yaml:"host"`
+		Port     string   `yaml:"port"`
+		Addrs    []string `yaml:"addrs"`
+		MasterName       string `yaml:"master_name"`
+		Username         string `yaml:"username"`
+		Password         string `yaml:"password"`
+		SentinelPassword string `yaml:"sentinel_password"`
+		DB       int      `yaml:"db"`
+		Tls      bool     `yaml:"tls"`
+		PoolSize     int `yaml:"pool_size"`
+		MinIdleConns int `yaml:"min_idle_conns"`
 	} `yaml:"redis_local"`
 	Mongo_Local struct {
+		Uri      string `yaml:"uri"`
 		Host     string `yaml:"host"`
 		Port     string `yaml:"port"`
 		User     string `yaml:"user"`
 		Pass     string `yaml:"pass"`
+		AuthSource string `yaml:"auth_source"`
+		ReplicaSet string `yaml:"replica_set"`
+		Tls        bool   `yaml:"tls"`
+		TlsCaFile  string `yaml:"tls_ca_file"`
+		SymbolReadPreference string `yaml:"symbol_read_preference"`
 		Database string `yaml:"database"`
 		DBName   string `yaml:"dbname"`
+		MaxPoolSize uint64 `yaml:"max_pool_size"`
+		MinPoolSize uint64 `yaml:"min_pool_size"`
 	} `yaml:"mongo_local"`
+	Upbit struct {
+		StaleAfter int           `yaml:"stale_after"`
+		Markets    []UpbitRegion `yaml:"markets"`
+	} `yaml:"upbit"`
+	Consensus struct {
+		Enabled   bool    `yaml:"enabled"`
+		Method    string  `yaml:"method"`
+		Threshold float64 `yaml:"threshold"`
+	} `yaml:"consensus"`
+	Quality struct {
+		PriceSpread   float64 `yaml:"price_spread"`
+		SupplyDiff    float64 `yaml:"supply_diff"`
+		TimestampSkew float64 `yaml:"timestamp_skew"`
+		Consecutive   int     `yaml:"consecutive"`
+		Webhook       string  `yaml:"webhook"`
+	} `yaml:"quality"`
+	Server struct {
+		ShutdownTimeout int `yaml:"shutdown_timeout"`
+	} `yaml:"server"`
+	Degraded struct {
+		CacheSize      int    `yaml:"cache_size"`
+		ProbeInterval  int    `yaml:"probe_interval"`
+		SymbolSnapshot string `yaml:"symbol_snapshot"`
+	} `yaml:"degraded"`
+	Stream struct {
+		AllowedOrigins []string `yaml:"allowed_origins"`
+	} `yaml:"stream"`
+	Grpc struct {
+		Port     string `yaml:"port"`
+		MaxBatch int    `yaml:"max_batch"`
+	} `yaml:"grpc"`
+	Portfolio struct {
+		Schedule string `yaml:"schedule"`
+	} `yaml:"portfolio"`
+	RateLimit struct {
+		Enabled        bool                     `yaml:"enabled"`
+		TrustedProxies []string                 `yaml:"trusted_proxies"`
+		Default        RateLimitRule            `yaml:"default"`
+		Upstream       RateLimitRule            `yaml:"upstream"`
+		Routes         map[string]RateLimitRule `yaml:"routes"`
+	} `yaml:"ratelimit"`
+	Log struct {
+		Level      string            `yaml:"level"`
+		Subsystems map[string]string `yaml:"subsystems"`
+	} `yaml:"log"`
+	Tracing struct {
+		Enabled       bool    `yaml:"enabled"`
+		Exporter      string  `yaml:"exporter"`
+		Endpoint      string  `yaml:"endpoint"`
+		ServiceName   string  `yaml:"service_name"`
+		SampleRatio   float64 `yaml:"sample_ratio"`
+		BatchSize     int     `yaml:"batch_size"`
+		FlushInterval int     `yaml:"flush_interval"`
+	} `yaml:"tracing"`
+	Metrics struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"metrics"`
+	Usage struct {
+		Enabled       bool `yaml:"enabled"`
+		BatchSize     int  `yaml:"batch_size"`
+		FlushInterval int  `yaml:"flush_interval"`
+		RetentionDays int  `yaml:"retention_days"`
+	} `yaml:"usage"`
+	Auth struct {
+		Enabled    bool   `yaml:"enabled"`
+		AdminKey   string `yaml:"admin_key"`
+		RateLimit  int    `yaml:"rate_limit"`
+		DailyQuota int    `yaml:"daily_quota"`
+		CacheTtl   int    `yaml:"cache_ttl"`
+		FailOpen   bool   `yaml:"fail_open"`
+	} `yaml:"auth"`
 }
 
 type CoinGeckoMarket struct {
@@ -103,6 +201,10 @@ type Data struct {
 	MaxSupply            interface{} `json:"maxSupply"`
 	Provider             string `json:"provider"`
 	LastUpdatedTimestamp string `json:"lastUpdatedTimestamp"`
+	KoreanName           string `json:"koreanName,omitempty"`
+	EnglishName          string `json:"englishName,omitempty"`
+	UpbitWarning         bool `json:"upbitWarning,omitempty"`
+	Consensus            *Consensus `json:"consensus,omitempty"`
 }
 type Redis struct {
 	MarketCap            float64 `json:"marketCap"`
@@ -112,15 +214,15 @@ type Redis struct {
 	LastUpdatedTimestamp string `json:"lastUpdatedTimestamp"`
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+func (a *App) handler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	symbol := params["symbol"]
 	tmp := strings.ToUpper(symbol)
 	symbolPro := strings.TrimSpace(tmp)
-	fmt.Printf("You are querying %s info",symbol)
+	serverLog.Debug(r.Context(),"info requested","symbol",symbol)
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error in reading body: %v",err)
+		serverLog.Warn(r.Context(),"error reading body","error",err)
 		http.Error(w, "can't read body", http.StatusBadRequest)
 	}
 	var requestBody RequestBody
@@ -131,56 +233,102 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		currencyCode = requestBody.CurrencyCode
 	}
-	ctx := context.TODO()
-	rds := initializeRedisLocalClient(ctx,cfg)
-	res, err := rds.Get(ctx,symbolPro).Result()
-	if err != nil {
-		fmt.Println("No redis data and querying API now!")
-		currencyPrice,coinBaseErr,errCode:= getCoinBaseInfo(w,symbolPro,currencyCode)
+	method, ok := consensusMethod(r)
+	if !ok {
+		writeError(w,http.StatusBadRequest,"Unknown consensus method, use "+consensusMethods)
+		return
+	}
+	cached := a.infoCached(r.Context(),symbolPro)
+	meterCache(r,cached)
+	meterCodes(r,nil,currencyCode)
+	// Coinbase and CoinMarketCap once, CoinGecko per currency.
+	if !cached && !a.allowUpstream(w,r,len(currencyCode)+2) {
+		return
+	}
+	data, sources, ok := a.getInfo(r.Context(),w,symbolPro,currencyCode,method)
+	if !ok {
+		return
+	}
+	setBlock(r,"sources",sources)
+	setProtoMessage(r,&upbitpb.DataList{Data: protoData(data)})
+	writeData(w,data)
+}
+
+// getInfo answers an /info request from the cache or the providers. Failures
+// are reported to w as errResult bodies and ok is false.
+func (a *App) getInfo(ctx context.Context, w http.ResponseWriter, symbolPro string, currencyCode []string, method string) ([]Data, map[string][]PriceSource, bool) {
+	ctx, span := startSpan(ctx,"info",spanInternal,"symbol",symbolPro,"currencies",currencyCode)
+	defer span.Finish()
+	rds := a.Redis
+	res, hit := a.cacheGet(ctx,symbolPro)
+	countCache("info",hit)
+	span.SetAttributes("cache",cacheOutcome(hit))
+	if !hit {
+		cacheLog.Debug(ctx,"info cache miss, querying providers","symbol",symbolPro)
+		currencyPrice,coinBaseErr,errCode:= getCoinBaseInfo(ctx,w,symbolPro,currencyCode)
 
 		if errCode == 404 {
-			return
+			return nil, nil, false
 		}
 
-		tokenInfo,coinMarketErr := getCoinMarketInfo(w,symbolPro)
+		tokenInfo,coinMarketErr := getCoinMarketInfo(ctx,w,symbolPro)
+
+		tokenInfoMap,coinGeckoErr := a.getCoinGeckoInfo(ctx,w,symbolPro,currencyCode)
+
+		sources := collectPriceSources(ctx,rds,symbolPro,currencyCode,currencyPrice,tokenInfo,tokenInfoMap)
+		if coinBaseErr == nil {
+			overrideUpbitPrices(ctx,rds,symbolPro,currencyPrice)
+		}
 
-		tokenInfoMap,coinGeckoErr := getCoinGeckoInfo(w,symbolPro,currencyCode)
+		go a.recordQuality(context.Background(),measureQuality(symbolPro,sources,tokenInfo,tokenInfoMap))
 
 		workMode := checkAPI(coinBaseErr,coinMarketErr,coinGeckoErr)
 
+		var data []Data
 		switch workMode {
 		case 0:
-			processBMG(w,symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
-			fmt.Println("========processBMG========")
+			data = processBMG(symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
+			infoModes.WithLabelValues("BMG").Inc()
 
 		case 1:
-			processMG(w,symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
-			fmt.Println("========processMG==========")
+			data = processMG(symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
+			infoModes.WithLabelValues("MG").Inc()
 		case 2:
-			processBG(w,symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
-			fmt.Println("========processBG=========")
+			data = processBG(symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
+			infoModes.WithLabelValues("BG").Inc()
 		case 3:
-			processBM(w,symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
-			fmt.Println("========processBM=========")
+			data = processBM(symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
+			infoModes.WithLabelValues("BM").Inc()
 		case 4:
-			processG(w,symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
-			fmt.Println("========processG=========")
+			data = processG(symbolPro,currencyPrice,tokenInfo,tokenInfoMap)
+			infoModes.WithLabelValues("G").Inc()
 		case -1:
+			infoModes.WithLabelValues("none").Inc()
+			providerLog.Error(ctx,"all providers failed","symbol",symbolPro)
 			msg,_ := json.Marshal(errResult{400,"Api server error"})
 			w.Write(msg)
-
+			return nil, nil, false
 		}
+		a.cacheData(ctx,symbolPro,data)
+		applyConsensus(data,sources,method)
+		return data, sources, true
 	} else {
 		var redisJson Redis
 		err := json.Unmarshal([]byte(res),&redisJson)
 		if err != nil {
-			fmt.Println("Error decoding redis data")
+			cacheLog.Warn(ctx,"error decoding cached info","symbol",symbolPro,"error",err)
+			countError("decode")
 		}
-		currencyPrice,_,errCode:= getCoinBaseInfo(w,symbolPro,currencyCode)
+		currencyPrice,_,errCode:= getCoinBaseInfo(ctx,w,symbolPro,currencyCode)
 		if errCode == 404 {
-			return
+			return nil, nil, false
 		}
-		processRedis(w,symbolPro,currencyPrice,redisJson)
+		sources := collectPriceSources(ctx,rds,symbolPro,currencyCode,currencyPrice,nil,nil)
+		overrideUpbitPrices(ctx,rds,symbolPro,currencyPrice)
+		cacheLog.Debug(ctx,"info cache hit","symbol",symbolPro)
+		data := processRedis(symbolPro,currencyPrice,redisJson)
+		applyConsensus(data,sources,method)
+		return data, sources, true
 
 	}
 
@@ -192,11 +340,13 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func getCoinMarketInfo(w http.ResponseWriter, symbol string) (map[string]interface{}, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET",coinMarketApi, nil)
+// getCoinMarketInfo and getCoinGeckoInfo report failures to w as errResult
+// bodies; callers with their own error handling pass a nil w.
+func getCoinMarketInfo(ctx context.Context, w http.ResponseWriter, symbol string) (map[string]interface{}, error) {
+	client := providerClient("coinmarketcap")
+	req, err := http.NewRequestWithContext(ctx,"GET",coinMarketApi, nil)
 	if err != nil {
-		log.Print(err)
+		providerLog.Error(ctx,"invalid CoinMarketCap request","error",err)
 		os.Exit(1)
 	}
 	q := url.Values{}
@@ -208,8 +358,10 @@ func getCoinMarketInfo(w http.ResponseWriter, symbol string) (map[string]interfa
 	resp, err := client.Do(req)
 	if err != nil {
 		msg, _ := json.Marshal(errResult{400, "Error getting cryptocurrency Supply"})
-		fmt.Println("Error getting cryptocurrency totalSupply")
-		w.Write(msg)
+		providerLog.Warn(ctx,"error getting CoinMarketCap supply","symbol",symbol,"error",err)
+		if w != nil {
+			w.Write(msg)
+		}
 		return nil, err
 	}
 	respBody, _ := ioutil.ReadAll(resp.Body)
@@ -218,14 +370,16 @@ func getCoinMarketInfo(w http.ResponseWriter, symbol string) (map[string]interfa
 	//fmt.Println(checkStatus != 0)
 	if checkStatus != 0 {
 		msg, _ := json.Marshal(errResult{400, "CoinMarket API limited"})
-		fmt.Println("CoinMarket API limited")
-		w.Write(msg)
+		providerLog.Warn(ctx,"CoinMarketCap API limited","symbol",symbol,"errorCode",checkStatus)
+		if w != nil {
+			w.Write(msg)
+		}
 		return nil, errors.New("API limited")
 	}
 	var currency = "data."+symbol
 	checkCorrectCurrency := gjson.Get(string(respBody),currency).Exists()
 	if !checkCorrectCurrency {
-		fmt.Println("CoinMarket data error")
+		providerLog.Warn(ctx,"CoinMarketCap has no data","symbol",symbol)
 		return nil, errors.New("CoinMarket data error")
 	}
 
@@ -242,19 +396,22 @@ func getCoinMarketInfo(w http.ResponseWriter, symbol string) (map[string]interfa
 	tokenInfo["provider"] = gjson.Get(string(respBody), slug).String()
 	tokenInfo["circulatingSupply"] = gjson.Get(string(respBody),circulatingSupply).Float()
 	tokenInfo["lastUpdatedTimestamp"] = gjson.Get(string(respBody),lastUpdated).String()
+	tokenInfo["price"] = gjson.Get(string(respBody),"data."+symbol+".quote.USD.price").Float()
+	tokenInfo["volume24h"] = gjson.Get(string(respBody),"data."+symbol+".quote.USD.volume_24h").Float()
+	tokenInfo["marketCap"] = gjson.Get(string(respBody),"data."+symbol+".quote.USD.market_cap").Float()
+	// The raw listing keeps the numbers CoinMarketCap left out apart from zeros.
+	tokenInfo["listing"] = gjson.Get(string(respBody),"data."+symbol).Raw
 
 	//w.Write(respBody)
-	fmt.Println("==========CoinMarket===========")
-	fmt.Println(tokenInfo)
-	fmt.Println("===============================")
+	providerLog.Debug(ctx,"CoinMarketCap info","symbol",symbol,"info",tokenInfo)
 	return tokenInfo,nil
 }
 
-func getCoinBaseInfo(w http.ResponseWriter,symbol string, currencyCode []string) (map[string]float64 ,error, int){
-	client := &http.Client{}
-	req, err := http.NewRequest("GET",coinBaseApi,nil)
+func getCoinBaseInfo(ctx context.Context, w http.ResponseWriter,symbol string, currencyCode []string) (map[string]float64 ,error, int){
+	client := providerClient("coinbase")
+	req, err := http.NewRequestWithContext(ctx,"GET",coinBaseApi,nil)
 	if err != nil {
-		log.Print(err)
+		providerLog.Error(ctx,"invalid Coinbase request","error",err)
 		os.Exit(1)
 	}
 	q := url.Values{}
@@ -264,7 +421,7 @@ func getCoinBaseInfo(w http.ResponseWriter,symbol string, currencyCode []string)
 	resp, err := client.Do(req)
 	if err != nil {
 		msg, _ := json.Marshal(errResult{400, "Error getting cryptocurrency prices"})
-		fmt.Println("Error getting cryptocurrency prices")
+		providerLog.Warn(ctx,"error getting Coinbase prices","symbol",symbol,"error",err)
 		w.Write(msg)
 		return nil, errors.New("Error getting cryptocurrency prices"),400
 
@@ -292,29 +449,27 @@ func getCoinBaseInfo(w http.ResponseWriter,symbol string, currencyCode []string)
 			//fmt.Println(gjson.Get(string(respBody), path).Float())
 			}
 	}
-	fmt.Println("==========CurrencyPrice===========")
-	fmt.Println(currencyPrice)
-	fmt.Println("==================================")
+	providerLog.Debug(ctx,"Coinbase prices","symbol",symbol,"prices",currencyPrice)
 	return currencyPrice,nil,0
 }
 
-func getCoinGeckoInfo( w http.ResponseWriter,symbol string, currencyCode []string)(map[string]map[string]interface{},error){
+func (a *App) getCoinGeckoInfo(ctx context.Context, w http.ResponseWriter,symbol string, currencyCode []string)(map[string]map[string]interface{},error){
 	var tokenInfoMap = make(map[string]map[string]interface{})
+	id := a.getSymbolId(ctx,symbol)
+	providerLog.Debug(ctx,"CoinGecko id","symbol",symbol,"id",id)
+	if id == "" {
+		return nil, errors.New("No CoinGecko id for "+symbol)
+	}
 	for _, code := range currencyCode {
 		tmp := strings.ToUpper(code)
 		code:= strings.TrimSpace(tmp)
-		client := &http.Client{}
-		req, err := http.NewRequest("GET",coinGeckoApi, nil)
+		ctx, span := startChildSpan(ctx,"coingecko "+code,spanInternal,"symbol",symbol,"currency",code)
+		client := providerClient("coingecko")
+		req, err := http.NewRequestWithContext(ctx,"GET",coinGeckoApi, nil)
 		if err != nil {
-			log.Print(err)
+			providerLog.Error(ctx,"invalid CoinGecko request","error",err)
 			os.Exit(1)
 		}
-		ctx := context.TODO()
-		co := initializeMongoLocalClient(ctx,cfg)
-		id := getSymbolId(co,symbol)
-		fmt.Println("==========TokenId==========")
-		fmt.Println(id)
-		fmt.Println("===============================")
 
 		q := url.Values{}
 		q.Add("vs_currency",code)
@@ -324,8 +479,12 @@ func getCoinGeckoInfo( w http.ResponseWriter,symbol string, currencyCode []strin
 		resp, err := client.Do(req)
 		if err != nil {
 			msg, _ := json.Marshal(errResult{400, "Error getting cryptocurrency info"})
-			fmt.Println("Error getting cryptocurrency prices")
-			w.Write(msg)
+			providerLog.Warn(ctx,"error getting CoinGecko info","symbol",symbol,"currency",code,"error",err)
+			if w != nil {
+				w.Write(msg)
+			}
+			span.SetError(err)
+			span.Finish()
 			return nil, errors.New("Error getting cryptocurrency prices")
 		}
 		respBody, _ := ioutil.ReadAll(resp.Body)
@@ -333,18 +492,32 @@ func getCoinGeckoInfo( w http.ResponseWriter,symbol string, currencyCode []strin
 		//fmt.Println(string(respBody))
 		if gjson.Get(string(respBody),"error").Exists() {
 			msg, _ := json.Marshal(errResult{400, "Invalid currency "+ code})
-			fmt.Println("Invalid currency "+code)
-			w.Write(msg)
+			providerLog.Warn(ctx,"CoinGecko rejected currency","symbol",symbol,"currency",code)
+			if w != nil {
+				w.Write(msg)
+			}
+			span.SetError(errors.New("Invalid currency "+code))
+			span.Finish()
 			return nil, errors.New("Invalid currency"+code)
 		}
 		var coinGeckoMarket = make([]CoinGeckoMarket,0)
 		err = json.Unmarshal([]byte(string(respBody)), &coinGeckoMarket)
 		//fmt.Println(coinGeckoMarket)
 		if err != nil {
-			fmt.Println("Error decoding coinGeckoMarket Info")
+			providerLog.Warn(ctx,"error decoding CoinGecko info","symbol",symbol,"currency",code,"error",err)
+			countError("decode")
+			span.SetError(err)
+			span.Finish()
 			return nil ,err
 
 		}
+		// An empty list answers ids CoinGecko no longer lists.
+		if len(coinGeckoMarket) == 0 {
+			providerLog.Warn(ctx,"no CoinGecko market","symbol",symbol,"id",id,"currency",code)
+			span.SetError(errors.New("No CoinGecko market for "+id))
+			span.Finish()
+			return nil, errors.New("No CoinGecko market for "+id)
+		}
 		//fmt.Println(coinGeckoMarket[0].Image)
 		
 		tokenInfo["price"] = float64(coinGeckoMarket[0].CurrentPrice)
@@ -354,13 +527,14 @@ func getCoinGeckoInfo( w http.ResponseWriter,symbol string, currencyCode []strin
 		}
 		tokenInfo["circulatingSupply"] = float64(coinGeckoMarket[0].CirculatingSupply)
 		tokenInfo["marketCap"] = float64(coinGeckoMarket[0].MarketCap)
+		tokenInfo["totalVolume"] = float64(coinGeckoMarket[0].TotalVolume)
+		tokenInfo["market"] = gjson.Get(string(respBody),"0").Raw
 		tokenInfo["lastUpdatedTimestamp"] = coinGeckoMarket[0].LastUpdated.String()
 
 		tokenInfoMap[code] = tokenInfo
+		span.Finish()
 	}
-	fmt.Println("===========CoinGecko============")
-	fmt.Println(tokenInfoMap)
-	fmt.Println("================================")
+	providerLog.Debug(ctx,"CoinGecko info","symbol",symbol,"info",tokenInfoMap)
 	return tokenInfoMap,nil
 
 }
@@ -386,7 +560,24 @@ func checkAPI(coinBaseErr error,coinMarketErr error, coinGeckoErr error) int {
 	}
 
 }
-func processBMG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}){
+// cacheData stores the supply figures of a fresh answer for five minutes and
+// publishes it to the price stream.
+func (a *App) cacheData(ctx context.Context, symbolPro string, res []Data) {
+	if len(res) == 0 {
+		return
+	}
+	data := res[len(res)-1]
+	redis := Redis{data.MarketCap,data.CirculatingSupply,data.MaxSupply,data.Provider,data.LastUpdatedTimestamp}
+	redisJson, err := json.Marshal(redis)
+	if err != nil {
+		cacheLog.Error(ctx,"error encoding info for the cache","symbol",symbolPro,"error",err)
+	}
+	a.cacheSet(ctx,symbolPro,redisJson,300*time.Second)
+	if !a.stores.isDown("redis") {
+		publishPrice(ctx,a.Redis,symbolPro,res)
+	}
+}
+func processBMG(symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) []Data {
 	var data Data
 	var res []Data
 	for k,v := range currencyPrice {
@@ -409,24 +600,9 @@ func processBMG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]
 		res = append(res,data)
 
 	}
-	ctx := context.TODO()
-	rds := initializeRedisLocalClient(ctx,cfg)
-	redis := Redis{data.MarketCap,data.CirculatingSupply,data.MaxSupply,data.Provider,data.LastUpdatedTimestamp}
-	redisJson, err := json.Marshal(redis)
-	if err != nil {
-		fmt.Println("Encoding error")
-	}
-	err = rds.Set(ctx,symbolPro,redisJson,300*time.Second).Err()
-	if err != nil {
-		fmt.Println("Set redis error")
-	}
-	result, err := json.Marshal(res)
-	if err != nil {
-		fmt.Println(err)
-	}
-	w.Write(result)
+	return res
 }
-func processRedis(w http.ResponseWriter,symbolPro string,currencyPrice map[string]float64, redisJson Redis){
+func processRedis(symbolPro string,currencyPrice map[string]float64, redisJson Redis) []Data {
 	var data Data
 	var res []Data
 	for k,v := range currencyPrice {
@@ -444,14 +620,9 @@ func processRedis(w http.ResponseWriter,symbolPro string,currencyPrice map[strin
 		res = append(res,data)
 
 	}
-	result, err := json.Marshal(res)
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Println("=============Get redis data============")
-	w.Write(result)
+	return res
 }
-func processMG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}){
+func processMG(symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) []Data {
 	var data Data
 	var res []Data
 	for k,_ := range currencyPrice {
@@ -472,25 +643,9 @@ func processMG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]f
 		res = append(res,data)
 
 	}
-	ctx := context.TODO()
-	rds := initializeRedisLocalClient(ctx,cfg)
-	redis := Redis{data.MarketCap,data.CirculatingSupply,data.MaxSupply,data.Provider,data.LastUpdatedTimestamp}
-	redisJson, err := json.Marshal(redis)
-	if err != nil {
-		fmt.Println("Encoding error")
-	}
-	err = rds.Set(ctx,symbolPro,redisJson,300*time.Second).Err()
-	if err != nil {
-		fmt.Println("Set redis error")
-	}
-
-	result, err := json.Marshal(res)
-	if err != nil {
-		fmt.Println(err)
-	}
-	w.Write(result)
+	return res
 }
-func processBG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}){
+func processBG(symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) []Data {
 	var data Data
 	var res []Data
 	for k,v := range currencyPrice {
@@ -511,25 +666,10 @@ func processBG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]f
 		res = append(res,data)
 
 	}
-	ctx := context.TODO()
-	rds := initializeRedisLocalClient(ctx,cfg)
-	redis := Redis{data.MarketCap,data.CirculatingSupply,data.MaxSupply,data.Provider,data.LastUpdatedTimestamp}
-	redisJson, err := json.Marshal(redis)
-	if err != nil {
-		fmt.Println("Encoding error")
-	}
-	err = rds.Set(ctx,symbolPro,redisJson,300*time.Second).Err()
-	if err != nil {
-		fmt.Println("Set redis error")
-	}
-	result, err := json.Marshal(res)
-	if err != nil {
-		fmt.Println(err)
-	}
-	w.Write(result)
+	return res
 }
 
-func processBM(w http.ResponseWriter,symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}){
+func processBM(symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) []Data {
 	var data Data
 	var res []Data
 	for k,v := range currencyPrice {
@@ -551,24 +691,9 @@ func processBM(w http.ResponseWriter,symbolPro string,currencyPrice map[string]f
 		res = append(res,data)
 
 	}
-	ctx := context.TODO()
-	rds := initializeRedisLocalClient(ctx,cfg)
-	redis := Redis{data.MarketCap,data.CirculatingSupply,data.MaxSupply,data.Provider,data.LastUpdatedTimestamp}
-	redisJson, err := json.Marshal(redis)
-	if err != nil {
-		fmt.Println("Encoding error")
-	}
-	err = rds.Set(ctx,symbolPro,redisJson,300*time.Second).Err()
-	if err != nil {
-		fmt.Println("Set redis error")
-	}
-	result, err := json.Marshal(res)
-	if err != nil {
-		fmt.Println(err)
-	}
-	w.Write(result)
+	return res
 }
-func processG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}){
+func processG(symbolPro string,currencyPrice map[string]float64, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) []Data {
 	var data Data
 	var res []Data
 	for k,_ := range currencyPrice {
@@ -589,99 +714,259 @@ func processG(w http.ResponseWriter,symbolPro string,currencyPrice map[string]fl
 		res = append(res,data)
 
 	}
-	ctx := context.TODO()
-	rds := initializeRedisLocalClient(ctx,cfg)
-	redis := Redis{data.MarketCap,data.CirculatingSupply,data.MaxSupply,data.Provider,data.LastUpdatedTimestamp}
-	redisJson, err := json.Marshal(redis)
+	return res
+}
+
+// initializeRedisLocalClient connects to a single Redis, to the master a
+// Sentinel group names or to a Redis Cluster, following redis_local.mode.
+func initializeRedisLocalClient( ctx context.Context, cfg Config) redis.UniversalClient {
+	opts, err := redisOptions(cfg)
 	if err != nil {
-		fmt.Println("Encoding error")
+		cacheLog.Error(ctx,"invalid redis configuration","error",err)
+		os.Exit(1)
 	}
-	err = rds.Set(ctx,symbolPro,redisJson,300*time.Second).Err()
-	if err != nil {
-		fmt.Println("Set redis error")
+	var rdb redis.UniversalClient
+	switch cfg.Redis_Local.Mode {
+	case redisSentinel:
+		rdb = redis.NewFailoverClient(opts.Failover())
+	case redisCluster:
+		rdb = redis.NewClusterClient(opts.Cluster())
+	default:
+		rdb = redis.NewClient(opts.Simple())
 	}
-	result, err := json.Marshal(res)
-	if err != nil {
-		fmt.Println(err)
+	if cfg.Tracing.Enabled {
+		rdb.AddHook(redisTracing{})
 	}
-	w.Write(result)
-}
-
-func initializeRedisLocalClient( ctx context.Context, cfg Config) *redis.Client {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     cfg.Redis_Local.Host+":"+cfg.Redis_Local.Port,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	_, err := rdb.Ping(ctx).Result()
+	_, err = rdb.Ping(ctx).Result()
 	if err != nil {
-		fmt.Println("redis链接错误")
+		cacheLog.Warn(ctx,"error connecting to redis","error",err)
+		countError("redis")
 	}
 	return rdb
 }
+
+// redisOptions are the options of every redis mode; standalone uses host and
+// port when no addrs are given.
+func redisOptions(cfg Config) (*redis.UniversalOptions, error) {
+	switch cfg.Redis_Local.Mode {
+	case redisStandalone, "":
+	case redisSentinel:
+		if cfg.Redis_Local.MasterName == "" {
+			return nil, errors.New("redis sentinel mode needs a master_name")
+		}
+	case redisCluster:
+	default:
+		return nil, errors.New("unknown redis mode " + cfg.Redis_Local.Mode)
+	}
+	addrs := cfg.Redis_Local.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{cfg.Redis_Local.Host+":"+cfg.Redis_Local.Port}
+	}
+	var tlsConfig *tls.Config
+	if cfg.Redis_Local.Tls {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return &redis.UniversalOptions{
+		Addrs:            addrs,
+		MasterName:       cfg.Redis_Local.MasterName,
+		Username:         cfg.Redis_Local.Username,
+		Password:         cfg.Redis_Local.Password,
+		SentinelPassword: cfg.Redis_Local.SentinelPassword,
+		DB:               cfg.Redis_Local.DB,
+		TLSConfig:        tlsConfig,
+		Dialer:           redisDialer(tlsConfig),
+		PoolSize:         cfg.Redis_Local.PoolSize,
+		MinIdleConns:     cfg.Redis_Local.MinIdleConns,
+	}, nil
+}
+
+// initializeMongoLocalClient connects to mongo_local.uri or, without one, to
+// host and port. The credentials, replica set and TLS settings apply to both.
 func initializeMongoLocalClient( ctx context.Context, cfg Config) *mongo.Client {
-	var clientOptions *options.ClientOptions
-	clientOptions = options.Client().ApplyURI("mongodb://" + cfg.Mongo_Local.Host + ":" + cfg.Mongo_Local.Port + "/" + cfg.Mongo_Local.Database)
+	clientOptions, err := mongoOptions(cfg)
+	if err != nil {
+		storeLog.Error(ctx,"invalid mongo configuration","error",err)
+		os.Exit(1)
+	}
+	clientOptions.SetPoolMonitor(mongoPoolMonitor)
+	if cfg.Tracing.Enabled {
+		clientOptions.SetMonitor(mongoCommandMonitor)
+	}
+	ctx, span := startChildSpan(ctx,"mongo connect",spanClient,"db.system","mongodb")
+	defer span.Finish()
 	cl, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		fmt.Println("connect mongo error")
+		// Connect only fails on options it can't use.
+		storeLog.Error(ctx,"invalid mongo configuration","error",err)
+		os.Exit(1)
 	}
 	err = cl.Ping(ctx, nil)
 	if err != nil {
-		fmt.Println("ping mongo error")
+		storeLog.Warn(ctx,"error pinging mongo","error",err)
+		countError("mongo")
+		span.SetError(err)
 	}
 	return cl
 }
-func setSymbolId() {
-	ctx := context.TODO()
-	cfg , err := OpenConfigFile()
+
+// mongoOptions applies the credentials, replica set, TLS and pool settings
+// over the connection string, failing on a URI or CA file it can't use.
+func mongoOptions(cfg Config) (*options.ClientOptions, error) {
+	uri := cfg.Mongo_Local.Uri
+	if uri == "" {
+		uri = "mongodb://" + cfg.Mongo_Local.Host + ":" + cfg.Mongo_Local.Port + "/" + cfg.Mongo_Local.Database
+	}
+	clientOptions := options.Client().ApplyURI(uri)
+	if cfg.Mongo_Local.User != "" {
+		clientOptions.SetAuth(options.Credential{
+			Username:   cfg.Mongo_Local.User,
+			Password:   cfg.Mongo_Local.Pass,
+			AuthSource: cfg.Mongo_Local.AuthSource,
+		})
+	}
+	if cfg.Mongo_Local.ReplicaSet != "" {
+		clientOptions.SetReplicaSet(cfg.Mongo_Local.ReplicaSet)
+	}
+	if cfg.Mongo_Local.Tls {
+		tlsConfig, err := mongoTLSConfig(cfg.Mongo_Local.TlsCaFile)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetTLSConfig(tlsConfig)
+	}
+	if cfg.Mongo_Local.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(cfg.Mongo_Local.MaxPoolSize)
+	}
+	clientOptions.SetMinPoolSize(cfg.Mongo_Local.MinPoolSize)
+	return clientOptions, clientOptions.Validate()
+}
+
+// mongoTLSConfig trusts the CA of caFile, or the system roots without one.
+func mongoTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
 	if err != nil {
-		fmt.Println("Open config error")
+		return nil, err
 	}
-	co := initializeMongoLocalClient(ctx,cfg)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET",symbolIdApi, nil)
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in " + caFile)
+	}
+	return tlsConfig, nil
+}
+func (a *App) setSymbolId() {
+	start := time.Now()
+	ctx := context.TODO()
+	co := a.Mongo
+	client := providerClient("coingecko")
+	req, err := http.NewRequestWithContext(ctx,"GET",symbolIdApi, nil)
 	if err != nil {
-		log.Print(err)
+		syncLog.Error(ctx,"invalid symbol list request","error",err)
 		os.Exit(1)
 	}
 	req.Header.Set("Accepts", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println("Error getting symbolId")
+		syncLog.Error(ctx,"error getting the CoinGecko symbol list","error",err)
+		recordSymbolSync(start,0,err)
+		return
 	}
 	respBody, _ := ioutil.ReadAll(resp.Body)
 	var symbolIdList []SymbolId
 	//fmt.Println(string(respBody))
 	err = json.Unmarshal([]byte(string(respBody)), &symbolIdList)
 	if err != nil {
-		fmt.Println("Error decoding symbolId Info")
+		syncLog.Error(ctx,"error decoding the CoinGecko symbol list","error",err)
+		countError("decode")
+		recordSymbolSync(start,0,err)
+		return
 	}
 	//fmt.Println(symbolIdList)
-	co.Database("id").Collection("symbolId").Drop(ctx)
+	// Load into a staging collection and swap it in, so that lookups and
+	// readiness never see the list half loaded.
+	staging := co.Database("id").Collection("symbolId_sync")
+	staging.Drop(ctx)
+	inserted := 0
 	for _,symbolId := range symbolIdList {
-		insertOne, err := co.Database("id").Collection("symbolId").InsertOne(ctx,symbolId)
+		_, err := staging.InsertOne(ctx,symbolId)
 		if err != nil {
-			fmt.Println("Insert Error")
+			syncLog.Warn(ctx,"error inserting symbol","symbol",symbolId.Symbol,"id",symbolId.Id,"error",err)
+			countError("mongo")
+			continue
 		}
-		fmt.Println(insertOne)
+		inserted++
 		}
+	if inserted == 0 {
+		syncLog.Error(ctx,"no CoinGecko symbols synced","listed",len(symbolIdList))
+		recordSymbolSync(start,0,errors.New("no symbols inserted"))
+		return
+	}
+	err = co.Database("admin").RunCommand(ctx,bson.D{
+		{Key: "renameCollection", Value: "id.symbolId_sync"},
+		{Key: "to", Value: "id.symbolId"},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		syncLog.Error(ctx,"error swapping in the CoinGecko symbols","error",err)
+		countError("mongo")
+		recordSymbolSync(start,0,err)
+		return
+	}
+	syncLog.Info(ctx,"synced CoinGecko symbols","documents",inserted,"durationMs",time.Since(start).Milliseconds())
+	a.symbols.load(symbolIdList)
+	saveSymbolSnapshot(ctx,symbolIdList)
+	recordSymbolSync(start,inserted,nil)
+	symbolSyncLastSuccess.SetToCurrentTime()
+	symbolSyncDocuments.Set(float64(inserted))
+	symbolSyncDuration.Set(time.Since(start).Seconds())
 }
-func getSymbolId (co *mongo.Client,symbol string) string {
-	ctx := context.TODO()
+// symbolCollection is the CoinGecko symbol list, read with the preference set
+// for symbol lookups so that they can be served by secondaries.
+func symbolCollection(co *mongo.Client) *mongo.Collection {
+	opts := options.Collection()
+	mode, err := readpref.ModeFromString(cfg.Mongo_Local.SymbolReadPreference)
+	if err == nil {
+		rp, err := readpref.New(mode)
+		if err == nil {
+			opts.SetReadPreference(rp)
+		}
+	}
+	return co.Database("id").Collection("symbolId", opts)
+}
+// getSymbolId looks the CoinGecko id of symbol up in mongo or, while mongo is
+// unreachable, in the in-memory copy of the symbol list.
+func (a *App) getSymbolId (ctx context.Context, symbol string) string {
 	tmp := strings.ToLower(symbol)
 	symbolP := strings.TrimSpace(tmp)
-	filter := bson.M{"symbol": symbolP}
-	fmt.Println("==========TokenSymbol==========")
-	fmt.Println(symbolP)
-	fmt.Println("===============================")
-	result := co.Database("id").Collection("symbolId").FindOne(ctx,filter )
-	var symbolId SymbolId
-	err :=result.Decode(&symbolId)
-	if err != nil {
-		fmt.Println("Decode symbolId error")
+	var symbolIds []SymbolId
+	var err error
+	if !a.stores.isDown("mongo") {
+		co := a.Mongo
+		filter := bson.M{"symbol": symbolP}
+		var cursor *mongo.Cursor
+		cursor, err = symbolCollection(co).Find(ctx,filter)
+		if err == nil {
+			err = cursor.All(ctx,&symbolIds)
+		}
+		if err != nil {
+			storeLog.Warn(ctx,"error finding CoinGecko id","symbol",symbolP,"error",err)
+			countError("mongo")
+			if unreachable(ctx,err) {
+				a.stores.markDown(ctx,"mongo",err)
+			}
+		}
+	}
+	if a.stores.isDown("mongo") {
+		symbolIds = a.symbols.get(symbolP)
+	}
+	if len(symbolIds) == 0 {
+		storeLog.Warn(ctx,"no CoinGecko id","symbol",symbolP,"error",err)
+		return ""
 	}
-	return symbolId.Id
+	return preferUpbitListed(symbol,symbolIds).Id
 
 }
 func OpenConfigFile() (Config, error) {
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		set    func(c *Config)
+		addrs  []string
+		master string
+		tls    bool
+		err    bool
+	}{
+		{"standalone from host and port", func(c *Config) {}, []string{"redis:6379"}, "", false, false},
+		{"standalone by default", func(c *Config) { c.Redis_Local.Mode = "" }, []string{"redis:6379"}, "", false, false},
+		{"standalone with tls", func(c *Config) { c.Redis_Local.Tls = true }, []string{"redis:6379"}, "", true, false},
+		{"sentinel", func(c *Config) {
+			c.Redis_Local.Mode = redisSentinel
+			c.Redis_Local.Addrs = []string{"s1:26379", "s2:26379"}
+			c.Redis_Local.MasterName = "cache"
+		}, []string{"s1:26379", "s2:26379"}, "cache", false, false},
+		{"sentinel without master", func(c *Config) { c.Redis_Local.Mode = redisSentinel }, nil, "", false, true},
+		{"cluster with tls", func(c *Config) {
+			c.Redis_Local.Mode = redisCluster
+			c.Redis_Local.Addrs = []string{"n1:6379", "n2:6379", "n3:6379"}
+			c.Redis_Local.Tls = true
+		}, []string{"n1:6379", "n2:6379", "n3:6379"}, "", true, false},
+		{"unknown mode", func(c *Config) { c.Redis_Local.Mode = "replicated" }, nil, "", false, true},
+	} {
+		var c Config
+		c.Redis_Local.Mode = redisStandalone
+		c.Redis_Local.Host, c.Redis_Local.Port = "redis", "6379"
+		c.Redis_Local.Password, c.Redis_Local.SentinelPassword = "secret", "sentinel-secret"
+		c.Redis_Local.DB, c.Redis_Local.PoolSize = 2, 50
+		tc.set(&c)
+		opts, err := redisOptions(c)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %v", tc.name, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(opts.Addrs, tc.addrs) || opts.MasterName != tc.master || (opts.TLSConfig != nil) != tc.tls {
+			t.Errorf("%s: addrs %v master %q tls %v", tc.name, opts.Addrs, opts.MasterName, opts.TLSConfig != nil)
+		}
+		if opts.Dialer == nil || opts.Password != "secret" || opts.DB != 2 || opts.PoolSize != 50 {
+			t.Errorf("%s: options %+v", tc.name, opts)
+		}
+		switch c.Redis_Local.Mode {
+		case redisSentinel:
+			failover := opts.Failover()
+			if failover.MasterName != tc.master || failover.SentinelPassword != "sentinel-secret" || !reflect.DeepEqual(failover.SentinelAddrs, tc.addrs) {
+				t.Errorf("%s: failover options %+v", tc.name, failover)
+			}
+		case redisCluster:
+			cluster := opts.Cluster()
+			if !reflect.DeepEqual(cluster.Addrs, tc.addrs) || cluster.TLSConfig == nil {
+				t.Errorf("%s: cluster options %+v", tc.name, cluster)
+			}
+		default:
+			simple := opts.Simple()
+			if simple.Addr != tc.addrs[0] || simple.DB != 2 || (simple.TLSConfig != nil) != tc.tls {
+				t.Errorf("%s: client options %+v", tc.name, simple)
+			}
+		}
+	}
+}
+
+func TestMongoOptions(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(t.TempDir(), "empty.pem")
+	ioutil.WriteFile(emptyFile, nil, 0600)
+
+	for _, tc := range []struct {
+		name       string
+		set        func(c *Config)
+		hosts      []string
+		replicaSet string
+		user       string
+		tls        bool
+		rootCAs    bool
+		err        bool
+	}{
+		{"host and port", func(c *Config) {}, []string{"mongo:27017"}, "", "", false, false, false},
+		{"uri replica set", func(c *Config) {
+			c.Mongo_Local.Uri = "mongodb://m1:27017,m2:27017,m3:27017/id?replicaSet=rs0"
+		}, []string{"m1:27017", "m2:27017", "m3:27017"}, "rs0", "", false, false, false},
+		{"replica set over the uri", func(c *Config) {
+			c.Mongo_Local.Uri = "mongodb://m1:27017,m2:27017/id?replicaSet=rs0"
+			c.Mongo_Local.ReplicaSet = "rs1"
+		}, []string{"m1:27017", "m2:27017"}, "rs1", "", false, false, false},
+		{"credentials", func(c *Config) {
+			c.Mongo_Local.User, c.Mongo_Local.Pass, c.Mongo_Local.AuthSource = "app", "secret", "admin"
+		}, []string{"mongo:27017"}, "", "app", false, false, false},
+		{"tls with system roots", func(c *Config) { c.Mongo_Local.Tls = true }, []string{"mongo:27017"}, "", "", true, false, false},
+		{"tls with a CA file", func(c *Config) {
+			c.Mongo_Local.Tls, c.Mongo_Local.TlsCaFile = true, caFile
+		}, []string{"mongo:27017"}, "", "", true, true, false},
+		{"missing CA file", func(c *Config) {
+			c.Mongo_Local.Tls, c.Mongo_Local.TlsCaFile = true, filepath.Join(t.TempDir(), "missing.pem")
+		}, nil, "", "", false, false, true},
+		{"CA file without certificates", func(c *Config) {
+			c.Mongo_Local.Tls, c.Mongo_Local.TlsCaFile = true, emptyFile
+		}, nil, "", "", false, false, true},
+		{"invalid uri", func(c *Config) { c.Mongo_Local.Uri = "mysql://m1" }, nil, "", "", false, false, true},
+	} {
+		var c Config
+		c.Mongo_Local.Host, c.Mongo_Local.Port, c.Mongo_Local.Database = "mongo", "27017", "id"
+		c.Mongo_Local.MaxPoolSize, c.Mongo_Local.MinPoolSize = 50, 5
+		tc.set(&c)
+		opts, err := mongoOptions(c)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, want error %v", tc.name, err, tc.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(opts.Hosts, tc.hosts) {
+			t.Errorf("%s: hosts %v, want %v", tc.name, opts.Hosts, tc.hosts)
+		}
+		replicaSet := ""
+		if opts.ReplicaSet != nil {
+			replicaSet = *opts.ReplicaSet
+		}
+		if replicaSet != tc.replicaSet {
+			t.Errorf("%s: replica set %q, want %q", tc.name, replicaSet, tc.replicaSet)
+		}
+		user := ""
+		if opts.Auth != nil {
+			user = opts.Auth.Username
+			if opts.Auth.Password != "secret" || opts.Auth.AuthSource != "admin" {
+				t.Errorf("%s: credentials %+v", tc.name, opts.Auth)
+			}
+		}
+		if user != tc.user {
+			t.Errorf("%s: user %q, want %q", tc.name, user, tc.user)
+		}
+		if (opts.TLSConfig != nil) != tc.tls || (tc.tls && (opts.TLSConfig.RootCAs != nil) != tc.rootCAs) {
+			t.Errorf("%s: tls %+v", tc.name, opts.TLSConfig)
+		}
+		if *opts.MaxPoolSize != 50 || *opts.MinPoolSize != 5 {
+			t.Errorf("%s: pool %d to %d", tc.name, *opts.MinPoolSize, *opts.MaxPoolSize)
+		}
+	}
+}
+
+func TestMongoOptionsTimeout(t *testing.T) {
+	var c Config
+	c.Mongo_Local.Uri = "mongodb://m1:27017/id?serverSelectionTimeoutMS=100"
+	opts, err := mongoOptions(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *opts.ServerSelectionTimeout != 100*time.Millisecond {
+		t.Errorf("server selection timeout %v", *opts.ServerSelectionTimeout)
+	}
+	if opts.MaxPoolSize != nil {
+		t.Errorf("max pool size %d, want the driver default", *opts.MaxPoolSize)
+	}
+}
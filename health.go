@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	healthzPath string = "/healthz"
+	readyzPath  string = "/readyz"
+	statusPath  string = "/status"
+)
+
+// The providers are probed at most once per upstreamCheckTTL, or once per
+// upstreamFailureTTL while they fail, however often /readyz is polled.
+const (
+	upstreamCheckTTL   = time.Minute
+	upstreamFailureTTL = 10 * time.Second
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var startTime = time.Now()
+
+var (
+	symbolSyncMu   sync.Mutex
+	lastSymbolSync *SyncResult
+)
+
+var upstreamCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// SyncResult is the outcome of a CoinGecko symbol sync.
+type SyncResult struct {
+	Time       time.Time `json:"time"`
+	Ok         bool      `json:"ok"`
+	Documents  int       `json:"documents"`
+	DurationMs int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Check is the outcome of one readiness check.
+type Check struct {
+	Ok        bool   `json:"ok"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status   string           `json:"status"`
+	Checks   map[string]Check `json:"checks"`
+	Degraded []string         `json:"degraded,omitempty"`
+}
+
+type Status struct {
+	Version        string      `json:"version"`
+	StartedAt      time.Time   `json:"startedAt"`
+	UptimeSeconds  int64       `json:"uptimeSeconds"`
+	ConfigHash     string      `json:"configHash"`
+	LastSymbolSync *SyncResult `json:"lastSymbolSync"`
+	// Datastores unreachable, with the time they were found so.
+	Degraded map[string]time.Time `json:"degraded"`
+	Symbols  int                  `json:"symbolsInMemory"`
+}
+
+// operationalPath reports whether the path is one of the endpoints meant for
+// orchestrators and scrapers, which skip auth, rate limits and metering.
+func operationalPath(path string) bool {
+	switch path {
+	case metricsPath, healthzPath, readyzPath, statusPath:
+		return true
+	}
+	return false
+}
+
+// healthzHandler answers as long as the process serves HTTP at all.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// readyzHandler answers 200 once the symbol list has been loaded and at least
+// one upstream provider is reachable. Redis and Mongo being unreachable only
+// makes it degraded, as their fallbacks answer meanwhile.
+func (a *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	checks := make(map[string]Check)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range map[string]func(context.Context) error{
+		"redis":    a.checkRedis,
+		"mongo":    a.checkMongo,
+		"symbols":  a.checkSymbols,
+		"upstream": checkUpstream,
+	} {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			result := Check{Ok: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	readiness := Readiness{Status: "ready", Checks: checks, Degraded: a.stores.names()}
+	code := http.StatusOK
+	if len(readiness.Degraded) > 0 {
+		readiness.Status = "degraded"
+	}
+	for _, name := range []string{"symbols", "upstream"} {
+		if !checks[name].Ok {
+			readiness.Status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	result, _ := json.Marshal(readiness)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(result)
+}
+
+func (a *App) statusHandler(w http.ResponseWriter, r *http.Request) {
+	symbolSyncMu.Lock()
+	lastSync := lastSymbolSync
+	symbolSyncMu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, Status{
+		Version:        version,
+		StartedAt:      startTime.UTC(),
+		UptimeSeconds:  int64(time.Since(startTime).Seconds()),
+		ConfigHash:     configHash(cfg),
+		LastSymbolSync: lastSync,
+		Degraded:       a.stores.since(),
+		Symbols:        a.symbols.len(),
+	})
+}
+
+// checkRedis and checkMongo also mark their datastore up or down, for
+// the fallbacks to be used or left.
+func (a *App) checkRedis(ctx context.Context) error {
+	rds := a.Redis
+	err := rds.Ping(ctx).Err()
+	a.recordCheck(ctx, "redis", err)
+	return err
+}
+
+func (a *App) checkMongo(ctx context.Context) error {
+	co := a.Mongo
+	err := co.Ping(ctx, nil)
+	a.recordCheck(ctx, "mongo", err)
+	return err
+}
+
+func (a *App) recordCheck(ctx context.Context, name string, err error) {
+	if err == nil {
+		a.stores.markUp(ctx, name)
+	} else if ctx.Err() != context.Canceled {
+		a.stores.markDown(ctx, name, err)
+	}
+}
+
+// checkSymbols passes on the in-memory copy of the symbol list while Mongo
+// is unreachable.
+func (a *App) checkSymbols(ctx context.Context) error {
+	co := a.Mongo
+	doc := symbolCollection(co).FindOne(ctx, bson.M{})
+	if doc.Err() == nil {
+		return nil
+	}
+	if unreachable(ctx, doc.Err()) && a.symbols.len() > 0 {
+		return nil
+	}
+	return errors.New("symbol list not loaded: " + doc.Err().Error())
+}
+
+// checkUpstream returns the outcome of the last probe of the providers while
+// it is fresh, else probes them again.
+func checkUpstream(ctx context.Context) error {
+	upstreamCheck.mu.Lock()
+	defer upstreamCheck.mu.Unlock()
+	ttl := upstreamCheckTTL
+	if upstreamCheck.err != nil {
+		ttl = upstreamFailureTTL
+	}
+	if !upstreamCheck.checked.IsZero() && time.Since(upstreamCheck.checked) < ttl {
+		return upstreamCheck.err
+	}
+	err := probeUpstream(ctx)
+	if ctx.Err() != nil {
+		return err
+	}
+	upstreamCheck.checked, upstreamCheck.err = time.Now(), err
+	return err
+}
+
+// probeUpstream tries the providers in turn until one answers with anything
+// but a server error.
+func probeUpstream(ctx context.Context) error {
+	var err error
+	for _, provider := range []struct{ name, url string }{
+		{"coinbase", coinBaseApi},
+		{"coingecko", coinGeckoApi},
+		{"coinmarketcap", coinMarketApi},
+	} {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, "HEAD", provider.url, nil)
+		if err != nil {
+			continue
+		}
+		var resp *http.Response
+		resp, err = providerClient(provider.name).Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 500 {
+			return nil
+		}
+		err = errors.New(provider.name + " status " + resp.Status)
+	}
+	return err
+}
+
+// configHash identifies the configuration loaded, so that replicas running
+// different ones stand out. Secrets are left out, so that the hash can't be
+// used to confirm a guess of one.
+func configHash(cfg Config) string {
+	cfg.Auth.AdminKey = ""
+	cfg.Redis_Local.Password = ""
+	cfg.Redis_Local.SentinelPassword = ""
+	cfg.Mongo_Local.Pass = ""
+	cfg.Mongo_Local.Uri = redactUri(cfg.Mongo_Local.Uri)
+	cfg.Quality.Webhook = ""
+	b, _ := yaml.Marshal(cfg)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// redactUri drops the password of a connection string. URIs listing several
+// hosts don't parse as URLs, so the user info is cut by hand.
+func redactUri(uri string) string {
+	scheme := strings.Index(uri, "://")
+	if scheme < 0 {
+		return uri
+	}
+	rest := uri[scheme+3:]
+	authority := rest
+	if slash := strings.IndexAny(rest, "/?"); slash >= 0 {
+		authority = rest[:slash]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return uri
+	}
+	user := authority[:at]
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		user = user[:colon]
+	}
+	return uri[:scheme+3] + user + rest[at:]
+}
+
+func recordSymbolSync(start time.Time, documents int, err error) {
+	result := &SyncResult{
+		Time:       start.UTC(),
+		Ok:         err == nil,
+		Documents:  documents,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	symbolSyncMu.Lock()
+	lastSymbolSync = result
+	symbolSyncMu.Unlock()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const requestIdHeader string = "X-Request-ID"
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+type requestIdKey struct{}
+
+// One logger per subsystem, each with the verbosity set for it under
+// log.subsystems in the config, or log.level.
+var (
+	serverLog   = newLogger("server")
+	providerLog = newLogger("providers")
+	cacheLog    = newLogger("cache")
+	syncLog     = newLogger("sync")
+	storeLog    = newLogger("store")
+	streamLog   = newLogger("stream")
+	qualityLog  = newLogger("quality")
+	usageLog    = newLogger("usage")
+)
+
+var (
+	logMu  sync.Mutex
+	logOut io.Writer = os.Stdout
+)
+
+// Logger writes one JSON object per line with the time, level, subsystem,
+// the request ID and span found in ctx, the message and then the key-value
+// pairs given, in order.
+type Logger struct {
+	subsystem string
+}
+
+func newLogger(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+func (l *Logger) Debug(ctx context.Context, msg string, kv ...interface{}) {
+	l.log(ctx, levelDebug, msg, kv)
+}
+
+func (l *Logger) Info(ctx context.Context, msg string, kv ...interface{}) {
+	l.log(ctx, levelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(ctx context.Context, msg string, kv ...interface{}) {
+	l.log(ctx, levelWarn, msg, kv)
+}
+
+func (l *Logger) Error(ctx context.Context, msg string, kv ...interface{}) {
+	l.log(ctx, levelError, msg, kv)
+}
+
+func (l *Logger) log(ctx context.Context, level int, msg string, kv []interface{}) {
+	if level < l.level() {
+		return
+	}
+	entry := jsonObject{
+		{"time", time.Now().UTC().Format(time.RFC3339Nano)},
+		{"level", levelNames[level]},
+		{"subsystem", l.subsystem},
+	}
+	if id := requestId(ctx); id != "" {
+		entry = append(entry, jsonField{"requestId", id})
+	}
+	if span := spanFromContext(ctx); span != nil {
+		entry = append(entry, jsonField{"traceId", span.TraceId}, jsonField{"spanId", span.SpanId})
+	}
+	entry = append(entry, jsonField{"msg", msg})
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := kv[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry = append(entry, jsonField{fmt.Sprint(kv[i]), value})
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(jsonObject{{"level", levelNames[level]}, {"subsystem", l.subsystem}, {"msg", msg}})
+	}
+	logMu.Lock()
+	logOut.Write(append(line, '\n'))
+	logMu.Unlock()
+}
+
+func (l *Logger) level() int {
+	if name, ok := cfg.Log.Subsystems[l.subsystem]; ok {
+		return parseLevel(name)
+	}
+	return parseLevel(cfg.Log.Level)
+}
+
+func parseLevel(name string) int {
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level
+		}
+	}
+	return levelInfo
+}
+
+func requestId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	if !validRequestId(id) {
+		id = newRequestId()
+	}
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestId accepts the IDs proxies and clients commonly send (UUIDs,
+// hex and the like) and nothing that could garble a log line.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// logRequests tags every request with the X-Request-ID it came with, or a
+// new one, echoes it in the response and logs the request once served.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withRequestId(r.Context(), r.Header.Get(requestIdHeader))
+		r = r.WithContext(ctx)
+		w.Header().Set(requestIdHeader, requestId(ctx))
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		if isStreaming(r) {
+			next.ServeHTTP(w, r)
+		} else {
+			next.ServeHTTP(sw, r)
+		}
+		serverLog.Info(ctx, "request served",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", sw.status,
+			"latencyMs", time.Since(start).Milliseconds(),
+			"client", clientIP(r))
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the log lines of the test to a buffer.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logMu.Lock()
+	saved := logOut
+	logOut = &buf
+	logMu.Unlock()
+	t.Cleanup(func() {
+		logMu.Lock()
+		logOut = saved
+		logMu.Unlock()
+	})
+	return &buf
+}
+
+func withLogLevels(t *testing.T, level string, subsystems map[string]string) {
+	saved := cfg
+	cfg.Log.Level = level
+	cfg.Log.Subsystems = subsystems
+	t.Cleanup(func() { cfg = saved })
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	withLogLevels(t, "warn", map[string]string{"cache": "debug", "sync": "error", "store": "verbose"})
+	for _, tc := range []struct {
+		logger *Logger
+		level  int
+		logged bool
+	}{
+		{serverLog, levelInfo, false},
+		{serverLog, levelWarn, true},
+		{cacheLog, levelDebug, true},
+		{syncLog, levelWarn, false},
+		{syncLog, levelError, true},
+		// An unknown level name falls back to info.
+		{storeLog, levelDebug, false},
+		{storeLog, levelInfo, true},
+	} {
+		buf := captureLog(t)
+		tc.logger.log(context.Background(), tc.level, "message", nil)
+		if logged := buf.Len() > 0; logged != tc.logged {
+			t.Errorf("%s at %s: logged %v, want %v", tc.logger.subsystem, levelNames[tc.level], logged, tc.logged)
+		}
+	}
+}
+
+func TestLogLine(t *testing.T) {
+	withLogLevels(t, "info", nil)
+	buf := captureLog(t)
+	ctx := withRequestId(context.Background(), "req-1")
+	providerLog.Warn(ctx, "error getting prices", "symbol", "BTC", "error", errors.New("timeout"), "dangling")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("line %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"level": "warn", "subsystem": "providers", "requestId": "req-1",
+		"msg": "error getting prices", "symbol": "BTC", "error": "timeout",
+	} {
+		if entry[key] != want {
+			t.Errorf("%s = %v, want %v", key, entry[key], want)
+		}
+	}
+	if _, ok := entry["dangling"]; ok {
+		t.Error("logged a key without a value")
+	}
+	if !strings.HasPrefix(buf.String(), `{"time":`) {
+		t.Errorf("line %q doesn't start with the time", buf.String())
+	}
+}
+
+func TestValidRequestId(t *testing.T) {
+	for _, tc := range []struct {
+		id    string
+		valid bool
+	}{
+		{"3fa85f64-5717-4562-b3fc-2c963f66afa6", true},
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"lb:1.2.3.4_req.42", true},
+		{strings.Repeat("a", 128), true},
+		{"", false},
+		{strings.Repeat("a", 129), false},
+		{"id with spaces", false},
+		{"id\nlevel=error", false},
+		{`"quoted"`, false},
+		{"비트코인", false},
+	} {
+		if got := validRequestId(tc.id); got != tc.valid {
+			t.Errorf("%q: valid %v, want %v", tc.id, got, tc.valid)
+		}
+	}
+}
+
+func TestLogRequestsRequestId(t *testing.T) {
+	captureLog(t)
+	var seen string
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestId(r.Context())
+	}))
+	for _, tc := range []struct {
+		header string
+		kept   bool
+	}{
+		{"3fa85f64-5717-4562-b3fc-2c963f66afa6", true},
+		{"", false},
+		{"bad id\r\n", false},
+	} {
+		req := httptest.NewRequest("GET", "/api/BTC/info", nil)
+		req.Header.Set(requestIdHeader, tc.header)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		echoed := w.Header().Get(requestIdHeader)
+		if echoed != seen || !validRequestId(echoed) {
+			t.Errorf("%q: echoed %q, handler saw %q", tc.header, echoed, seen)
+		}
+		if kept := echoed == tc.header; kept != tc.kept {
+			t.Errorf("%q: kept %v, want %v", tc.header, kept, tc.kept)
+		}
+	}
+}
@@ -2,28 +2,185 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robfig/cron"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("======Server Start======")
-	ctx:= context.TODO()
-	_ = initializeRedisLocalClient(ctx)
-	setSymbolId()
+	ctx, stop := signal.NotifyContext(context.Background(),syscall.SIGTERM,os.Interrupt)
+	defer stop()
+	serverLog.Info(ctx,"server starting","http","0.0.0.0:1928","grpc",cfg.Grpc.Port)
+	a := newApp(ctx,cfg)
+	if cfg.Auth.Enabled && cfg.Auth.AdminKey == "" {
+		serverLog.Warn(ctx,"auth enabled without an admin key, only keys already issued can call the API")
+	}
+
+	// Background jobs outlive the draining of the servers, so that the
+	// requests finishing meanwhile still get their usage and spans written.
+	jobs, stopJobs := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	run := func(job func(context.Context)) {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			job(jobs)
+		}()
+	}
+	// Loading the symbols takes a while; /readyz holds traffic off meanwhile.
+	go func() {
+		a.loadSymbols(ctx)
+		a.setSymbolId()
+	}()
+	// The unique indexes need the raw keys rehashed first.
+	go func() {
+		a.migrateSavedKeys(ctx)
+		a.ensureSavedIndexes(ctx)
+	}()
+	// Markets are decorated once the catalog is loaded.
+	go a.syncUpbitMarkets()
+	run(func(ctx context.Context) { hub.run(ctx,a.Redis) })
+	run(a.runUpbitIngestion)
+	run(a.runDatastoreProbe)
+	grpcServer := a.startGrpcServer()
+	if cfg.Usage.Enabled {
+		run(a.runUsageBatcher)
+	}
+	if cfg.Tracing.Enabled {
+		run(runSpanExporter)
+	}
 
 	c := cron.New()
 	err := c.AddFunc("@daily", func() {
-		fmt.Println("Start cron")
-		go setSymbolId()
+		syncLog.Info(ctx,"starting daily sync")
+		go a.setSymbolId()
+		go a.syncUpbitMarkets()
 	})
 	if err != nil {
-		fmt.Println("Error starting cron!")
+		syncLog.Error(ctx,"error scheduling daily sync","error",err)
+	}
+	if cfg.Portfolio.Schedule != "" {
+		err = c.AddFunc(cfg.Portfolio.Schedule, a.valuePortfolios)
+		if err != nil {
+			syncLog.Error(ctx,"error scheduling portfolio valuation","schedule",cfg.Portfolio.Schedule,"error",err)
+		}
 	}
 	c.Start()
+
+	srv := &http.Server{Addr: "0.0.0.0:1928", Handler: newRouter(a)}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			serverLog.Error(ctx,"error serving http","error",err)
+			stop()
+		}
+	}()
+	<-ctx.Done()
+
+	serverLog.Info(context.Background(),"shutting down")
+	timeout := time.Duration(cfg.Server.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(),timeout)
+	defer cancel()
+	c.Stop()
+	hub.close()
+	err = srv.Shutdown(shutdown)
+	if err != nil {
+		serverLog.Warn(shutdown,"error draining http requests","error",err)
+	}
+	if grpcServer != nil {
+		stopGrpcServer(shutdown,grpcServer)
+	}
+	stopJobs()
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-shutdown.Done():
+		serverLog.Warn(context.Background(),"background jobs still running at shutdown")
+	}
+	closing, cancelClose := context.WithTimeout(context.Background(),5*time.Second)
+	defer cancelClose()
+	a.Close(closing)
+	serverLog.Info(closing,"server stopped")
+}
+
+func newRouter(a *App) *mux.Router {
 	muxRouter := mux.NewRouter()
-	muxRouter.HandleFunc("/api/{symbol}/info",handler)
-	http.ListenAndServe("0.0.0.0:1928",muxRouter)
+	muxRouter.Use(logRequests)
+	muxRouter.Use(a.flagDegraded)
+	muxRouter.Use(traceRequests)
+	muxRouter.Use(instrument)
+	muxRouter.Use(meterUsage)
+	muxRouter.Use(a.shapeResponse)
+	muxRouter.Use(a.limitRequests)
+	muxRouter.Use(a.authenticate)
+	muxRouter.HandleFunc("/api/openapi.json",openapiHandler)
+	muxRouter.HandleFunc(healthzPath,healthzHandler)
+	muxRouter.HandleFunc(readyzPath,a.readyzHandler)
+	muxRouter.HandleFunc(statusPath,a.statusHandler)
+	if cfg.Metrics.Enabled {
+		muxRouter.Handle(metricsPath,promhttp.Handler())
+	}
+	v2 := muxRouter.PathPrefix("/api/v2").Subrouter()
+	v2.Use(v2Envelope)
+	v2.HandleFunc("/premium",a.premiumListHandler)
+	v2.HandleFunc("/admin/keys",a.adminKeyListHandler).Methods("GET")
+	v2.HandleFunc("/admin/keys",a.adminKeyCreateHandler).Methods("POST")
+	v2.HandleFunc("/admin/keys/{id}",a.adminKeyRevokeHandler).Methods("DELETE")
+	v2.HandleFunc("/admin/usage/report",a.usageReportHandler).Methods("GET")
+	v2.HandleFunc("/portfolio/value",a.portfolioValueHandler).Methods("POST")
+	v2.HandleFunc("/watchlists",a.watchlistListHandler).Methods("GET")
+	v2.HandleFunc("/watchlists/{name}",a.watchlistGetHandler).Methods("GET")
+	v2.HandleFunc("/watchlists/{name}",a.watchlistPutHandler).Methods("PUT")
+	v2.HandleFunc("/watchlists/{name}",a.watchlistDeleteHandler).Methods("DELETE")
+	v2.HandleFunc("/watchlists/{name}/prices",a.watchlistPricesHandler).Methods("GET")
+	v2.HandleFunc("/portfolios",a.portfolioListHandler).Methods("GET")
+	v2.HandleFunc("/portfolios/{name}",a.portfolioGetHandler).Methods("GET")
+	v2.HandleFunc("/portfolios/{name}",a.portfolioPutHandler).Methods("PUT")
+	v2.HandleFunc("/portfolios/{name}",a.portfolioDeleteHandler).Methods("DELETE")
+	v2.HandleFunc("/portfolios/{name}/value",a.portfolioSavedValueHandler).Methods("GET")
+	v2.HandleFunc("/portfolios/{name}/history",a.portfolioHistoryHandler).Methods("GET")
+	v2.HandleFunc("/quality/report",a.qualityReportHandler)
+	v2.HandleFunc("/{symbol}/info",a.handlerV2)
+	v2.HandleFunc("/{symbol}/details",a.detailsHandler)
+	v2.HandleFunc("/{symbol}/premium",a.premiumHandler)
+	v2.HandleFunc("/{symbol}/quote",a.quoteHandler)
+	muxRouter.HandleFunc("/api/stream",a.streamHandler)
+	muxRouter.HandleFunc("/api/ws",a.wsHandler)
+	muxRouter.HandleFunc("/api/premium",a.premiumListHandler)
+	muxRouter.HandleFunc("/api/admin/keys",a.adminKeyListHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/admin/keys",a.adminKeyCreateHandler).Methods("POST")
+	muxRouter.HandleFunc("/api/admin/keys/{id}",a.adminKeyRevokeHandler).Methods("DELETE")
+	muxRouter.HandleFunc("/api/admin/usage/report",a.usageReportHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/admin/usage/export",a.usageExportHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/portfolio/value",a.portfolioValueHandler).Methods("POST")
+	muxRouter.HandleFunc("/api/watchlists",a.watchlistListHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/watchlists/{name}",a.watchlistGetHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/watchlists/{name}",a.watchlistPutHandler).Methods("PUT")
+	muxRouter.HandleFunc("/api/watchlists/{name}",a.watchlistDeleteHandler).Methods("DELETE")
+	muxRouter.HandleFunc("/api/watchlists/{name}/prices",a.watchlistPricesHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/portfolios",a.portfolioListHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/portfolios/{name}",a.portfolioGetHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/portfolios/{name}",a.portfolioPutHandler).Methods("PUT")
+	muxRouter.HandleFunc("/api/portfolios/{name}",a.portfolioDeleteHandler).Methods("DELETE")
+	muxRouter.HandleFunc("/api/portfolios/{name}/value",a.portfolioSavedValueHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/portfolios/{name}/history",a.portfolioHistoryHandler).Methods("GET")
+	muxRouter.HandleFunc("/api/quality/report",a.qualityReportHandler)
+	muxRouter.HandleFunc("/api/{symbol}/info",a.handler)
+	muxRouter.HandleFunc("/api/{symbol}/details",a.detailsHandler)
+	muxRouter.HandleFunc("/api/{symbol}/premium",a.premiumHandler)
+	muxRouter.HandleFunc("/api/{symbol}/quote",a.quoteHandler)
+	return muxRouter
 }
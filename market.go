@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var catalog = &upbitCatalog{markets: make(map[string]UpbitMarket)}
+
+// MarketDoc is an Upbit market as stored in the upbit.market collection.
+type MarketDoc struct {
+	Market        string `bson:"market" json:"market"`
+	Quote         string `bson:"quote" json:"quote"`
+	Symbol        string `bson:"symbol" json:"symbol"`
+	KoreanName    string `bson:"korean_name" json:"koreanName"`
+	EnglishName   string `bson:"english_name" json:"englishName"`
+	MarketWarning string `bson:"market_warning" json:"marketWarning"`
+}
+
+// upbitCatalog keeps one market per base symbol, preferring the KRW market
+// since it carries the names our Korean app shows, and the market codes of
+// each quote currency.
+type upbitCatalog struct {
+	mu      sync.RWMutex
+	markets map[string]UpbitMarket
+	quotes  map[string][]string
+}
+
+func (c *upbitCatalog) load(docs []MarketDoc) {
+	markets := make(map[string]UpbitMarket)
+	quotes := make(map[string][]string)
+	for _, doc := range docs {
+		quotes[doc.Quote] = append(quotes[doc.Quote], doc.Market)
+		current, ok := markets[doc.Symbol]
+		if ok && strings.HasPrefix(current.Market, "KRW-") {
+			continue
+		}
+		markets[doc.Symbol] = UpbitMarket{doc.Market, doc.KoreanName, doc.EnglishName, doc.MarketWarning}
+	}
+	c.mu.Lock()
+	c.markets = markets
+	c.quotes = quotes
+	c.mu.Unlock()
+}
+
+// marketsOf returns the market codes of the quote currency, none until the
+// catalog is loaded.
+func (c *upbitCatalog) marketsOf(quote string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.quotes[quote]
+}
+
+func (c *upbitCatalog) get(symbol string) (UpbitMarket, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	market, ok := c.markets[symbol]
+	return market, ok
+}
+
+// syncUpbitMarkets replaces each region's markets in mongo with the current
+// /v1/market/all listing. A region that fails to load keeps its old markets.
+// The listing is built in a staging collection and swapped in, so that the
+// catalog is never read half loaded. The whole sync gives up after
+// upbitSyncTimeout, so that an unreachable mongo or Upbit doesn't hold it.
+func (a *App) syncUpbitMarkets() {
+	ctx, cancel := context.WithTimeout(context.Background(), upbitSyncTimeout)
+	defer cancel()
+	co := a.Mongo
+	collection := co.Database("upbit").Collection("market")
+	staging := co.Database("upbit").Collection("market_sync")
+	staging.Drop(ctx)
+	synced := 0
+	for _, region := range cfg.Upbit.Markets {
+		var docs []interface{}
+		markets, err := getUpbitMarkets(ctx, region, true)
+		if err != nil {
+			syncLog.Warn(ctx, "error getting Upbit markets", "quote", region.Quote, "error", err)
+		}
+		for _, market := range markets {
+			docs = append(docs, MarketDoc{
+				Market:        market.Market,
+				Quote:         region.Quote,
+				Symbol:        strings.TrimPrefix(market.Market, region.Quote+"-"),
+				KoreanName:    market.KoreanName,
+				EnglishName:   market.EnglishName,
+				MarketWarning: market.MarketWarning,
+			})
+		}
+		if len(docs) > 0 {
+			synced++
+		} else {
+			docs, err = keptMarkets(ctx, collection, region.Quote)
+			if err != nil {
+				syncLog.Error(ctx, "error keeping Upbit markets, not swapping", "quote", region.Quote, "error", err)
+				countError("mongo")
+				return
+			}
+		}
+		if len(docs) == 0 {
+			continue
+		}
+		_, err = staging.InsertMany(ctx, docs)
+		if err != nil {
+			syncLog.Error(ctx, "error inserting Upbit markets, not swapping", "quote", region.Quote, "error", err)
+			countError("mongo")
+			return
+		}
+	}
+	if synced == 0 {
+		loadUpbitCatalog(ctx, co)
+		return
+	}
+	err := co.Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: "upbit.market_sync"},
+		{Key: "to", Value: "upbit.market"},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		syncLog.Error(ctx, "error swapping in the Upbit markets", "error", err)
+		countError("mongo")
+	}
+	loadUpbitCatalog(ctx, co)
+}
+
+// keptMarkets returns the stored markets of a region, to carry them over a
+// sync that failed to list it.
+func keptMarkets(ctx context.Context, collection *mongo.Collection, quote string) ([]interface{}, error) {
+	cursor, err := collection.Find(ctx, bson.M{"quote": quote})
+	if err != nil {
+		return nil, err
+	}
+	var kept []MarketDoc
+	err = cursor.All(ctx, &kept)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]interface{}, 0, len(kept))
+	for _, doc := range kept {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+func loadUpbitCatalog(ctx context.Context, co *mongo.Client) {
+	cursor, err := co.Database("upbit").Collection("market").Find(ctx, bson.M{})
+	if err != nil {
+		storeLog.Warn(ctx, "error finding Upbit markets", "error", err)
+		return
+	}
+	var docs []MarketDoc
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		storeLog.Warn(ctx, "error decoding Upbit markets", "error", err)
+		return
+	}
+	catalog.load(docs)
+	syncLog.Info(ctx, "loaded Upbit markets", "markets", len(docs))
+}
+
+// preferUpbitListed picks, among the CoinGecko ids sharing a ticker, the one
+// whose name matches the asset Upbit lists under that ticker.
+func preferUpbitListed(symbol string, symbolIds []SymbolId) SymbolId {
+	market, ok := catalog.get(normalizeCode(symbol))
+	if ok && len(symbolIds) > 1 {
+		for _, symbolId := range symbolIds {
+			if strings.EqualFold(symbolId.Name, market.EnglishName) {
+				return symbolId
+			}
+		}
+	}
+	return symbolIds[0]
+}
+
+func decorateMarket(res []Data) {
+	for i := range res {
+		market, ok := catalog.get(res[i].Symbol)
+		if !ok {
+			continue
+		}
+		res[i].KoreanName = market.KoreanName
+		res[i].EnglishName = market.EnglishName
+		res[i].UpbitWarning = market.MarketWarning == "CAUTION"
+	}
+}
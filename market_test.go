@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// withCatalog loads docs into a catalog of its own for the test.
+func withCatalog(t *testing.T, docs []MarketDoc) {
+	saved := catalog
+	catalog = &upbitCatalog{markets: make(map[string]UpbitMarket)}
+	catalog.load(docs)
+	t.Cleanup(func() { catalog = saved })
+}
+
+var testMarketDocs = []MarketDoc{
+	{Market: "IDR-BTC", Quote: "IDR", Symbol: "BTC", KoreanName: "", EnglishName: "Bitcoin"},
+	{Market: "KRW-BTC", Quote: "KRW", Symbol: "BTC", KoreanName: "비트코인", EnglishName: "Bitcoin"},
+	{Market: "SGD-BTC", Quote: "SGD", Symbol: "BTC", EnglishName: "Bitcoin"},
+	{Market: "KRW-GAS", Quote: "KRW", Symbol: "GAS", KoreanName: "가스", EnglishName: "Gas", MarketWarning: "CAUTION"},
+	{Market: "THB-SOL", Quote: "THB", Symbol: "SOL", EnglishName: "Solana"},
+	{Market: "SGD-SOL", Quote: "SGD", Symbol: "SOL", EnglishName: "Solana"},
+}
+
+func TestCatalogLoad(t *testing.T) {
+	withCatalog(t, testMarketDocs)
+	for _, tc := range []struct {
+		symbol string
+		market string
+		ok     bool
+	}{
+		{"BTC", "KRW-BTC", true},
+		{"GAS", "KRW-GAS", true},
+		{"SOL", "SGD-SOL", true},
+		{"ETH", "", false},
+	} {
+		market, ok := catalog.get(tc.symbol)
+		if ok != tc.ok || market.Market != tc.market {
+			t.Errorf("%s: market %q %v, want %q %v", tc.symbol, market.Market, ok, tc.market, tc.ok)
+		}
+	}
+	if got, want := catalog.marketsOf("KRW"), []string{"KRW-BTC", "KRW-GAS"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("KRW markets %v, want %v", got, want)
+	}
+	if got := catalog.marketsOf("USD"); len(got) != 0 {
+		t.Errorf("USD markets %v, want none", got)
+	}
+}
+
+func TestPreferUpbitListed(t *testing.T) {
+	withCatalog(t, testMarketDocs)
+	gas := []SymbolId{
+		{Id: "gas-dao", Symbol: "gas", Name: "Gas DAO"},
+		{Id: "gas", Symbol: "gas", Name: "GAS"},
+	}
+	eth := []SymbolId{
+		{Id: "ethereum", Symbol: "eth", Name: "Ethereum"},
+		{Id: "eth-wrapped", Symbol: "eth", Name: "Wrapped Ether"},
+	}
+	for _, tc := range []struct {
+		name      string
+		symbol    string
+		symbolIds []SymbolId
+		want      string
+	}{
+		{"english name matches regardless of case", "gas", gas, "gas"},
+		{"not listed on Upbit", "ETH", eth, "ethereum"},
+		{"single id", "GAS", gas[:1], "gas-dao"},
+		{"no name matches", "BTC", eth, "ethereum"},
+	} {
+		if got := preferUpbitListed(tc.symbol, tc.symbolIds); got.Id != tc.want {
+			t.Errorf("%s: id %q, want %q", tc.name, got.Id, tc.want)
+		}
+	}
+}
+
+func TestDecorateMarket(t *testing.T) {
+	withCatalog(t, testMarketDocs)
+	res := []Data{{Symbol: "BTC"}, {Symbol: "GAS"}, {Symbol: "SOL"}, {Symbol: "ETH"}}
+	decorateMarket(res)
+	for i, want := range []Data{
+		{Symbol: "BTC", KoreanName: "비트코인", EnglishName: "Bitcoin"},
+		{Symbol: "GAS", KoreanName: "가스", EnglishName: "Gas", UpbitWarning: true},
+		{Symbol: "SOL", EnglishName: "Solana"},
+		{Symbol: "ETH"},
+	} {
+		got := res[i]
+		if got.KoreanName != want.KoreanName || got.EnglishName != want.EnglishName || got.UpbitWarning != want.UpbitWarning {
+			t.Errorf("%s: names %q %q warning %v, want %q %q %v", want.Symbol,
+				got.KoreanName, got.EnglishName, got.UpbitWarning, want.KoreanName, want.EnglishName, want.UpbitWarning)
+		}
+	}
+}
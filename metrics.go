@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const (
+	metricsPath string = "/metrics"
+	// providerTimeout bounds a whole provider call, body included, so that a
+	// hanging upstream can't hold a request or a sync.
+	providerTimeout = 10 * time.Second
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_http_requests_total",
+		Help: "HTTP requests served, by route template, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upbit_http_request_duration_seconds",
+		Help:    "Latency of the HTTP requests served, streams excluded.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route", "status"})
+	cacheResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_cache_requests_total",
+		Help: "Redis cache lookups, by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+	infoModes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_info_source_mode_total",
+		Help: "Uncached /info answers by the providers they were built from (BMG: Coinbase, CoinMarketCap and CoinGecko).",
+	}, []string{"mode"})
+	providerCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_provider_requests_total",
+		Help: "Calls to upstream providers, by provider and HTTP status, or error when none came back.",
+	}, []string{"provider", "code"})
+	providerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upbit_provider_request_duration_seconds",
+		Help:    "Latency of the calls to upstream providers.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"})
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_errors_total",
+		Help: "Errors by category: provider, redis, mongo, decode, client (4xx answers) and server (5xx answers).",
+	}, []string{"category"})
+	symbolSyncLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upbit_symbol_sync_last_success_timestamp_seconds",
+		Help: "Time the CoinGecko symbol list was last synced to Mongo.",
+	})
+	symbolSyncDocuments = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upbit_symbol_sync_documents",
+		Help: "Symbols written by the last successful symbol sync.",
+	})
+	symbolSyncDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upbit_symbol_sync_duration_seconds",
+		Help: "Duration of the last successful symbol sync.",
+	})
+	datastoreDown = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upbit_datastore_down",
+		Help: "1 while redis or mongo is unreachable and its in-process fallback answers instead.",
+	}, []string{"datastore"})
+	redisConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upbit_redis_connections_open",
+		Help: "Redis connections currently open, across all clients.",
+	})
+	redisDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_redis_dials_total",
+		Help: "Redis connections dialed, by result.",
+	}, []string{"result"})
+	mongoConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upbit_mongo_connections_open",
+		Help: "Mongo connections currently open, across all clients.",
+	})
+	mongoConnectionsInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upbit_mongo_connections_in_use",
+		Help: "Mongo connections currently checked out of the pools.",
+	})
+	mongoPoolEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upbit_mongo_pool_events_total",
+		Help: "Mongo connection pool events, by type.",
+	}, []string{"type"})
+)
+
+// instrument counts every request and times the ones that aren't streams.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		streaming := isStreaming(r)
+		if streaming {
+			next.ServeHTTP(w, r)
+		} else {
+			next.ServeHTTP(sw, r)
+		}
+		status := strconv.Itoa(sw.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		if !streaming {
+			httpDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+		}
+		switch {
+		case sw.status >= 500:
+			errorsTotal.WithLabelValues("server").Inc()
+		case sw.status >= 400:
+			errorsTotal.WithLabelValues("client").Inc()
+		}
+	})
+}
+
+// providerClient returns an HTTP client whose calls are counted, timed and
+// traced under provider, and that gives up after providerTimeout.
+func providerClient(provider string) *http.Client {
+	return &http.Client{
+		Transport: providerTransport{provider: provider, next: http.DefaultTransport},
+		Timeout:   providerTimeout,
+	}
+}
+
+type providerTransport struct {
+	provider string
+	next     http.RoundTripper
+}
+
+func (t providerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, span := startChildSpan(req.Context(), req.Method+" "+t.provider, spanClient,
+		"provider", t.provider,
+		"http.method", req.Method,
+		"http.url", req.URL.String())
+	defer span.Finish()
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	providerDuration.WithLabelValues(t.provider).Observe(time.Since(start).Seconds())
+	if err != nil {
+		providerCalls.WithLabelValues(t.provider, "error").Inc()
+		errorsTotal.WithLabelValues("provider").Inc()
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttributes("http.status_code", resp.StatusCode)
+	providerCalls.WithLabelValues(t.provider, strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		errorsTotal.WithLabelValues("provider").Inc()
+	}
+	return resp, nil
+}
+
+func countCache(cache string, hit bool) {
+	cacheResults.WithLabelValues(cache, cacheOutcome(hit)).Inc()
+}
+
+func cacheOutcome(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+func countError(category string) {
+	errorsTotal.WithLabelValues(category).Inc()
+}
+
+// redisDialer dials like go-redis does, over TLS when tlsConfig is set, keeping
+// count of the open connections.
+func redisDialer(tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		netDialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 5 * time.Minute}
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			conn, err = (&tls.Dialer{NetDialer: netDialer, Config: tlsConfig}).DialContext(ctx, network, addr)
+		} else {
+			conn, err = netDialer.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			redisDials.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		redisDials.WithLabelValues("ok").Inc()
+		redisConnections.Inc()
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(redisConnections.Dec)
+	return c.Conn.Close()
+}
+
+var mongoPoolMonitor = &event.PoolMonitor{
+	Event: func(e *event.PoolEvent) {
+		mongoPoolEvents.WithLabelValues(e.Type).Inc()
+		switch e.Type {
+		case event.ConnectionCreated:
+			mongoConnections.Inc()
+		case event.ConnectionClosed:
+			mongoConnections.Dec()
+		case event.GetSucceeded:
+			mongoConnectionsInUse.Inc()
+		case event.ConnectionReturned:
+			mongoConnectionsInUse.Dec()
+		}
+	},
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentLabels(t *testing.T) {
+	srv := newTestServer(t, nil)
+	for _, tc := range []struct {
+		path, route, status string
+		key                 string
+	}{
+		{"/api/BTC/info", "/api/{symbol}/info", "200", testApiKey},
+		{"/api/BTC/info", "/api/{symbol}/info", "401", ""},
+		{"/api/v2/BTC/quote?side=buy&amount=0", "/api/v2/{symbol}/quote", "400", testApiKey},
+	} {
+		requests := httpRequests.WithLabelValues(tc.route, "GET", tc.status)
+		before := testutil.ToFloat64(requests)
+		req, _ := http.NewRequest("GET", srv.URL+tc.path, nil)
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := testutil.ToFloat64(requests) - before; got != 1 {
+			t.Errorf("%s: counted %v requests as %s %s, want 1", tc.path, got, tc.route, tc.status)
+		}
+	}
+}
+
+func TestProviderLabels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/broken":
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		url, code string
+		errors    float64
+	}{
+		{upstream.URL + "/ok", "200", 0},
+		{upstream.URL + "/limited", "429", 1},
+		{upstream.URL + "/broken", "502", 1},
+		{closed.URL, "error", 1},
+	} {
+		calls := providerCalls.WithLabelValues("test", tc.code)
+		before, errorsBefore := testutil.ToFloat64(calls), testutil.ToFloat64(errorsTotal.WithLabelValues("provider"))
+		resp, err := providerClient("test").Get(tc.url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if got := testutil.ToFloat64(calls) - before; got != 1 {
+			t.Errorf("%s: counted %v calls as %s, want 1", tc.url, got, tc.code)
+		}
+		if got := testutil.ToFloat64(errorsTotal.WithLabelValues("provider")) - errorsBefore; got != tc.errors {
+			t.Errorf("%s: counted %v provider errors, want %v", tc.url, got, tc.errors)
+		}
+	}
+}
+
+func TestProviderClientTimeout(t *testing.T) {
+	if timeout := providerClient("test").Timeout; timeout != providerTimeout || timeout <= 0 {
+		t.Errorf("timeout %v, want %v", timeout, providerTimeout)
+	}
+}
+
+func TestCountCacheLabels(t *testing.T) {
+	for _, hit := range []bool{true, false} {
+		results := cacheResults.WithLabelValues("test", cacheOutcome(hit))
+		before := testutil.ToFloat64(results)
+		countCache("test", hit)
+		if got := testutil.ToFloat64(results) - before; got != 1 {
+			t.Errorf("hit %v: counted %v, want 1", hit, got)
+		}
+	}
+	if cacheOutcome(true) != "hit" || cacheOutcome(false) != "miss" {
+		t.Errorf("outcomes %q %q", cacheOutcome(true), cacheOutcome(false))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type Holding struct {
+	Symbol   string  `bson:"symbol" json:"symbol"`
+	Quantity float64 `bson:"quantity" json:"quantity"`
+	// CostBasis is the total paid for the holding, in CostCurrency (USD by
+	// default).
+	CostBasis    *float64 `bson:"costBasis,omitempty" json:"costBasis,omitempty"`
+	CostCurrency string   `bson:"costCurrency,omitempty" json:"costCurrency,omitempty"`
+}
+
+type PortfolioRequest struct {
+	Holdings     []Holding `bson:"holdings" json:"holdings"`
+	CurrencyCode []string  `bson:"currencyCode" json:"currencyCode"`
+}
+
+type PositionValue struct {
+	Symbol        string             `json:"symbol"`
+	Quantity      float64            `json:"quantity"`
+	Price         map[string]float64 `json:"price"`
+	Value         map[string]float64 `json:"value"`
+	Allocation    float64            `json:"allocation"`
+	CostBasis     map[string]float64 `json:"costBasis,omitempty"`
+	UnrealizedPnl map[string]float64 `json:"unrealizedPnl,omitempty"`
+	// UnrealizedPnlPercent is the same in every currency.
+	UnrealizedPnlPercent *float64 `json:"unrealizedPnlPercent,omitempty"`
+}
+
+type PortfolioValue struct {
+	Positions     []PositionValue    `json:"positions"`
+	Total         map[string]float64 `json:"total"`
+	CostBasis     map[string]float64 `json:"costBasis"`
+	UnrealizedPnl map[string]float64 `json:"unrealizedPnl"`
+	Provider      string             `json:"provider"`
+	Timestamp     int64              `json:"timestamp"`
+}
+
+// portfolioValueHandler values holdings from a single Coinbase rates snapshot,
+// so every position and total is priced at the same moment.
+func (a *App) portfolioValueHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "can't read body")
+		return
+	}
+	var req PortfolioRequest
+	if json.Unmarshal(body, &req) != nil {
+		writeError(w, http.StatusBadRequest, "holdings are required")
+		return
+	}
+	err = normalizePortfolio(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	meterCodes(r, holdingSymbols(req.Holdings), req.CurrencyCode)
+	if !a.allowUpstream(w, r, 1) {
+		return
+	}
+	// How many units of every asset one USD buys.
+	rates, err := getCoinBaseRates(r.Context(), "USD")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error getting exchange rates")
+		return
+	}
+	code, msg := checkPortfolio(req, rates)
+	if code != 0 {
+		writeError(w, code, msg)
+		return
+	}
+	writeJSON(w, valuePortfolio(req.Holdings, req.CurrencyCode, rates))
+}
+
+// normalizePortfolio upper-cases the codes of a portfolio and fills in the
+// default currencies.
+func normalizePortfolio(req *PortfolioRequest) error {
+	if len(req.Holdings) == 0 {
+		return errors.New("holdings are required")
+	}
+	currencyCode := make([]string, 0, len(req.CurrencyCode))
+	for _, code := range req.CurrencyCode {
+		currencyCode = append(currencyCode, normalizeCode(code))
+	}
+	if len(currencyCode) == 0 {
+		currencyCode = currencyCodeDefault
+	}
+	req.CurrencyCode = currencyCode
+	for i, holding := range req.Holdings {
+		if holding.Quantity < 0 {
+			return errors.New("quantity of " + holding.Symbol + " can't be negative")
+		}
+		req.Holdings[i].Symbol = normalizeCode(holding.Symbol)
+		req.Holdings[i].CostCurrency = normalizeCode(holding.CostCurrency)
+		if req.Holdings[i].CostCurrency == "" {
+			req.Holdings[i].CostCurrency = "USD"
+		}
+	}
+	return nil
+}
+
+// checkPortfolio returns the HTTP status and message of the first code of the
+// portfolio missing from rates, or 0.
+func checkPortfolio(req PortfolioRequest, rates map[string]float64) (int, string) {
+	for _, code := range req.CurrencyCode {
+		if rates[code] == 0 {
+			return http.StatusBadRequest, "Invalid currency " + code
+		}
+	}
+	for _, holding := range req.Holdings {
+		if rates[holding.Symbol] == 0 {
+			return http.StatusNotFound, "cryptocurrency " + holding.Symbol + " doesn't exist"
+		}
+		if holding.CostBasis != nil && rates[holding.CostCurrency] == 0 {
+			return http.StatusBadRequest, "Invalid currency " + holding.CostCurrency
+		}
+	}
+	return 0, ""
+}
+
+func valuePortfolio(holdings []Holding, currencyCode []string, rates map[string]float64) PortfolioValue {
+	res := PortfolioValue{
+		Positions:     make([]PositionValue, 0, len(holdings)),
+		Total:         make(map[string]float64),
+		CostBasis:     make(map[string]float64),
+		UnrealizedPnl: make(map[string]float64),
+		Provider:      "coinbase",
+		Timestamp:     time.Now().Unix(),
+	}
+	var totalUsd float64
+	for _, holding := range holdings {
+		position := PositionValue{
+			Symbol:   holding.Symbol,
+			Quantity: holding.Quantity,
+			Price:    make(map[string]float64),
+			Value:    make(map[string]float64),
+		}
+		usdPrice := 1 / rates[holding.Symbol]
+		for _, code := range currencyCode {
+			position.Price[code] = usdPrice * rates[code]
+			position.Value[code] = holding.Quantity * position.Price[code]
+			res.Total[code] += position.Value[code]
+		}
+		if holding.CostBasis != nil {
+			position.CostBasis = make(map[string]float64)
+			position.UnrealizedPnl = make(map[string]float64)
+			for _, code := range currencyCode {
+				cost := *holding.CostBasis / rates[holding.CostCurrency] * rates[code]
+				position.CostBasis[code] = cost
+				position.UnrealizedPnl[code] = position.Value[code] - cost
+				res.CostBasis[code] += cost
+				res.UnrealizedPnl[code] += position.Value[code] - cost
+			}
+			if *holding.CostBasis != 0 {
+				percent := (holding.Quantity*usdPrice/(*holding.CostBasis/rates[holding.CostCurrency]) - 1) * 100
+				position.UnrealizedPnlPercent = &percent
+			}
+		}
+		totalUsd += holding.Quantity * usdPrice
+		res.Positions = append(res.Positions, position)
+	}
+	if totalUsd > 0 {
+		for i, holding := range holdings {
+			res.Positions[i].Allocation = holding.Quantity / rates[holding.Symbol] / totalUsd * 100
+		}
+	}
+	return res
+}
+
+func holdingSymbols(holdings []Holding) []string {
+	symbols := make([]string, 0, len(holdings))
+	for _, holding := range holdings {
+		symbols = append(symbols, holding.Symbol)
+	}
+	return symbols
+}
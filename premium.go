@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	regionTickersKeyPrefix string = "tickers:"
+	regionTickersTTL              = 5 * time.Second
+)
+
+// Premium compares one Upbit market against the global USD price converted
+// at the Coinbase FX rate for the market's quote currency.
+type Premium struct {
+	Market       string  `json:"market"`
+	Symbol       string  `json:"symbol"`
+	CurrencyCode string  `json:"currencyCode"`
+	UpbitPrice   float64 `json:"upbitPrice"`
+	GlobalPrice  float64 `json:"globalPrice"`
+	FxRate       float64 `json:"fxRate"`
+	Premium      float64 `json:"premium"`
+}
+
+type PremiumResult struct {
+	Symbol         string    `json:"symbol"`
+	GlobalUsdPrice float64   `json:"globalUsdPrice"`
+	GlobalProvider string    `json:"globalProvider"`
+	Markets        []Premium `json:"markets"`
+}
+
+func (a *App) premiumHandler(w http.ResponseWriter, r *http.Request) {
+	symbol := normalizeCode(mux.Vars(r)["symbol"])
+	ctx := r.Context()
+	rds := a.Redis
+	if !a.allowUpstream(w, r, 1) {
+		return
+	}
+
+	rates, err := getCoinBaseRates(ctx, "USD")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error getting exchange rates")
+		return
+	}
+	result := PremiumResult{Symbol: symbol, GlobalProvider: "coinbase"}
+	if rates[symbol] > 0 {
+		result.GlobalUsdPrice = 1 / rates[symbol]
+	} else {
+		result.GlobalUsdPrice, err = a.getCoinGeckoUsdPrice(ctx, symbol)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "cryptocurrency "+symbol+" doesn't exist")
+			return
+		}
+		result.GlobalProvider = "coingecko"
+	}
+	for _, region := range cfg.Upbit.Markets {
+		ticker, ok := getUpbitTicker(ctx, rds, symbol, region.Quote)
+		if !ok {
+			tickers, err := getUpbitRestTickers(ctx, region, []string{region.Quote + "-" + symbol})
+			if err != nil || len(tickers) == 0 {
+				continue
+			}
+			ticker = tickers[0]
+		}
+		premium, ok := newPremium(region.Quote, symbol, ticker.TradePrice, result.GlobalUsdPrice, rates)
+		if ok {
+			result.Markets = append(result.Markets, premium)
+		}
+	}
+	if len(result.Markets) == 0 {
+		writeError(w, http.StatusNotFound, "cryptocurrency "+symbol+" isn't listed on Upbit")
+		return
+	}
+	writeJSON(w, result)
+}
+
+// premiumListHandler ranks every market of one Upbit region by premium,
+// highest first. The region defaults to KRW.
+func (a *App) premiumListHandler(w http.ResponseWriter, r *http.Request) {
+	quote := normalizeCode(r.URL.Query().Get("currency"))
+	if quote == "" {
+		quote = "KRW"
+	}
+	var region UpbitRegion
+	for _, m := range cfg.Upbit.Markets {
+		if m.Quote == quote {
+			region = m
+		}
+	}
+	if region.Quote == "" {
+		writeError(w, http.StatusBadRequest, "No Upbit market for currency "+quote)
+		return
+	}
+	ctx := r.Context()
+	// Coinbase, and the Upbit tickers unless they are cached.
+	cached := a.cacheExists(ctx, regionTickersKeyPrefix+region.Quote)
+	meterCache(r, cached)
+	calls := 1
+	if !cached {
+		calls++
+	}
+	if !a.allowUpstream(w, r, calls) {
+		return
+	}
+
+	rates, err := getCoinBaseRates(ctx, "USD")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error getting exchange rates")
+		return
+	}
+	tickers, err := a.getRegionTickers(ctx, region)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error getting Upbit tickers")
+		return
+	}
+	res := make([]Premium, 0)
+	for _, ticker := range tickers {
+		symbol := strings.TrimPrefix(ticker.Market, quote+"-")
+		if rates[symbol] <= 0 {
+			continue
+		}
+		premium, ok := newPremium(quote, symbol, ticker.TradePrice, 1/rates[symbol], rates)
+		if ok {
+			res = append(res, premium)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Premium > res[j].Premium
+	})
+	writeJSON(w, res)
+}
+
+func newPremium(quote string, symbol string, upbitPrice float64, usdPrice float64, rates map[string]float64) (Premium, bool) {
+	fx := rates[quote]
+	if fx <= 0 || usdPrice <= 0 || upbitPrice <= 0 {
+		return Premium{}, false
+	}
+	globalPrice := usdPrice * fx
+	return Premium{
+		Market:       quote + "-" + symbol,
+		Symbol:       symbol,
+		CurrencyCode: quote,
+		UpbitPrice:   upbitPrice,
+		GlobalPrice:  globalPrice,
+		FxRate:       fx,
+		Premium:      (upbitPrice/globalPrice - 1) * 100,
+	}, true
+}
+
+// getRegionTickers returns a ticker for every market of the region, taking
+// the markets from the catalog and fresh tickers from the price book. The
+// rest are fetched over REST in one batch, cached for regionTickersTTL.
+func (a *App) getRegionTickers(ctx context.Context, region UpbitRegion) ([]UpbitTicker, error) {
+	key := regionTickersKeyPrefix + region.Quote
+	res, hit := a.cacheGet(ctx, key)
+	countCache("tickers", hit)
+	var tickers []UpbitTicker
+	if hit && json.Unmarshal([]byte(res), &tickers) == nil {
+		return tickers, nil
+	}
+
+	markets := catalog.marketsOf(region.Quote)
+	if len(markets) == 0 {
+		listed, err := getUpbitMarkets(ctx, region, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, market := range listed {
+			markets = append(markets, market.Market)
+		}
+	}
+	var missing []string
+	for _, market := range markets {
+		symbol := strings.TrimPrefix(market, region.Quote+"-")
+		ticker, ok := getUpbitTicker(ctx, a.Redis, symbol, region.Quote)
+		if ok {
+			ticker.Market = market
+			tickers = append(tickers, ticker)
+		} else {
+			missing = append(missing, market)
+		}
+	}
+	if len(missing) > 0 {
+		fetched, err := getUpbitRestTickers(ctx, region, missing)
+		if err != nil {
+			return nil, err
+		}
+		tickers = append(tickers, fetched...)
+	}
+	cached, _ := json.Marshal(tickers)
+	a.cacheSet(ctx, key, cached, regionTickersTTL)
+	return tickers, nil
+}
+
+func getUpbitRestTickers(ctx context.Context, region UpbitRegion, markets []string) ([]UpbitTicker, error) {
+	q := url.Values{}
+	q.Add("markets", strings.Join(markets, ","))
+	req, err := http.NewRequestWithContext(ctx, "GET", region.Rest+"/v1/ticker?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := providerClient("upbit").Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Upbit ticker status " + resp.Status)
+	}
+	var tickers []UpbitTicker
+	err = json.Unmarshal(respBody, &tickers)
+	if err != nil {
+		return nil, err
+	}
+	return tickers, nil
+}
+
+// getCoinBaseRates returns how many units of every currency and crypto asset
+// one unit of base buys.
+func getCoinBaseRates(ctx context.Context, base string) (map[string]float64, error) {
+	q := url.Values{}
+	q.Add("currency", base)
+	req, err := http.NewRequestWithContext(ctx, "GET", coinBaseApi+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := providerClient("coinbase").Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if gjson.GetBytes(respBody, "errors").Exists() {
+		return nil, errors.New("Error getting CoinBase rates for " + base)
+	}
+	rates := make(map[string]float64)
+	gjson.GetBytes(respBody, "data.rates").ForEach(func(key, value gjson.Result) bool {
+		rates[key.String()] = value.Float()
+		return true
+	})
+	return rates, nil
+}
+
+func (a *App) getCoinGeckoUsdPrice(ctx context.Context, symbol string) (float64, error) {
+	id := a.getSymbolId(ctx, symbol)
+	if id == "" {
+		return 0, errors.New("Unknown symbol " + symbol)
+	}
+	q := url.Values{}
+	q.Add("vs_currency", "usd")
+	q.Add("ids", id)
+	req, err := http.NewRequestWithContext(ctx, "GET", coinGeckoApi+"?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := providerClient("coingecko").Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	var coinGeckoMarket []CoinGeckoMarket
+	err = json.Unmarshal(respBody, &coinGeckoMarket)
+	if err != nil || len(coinGeckoMarket) == 0 {
+		return 0, errors.New("Error decoding coinGeckoMarket Info")
+	}
+	return coinGeckoMarket[0].CurrentPrice, nil
+}
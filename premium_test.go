@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewPremium(t *testing.T) {
+	rates := map[string]float64{"KRW": 1400, "SGD": 1.35}
+	for _, tc := range []struct {
+		name       string
+		quote      string
+		upbitPrice float64
+		usdPrice   float64
+		premium    float64
+		ok         bool
+	}{
+		{"kimchi premium", "KRW", 72100000, 50000, 3, true},
+		{"discount", "KRW", 67900000, 50000, -3, true},
+		{"at par", "SGD", 67500, 50000, 0, true},
+		{"no fx rate", "THB", 1800000, 50000, 0, false},
+		{"no global price", "KRW", 72100000, 0, 0, false},
+		{"no Upbit price", "KRW", 0, 50000, 0, false},
+	} {
+		got, ok := newPremium(tc.quote, "BTC", tc.upbitPrice, tc.usdPrice, rates)
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if ok && (math.Abs(got.Premium-tc.premium) > 1e-9 || got.Market != tc.quote+"-BTC" || got.GlobalPrice != tc.usdPrice*rates[tc.quote]) {
+			t.Errorf("%s: got %+v, want a premium of %v", tc.name, got, tc.premium)
+		}
+	}
+}
+
+// TestPremiumList ranks the catalog's KRW markets against the Coinbase
+// prices of the test upstream: BTC at 50000 USD, ETH at 2000 USD, 1400 KRW
+// to the dollar.
+func TestPremiumList(t *testing.T) {
+	var tickerCalls int32
+	upbit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/ticker" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&tickerCalls, 1)
+		w.Write([]byte(`[{"market":"KRW-BTC","trade_price":72100000},{"market":"KRW-ETH","trade_price":2716000}]`))
+	}))
+	defer upbit.Close()
+	srv := newTestServer(t, nil)
+	cfg.Upbit.Markets = []UpbitRegion{{Quote: "KRW", Rest: upbit.URL}}
+	withCatalog(t, []MarketDoc{
+		{Market: "KRW-BTC", Quote: "KRW", Symbol: "BTC"},
+		{Market: "KRW-ETH", Quote: "KRW", Symbol: "ETH"},
+	})
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/premium", nil)
+		req.Header.Set("X-API-Key", testApiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []Premium
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil || len(res) != 2 {
+			t.Fatalf("got %v, %v", res, err)
+		}
+		if res[0].Symbol != "BTC" || math.Abs(res[0].Premium-3) > 1e-9 || res[1].Symbol != "ETH" || math.Abs(res[1].Premium+3) > 1e-9 {
+			t.Errorf("unexpected ranking %+v", res)
+		}
+	}
+	if n := atomic.LoadInt32(&tickerCalls); n != 1 {
+		t.Errorf("fetched the tickers %d times, want once", n)
+	}
+}
@@ -0,0 +1,205 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package upbitpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// UpbitClient is the client API for Upbit service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UpbitClient interface {
+	GetInfo(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*DataList, error)
+	BatchGetInfo(ctx context.Context, in *BatchInfoRequest, opts ...grpc.CallOption) (*BatchInfoResponse, error)
+	// WatchPrices pushes every cache refresh of the watched symbols, after the
+	// events stored since last_event_id when it is set.
+	WatchPrices(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Upbit_WatchPricesClient, error)
+}
+
+type upbitClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUpbitClient(cc grpc.ClientConnInterface) UpbitClient {
+	return &upbitClient{cc}
+}
+
+func (c *upbitClient) GetInfo(ctx context.Context, in *InfoRequest, opts ...grpc.CallOption) (*DataList, error) {
+	out := new(DataList)
+	err := c.cc.Invoke(ctx, "/upbit.Upbit/GetInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upbitClient) BatchGetInfo(ctx context.Context, in *BatchInfoRequest, opts ...grpc.CallOption) (*BatchInfoResponse, error) {
+	out := new(BatchInfoResponse)
+	err := c.cc.Invoke(ctx, "/upbit.Upbit/BatchGetInfo", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *upbitClient) WatchPrices(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Upbit_WatchPricesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Upbit_ServiceDesc.Streams[0], "/upbit.Upbit/WatchPrices", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &upbitWatchPricesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Upbit_WatchPricesClient interface {
+	Recv() (*PriceEvent, error)
+	grpc.ClientStream
+}
+
+type upbitWatchPricesClient struct {
+	grpc.ClientStream
+}
+
+func (x *upbitWatchPricesClient) Recv() (*PriceEvent, error) {
+	m := new(PriceEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UpbitServer is the server API for Upbit service.
+// All implementations must embed UnimplementedUpbitServer
+// for forward compatibility
+type UpbitServer interface {
+	GetInfo(context.Context, *InfoRequest) (*DataList, error)
+	BatchGetInfo(context.Context, *BatchInfoRequest) (*BatchInfoResponse, error)
+	// WatchPrices pushes every cache refresh of the watched symbols, after the
+	// events stored since last_event_id when it is set.
+	WatchPrices(*WatchRequest, Upbit_WatchPricesServer) error
+	mustEmbedUnimplementedUpbitServer()
+}
+
+// UnimplementedUpbitServer must be embedded to have forward compatible implementations.
+type UnimplementedUpbitServer struct {
+}
+
+func (UnimplementedUpbitServer) GetInfo(context.Context, *InfoRequest) (*DataList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInfo not implemented")
+}
+func (UnimplementedUpbitServer) BatchGetInfo(context.Context, *BatchInfoRequest) (*BatchInfoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGetInfo not implemented")
+}
+func (UnimplementedUpbitServer) WatchPrices(*WatchRequest, Upbit_WatchPricesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPrices not implemented")
+}
+func (UnimplementedUpbitServer) mustEmbedUnimplementedUpbitServer() {}
+
+// UnsafeUpbitServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UpbitServer will
+// result in compilation errors.
+type UnsafeUpbitServer interface {
+	mustEmbedUnimplementedUpbitServer()
+}
+
+func RegisterUpbitServer(s grpc.ServiceRegistrar, srv UpbitServer) {
+	s.RegisterService(&Upbit_ServiceDesc, srv)
+}
+
+func _Upbit_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpbitServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/upbit.Upbit/GetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpbitServer).GetInfo(ctx, req.(*InfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upbit_BatchGetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UpbitServer).BatchGetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/upbit.Upbit/BatchGetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UpbitServer).BatchGetInfo(ctx, req.(*BatchInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Upbit_WatchPrices_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UpbitServer).WatchPrices(m, &upbitWatchPricesServer{stream})
+}
+
+type Upbit_WatchPricesServer interface {
+	Send(*PriceEvent) error
+	grpc.ServerStream
+}
+
+type upbitWatchPricesServer struct {
+	grpc.ServerStream
+}
+
+func (x *upbitWatchPricesServer) Send(m *PriceEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Upbit_ServiceDesc is the grpc.ServiceDesc for Upbit service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Upbit_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "upbit.Upbit",
+	HandlerType: (*UpbitServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetInfo",
+			Handler:    _Upbit_GetInfo_Handler,
+		},
+		{
+			MethodName: "BatchGetInfo",
+			Handler:    _Upbit_BatchGetInfo_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchPrices",
+			Handler:       _Upbit_WatchPrices_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/upbit.proto",
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	qualityKeyPrefix  string = "quality:"
+	coinGeckoTimeForm string = "2006-01-02 15:04:05.999999999 -0700 MST"
+)
+
+var qualityMetrics = []string{"priceSpread", "supplyDiff", "timestampSkew"}
+
+// QualityMetrics is the provider disagreement measured on the latest fetch
+// of a symbol. Spread and supply difference are in percent, skew in seconds.
+type QualityMetrics struct {
+	Symbol        string    `bson:"symbol" json:"symbol"`
+	PriceSpread   float64   `bson:"priceSpread" json:"priceSpread"`
+	SupplyDiff    float64   `bson:"supplyDiff" json:"supplyDiff"`
+	TimestampSkew float64   `bson:"timestampSkew" json:"timestampSkew"`
+	Providers     []string  `bson:"providers" json:"providers"`
+	UpdatedAt     time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+type QualityEvent struct {
+	Symbol      string    `bson:"symbol" json:"symbol"`
+	Metric      string    `bson:"metric" json:"metric"`
+	Value       float64   `bson:"value" json:"value"`
+	Threshold   float64   `bson:"threshold" json:"threshold"`
+	Consecutive int64     `bson:"consecutive" json:"consecutive"`
+	Time        time.Time `bson:"time" json:"time"`
+}
+
+func (m QualityMetrics) value(metric string) float64 {
+	switch metric {
+	case "priceSpread":
+		return m.PriceSpread
+	case "supplyDiff":
+		return m.SupplyDiff
+	}
+	return m.TimestampSkew
+}
+
+func qualityThreshold(metric string) float64 {
+	switch metric {
+	case "priceSpread":
+		return cfg.Quality.PriceSpread
+	case "supplyDiff":
+		return cfg.Quality.SupplyDiff
+	}
+	return cfg.Quality.TimestampSkew
+}
+
+// qualityConsecutive is the streak that raises an event; anything below one
+// would never be reached.
+func qualityConsecutive() int64 {
+	if cfg.Quality.Consecutive <= 0 {
+		return 1
+	}
+	return int64(cfg.Quality.Consecutive)
+}
+
+// measureQuality compares the providers quoting the symbol. Upbit is left out
+// of the price spread, since its local markets trade at a premium to the
+// global price. Supply and timestamps are compared on the CoinGecko market in
+// USD when it was fetched, else in the first currency in alphabetical order.
+func measureQuality(symbol string, sources map[string][]PriceSource, tokenInfo map[string]interface{}, tokenInfoMap map[string]map[string]interface{}) QualityMetrics {
+	metrics := QualityMetrics{Symbol: symbol, UpdatedAt: time.Now()}
+	providers := make(map[string]bool)
+	for _, currencySources := range sources {
+		if len(currencySources) < 2 {
+			continue
+		}
+		var prices []float64
+		low, high := math.Inf(1), math.Inf(-1)
+		for _, source := range currencySources {
+			providers[source.Provider] = true
+			if source.Provider == "upbit" {
+				continue
+			}
+			prices = append(prices, source.Price)
+			low = math.Min(low, source.Price)
+			high = math.Max(high, source.Price)
+		}
+		if len(prices) < 2 {
+			continue
+		}
+		metrics.PriceSpread = math.Max(metrics.PriceSpread, (high-low)/medianOf(prices)*100)
+	}
+	for provider := range providers {
+		metrics.Providers = append(metrics.Providers, provider)
+	}
+
+	cmcSupply, _ := tokenInfo["circulatingSupply"].(float64)
+	cmcUpdated, cmcErr := time.Parse(time.RFC3339, fmt.Sprint(tokenInfo["lastUpdatedTimestamp"]))
+	var codes []string
+	for code := range tokenInfoMap {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	if _, ok := tokenInfoMap["USD"]; ok {
+		codes = []string{"USD"}
+	}
+	if len(codes) > 0 {
+		info := tokenInfoMap[codes[0]]
+		geckoSupply, _ := info["circulatingSupply"].(float64)
+		if cmcSupply > 0 && geckoSupply > 0 {
+			metrics.SupplyDiff = math.Abs(cmcSupply-geckoSupply) / math.Max(cmcSupply, geckoSupply) * 100
+		}
+		geckoUpdated, err := time.Parse(coinGeckoTimeForm, fmt.Sprint(info["lastUpdatedTimestamp"]))
+		if cmcErr == nil && err == nil {
+			metrics.TimestampSkew = math.Abs(cmcUpdated.Sub(geckoUpdated).Seconds())
+		}
+	}
+	return metrics
+}
+
+// recordQuality stores the metrics of a fetch and counts, per metric, the
+// consecutive fetches above threshold. An event is raised once per streak,
+// when the count reaches the configured number of fetches.
+func (a *App) recordQuality(ctx context.Context, metrics QualityMetrics) {
+	co := a.Mongo
+	_, err := co.Database("quality").Collection("metrics").ReplaceOne(ctx,
+		bson.M{"symbol": metrics.Symbol}, metrics, options.Replace().SetUpsert(true))
+	if err != nil {
+		qualityLog.Warn(ctx, "error saving quality metrics", "symbol", metrics.Symbol, "error", err)
+	}
+
+	for _, metric := range qualityMetrics {
+		threshold := qualityThreshold(metric)
+		if threshold <= 0 {
+			continue
+		}
+		key := qualityKeyPrefix + metrics.Symbol + ":" + metric
+		if metrics.value(metric) <= threshold {
+			a.Redis.Del(ctx, key)
+			continue
+		}
+		count, err := a.Redis.Incr(ctx, key).Result()
+		if err != nil {
+			qualityLog.Warn(ctx, "error counting quality breach", "symbol", metrics.Symbol, "metric", metric, "error", err)
+			continue
+		}
+		a.Redis.Expire(ctx, key, 24*time.Hour)
+		if count != qualityConsecutive() {
+			continue
+		}
+		event := QualityEvent{metrics.Symbol, metric, metrics.value(metric), threshold, count, time.Now()}
+		_, err = co.Database("quality").Collection("events").InsertOne(ctx, event)
+		if err != nil {
+			qualityLog.Warn(ctx, "error inserting quality event", "symbol", metrics.Symbol, "metric", metric, "error", err)
+		}
+		notifyQuality(event)
+	}
+}
+
+func notifyQuality(event QualityEvent) {
+	if cfg.Quality.Webhook == "" {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.Quality.Webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		qualityLog.Warn(context.Background(), "error calling quality webhook", "symbol", event.Symbol, "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// qualityReportHandler lists the assets whose providers disagree the most
+// on one metric, with the latest events raised.
+func (a *App) qualityReportHandler(w http.ResponseWriter, r *http.Request) {
+	metric := r.URL.Query().Get("metric")
+	if metric == "" {
+		metric = "supplyDiff"
+	}
+	known := false
+	for _, m := range qualityMetrics {
+		known = known || m == metric
+	}
+	if !known {
+		writeError(w, http.StatusBadRequest, "Unknown metric "+metric)
+		return
+	}
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	ctx := r.Context()
+	co := a.Mongo
+
+	cursor, err := co.Database("quality").Collection("metrics").Find(ctx, bson.M{},
+		options.Find().SetSort(bson.M{metric: -1}).SetLimit(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading quality metrics")
+		return
+	}
+	assets := make([]QualityMetrics, 0)
+	err = cursor.All(ctx, &assets)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading quality metrics")
+		return
+	}
+	cursor, err = co.Database("quality").Collection("events").Find(ctx, bson.M{},
+		options.Find().SetSort(bson.M{"time": -1}).SetLimit(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading quality events")
+		return
+	}
+	events := make([]QualityEvent, 0)
+	err = cursor.All(ctx, &events)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading quality events")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"metric":    metric,
+		"threshold": qualityThreshold(metric),
+		"assets":    assets,
+		"events":    events,
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMeasureQuality(t *testing.T) {
+	sources := map[string][]PriceSource{
+		"KRW": {{"coinbase", 90000000, 0}, {"coingecko", 90900000, 0}, {"upbit", 95000000, 0}},
+		"USD": {{"coinbase", 65000, 0}, {"upbit", 64000, 0}},
+	}
+	tokenInfo := map[string]interface{}{"circulatingSupply": 100.0, "lastUpdatedTimestamp": "2024-01-01T00:00:00Z"}
+	tokenInfoMap := map[string]map[string]interface{}{
+		"KRW": {"circulatingSupply": 50.0, "lastUpdatedTimestamp": "2024-01-01 00:00:00 +0000 UTC"},
+		"USD": {"circulatingSupply": 90.0, "lastUpdatedTimestamp": "2024-01-01 00:01:00 +0000 UTC"},
+		"EUR": {"circulatingSupply": 10.0, "lastUpdatedTimestamp": "2024-01-01 00:02:00 +0000 UTC"},
+	}
+	for i := 0; i < 10; i++ {
+		m := measureQuality("BTC", sources, tokenInfo, tokenInfoMap)
+		if !near(m.PriceSpread, 0.9/90.45*100) {
+			t.Fatalf("priceSpread = %v, want the KRW spread without Upbit", m.PriceSpread)
+		}
+		if m.SupplyDiff != 10 || m.TimestampSkew != 60 {
+			t.Fatalf("supplyDiff, timestampSkew = %v, %v, want the USD market's 10, 60", m.SupplyDiff, m.TimestampSkew)
+		}
+	}
+
+	delete(tokenInfoMap, "USD")
+	m := measureQuality("BTC", sources, tokenInfo, tokenInfoMap)
+	if m.SupplyDiff != 90 || m.TimestampSkew != 120 {
+		t.Fatalf("supplyDiff, timestampSkew = %v, %v, want EUR's 90, 120", m.SupplyDiff, m.TimestampSkew)
+	}
+}
+
+func TestQualityConsecutive(t *testing.T) {
+	saved := cfg.Quality.Consecutive
+	defer func() { cfg.Quality.Consecutive = saved }()
+	for configured, want := range map[int]int64{-1: 1, 0: 1, 1: 1, 3: 3} {
+		cfg.Quality.Consecutive = configured
+		if got := qualityConsecutive(); got != want {
+			t.Errorf("consecutive %d: got %d, want %d", configured, got, want)
+		}
+	}
+}
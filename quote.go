@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	orderbookKeyPrefix string = "orderbook:"
+	orderbookTTL              = 2 * time.Second
+)
+
+var depthPercents = []float64{1, 2, 5}
+
+type OrderbookUnit struct {
+	AskPrice float64 `json:"ask_price"`
+	BidPrice float64 `json:"bid_price"`
+	AskSize  float64 `json:"ask_size"`
+	BidSize  float64 `json:"bid_size"`
+}
+
+type Orderbook struct {
+	Market         string          `json:"market"`
+	Timestamp      int64           `json:"timestamp"`
+	OrderbookUnits []OrderbookUnit `json:"orderbook_units"`
+}
+
+type Depth struct {
+	Percent     float64 `json:"percent"`
+	BidSize     float64 `json:"bidSize"`
+	BidNotional float64 `json:"bidNotional"`
+	AskSize     float64 `json:"askSize"`
+	AskNotional float64 `json:"askNotional"`
+}
+
+type Quote struct {
+	Market       string  `json:"market"`
+	Side         string  `json:"side"`
+	Amount       float64 `json:"amount"`
+	Filled       float64 `json:"filled"`
+	Unfilled     float64 `json:"unfilled"`
+	Notional     float64 `json:"notional"`
+	AveragePrice float64 `json:"averagePrice"`
+	WorstPrice   float64 `json:"worstPrice"`
+	MidPrice     float64 `json:"midPrice"`
+	Slippage     float64 `json:"slippage"`
+	Depth        []Depth `json:"depth"`
+	Timestamp    int64   `json:"timestamp"`
+}
+
+// quoteHandler estimates the execution of a market order of amount units of
+// symbol by walking the Upbit orderbook. Slippage and depth are in percent
+// of the mid price.
+func (a *App) quoteHandler(w http.ResponseWriter, r *http.Request) {
+	symbol := normalizeCode(mux.Vars(r)["symbol"])
+	side := strings.ToLower(r.URL.Query().Get("side"))
+	if side != "buy" && side != "sell" {
+		writeError(w, http.StatusBadRequest, "side must be buy or sell")
+		return
+	}
+	amount, err := strconv.ParseFloat(r.URL.Query().Get("amount"), 64)
+	if err != nil || amount <= 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		writeError(w, http.StatusBadRequest, "amount must be a positive number")
+		return
+	}
+	currency := normalizeCode(r.URL.Query().Get("currency"))
+	if currency == "" {
+		currency = "KRW"
+	}
+	var region UpbitRegion
+	for _, m := range cfg.Upbit.Markets {
+		if m.Quote == currency {
+			region = m
+		}
+	}
+	if region.Quote == "" {
+		writeError(w, http.StatusBadRequest, "No Upbit market for currency "+currency)
+		return
+	}
+
+	ctx := r.Context()
+	cached := a.cacheExists(ctx, orderbookKeyPrefix+currency+"-"+symbol)
+	meterCache(r, cached)
+	if !cached && !a.allowUpstream(w, r, 1) {
+		return
+	}
+	book, err := a.getOrderbook(ctx, region, currency+"-"+symbol)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "No orderbook for "+currency+"-"+symbol)
+		return
+	}
+	writeJSON(w, walkOrderbook(book, side, amount))
+}
+
+func walkOrderbook(book Orderbook, side string, amount float64) Quote {
+	quote := Quote{Market: book.Market, Side: side, Amount: amount, Timestamp: book.Timestamp}
+	if len(book.OrderbookUnits) == 0 {
+		quote.Unfilled = amount
+		return quote
+	}
+	// A book with one side empty has its mid price at the other side.
+	best := book.OrderbookUnits[0]
+	switch {
+	case best.AskSize == 0:
+		quote.MidPrice = best.BidPrice
+	case best.BidSize == 0:
+		quote.MidPrice = best.AskPrice
+	default:
+		quote.MidPrice = (best.AskPrice + best.BidPrice) / 2
+	}
+
+	remaining := amount
+	for _, unit := range book.OrderbookUnits {
+		price, size := unit.AskPrice, unit.AskSize
+		if side == "sell" {
+			price, size = unit.BidPrice, unit.BidSize
+		}
+		if remaining <= 0 {
+			break
+		}
+		if size <= 0 {
+			continue
+		}
+		fill := math.Min(remaining, size)
+		quote.Filled += fill
+		quote.Notional += fill * price
+		quote.WorstPrice = price
+		remaining -= fill
+	}
+	quote.Unfilled = remaining
+	if quote.Filled > 0 {
+		quote.AveragePrice = quote.Notional / quote.Filled
+		quote.Slippage = math.Abs(quote.AveragePrice-quote.MidPrice) / quote.MidPrice * 100
+	}
+
+	for _, percent := range depthPercents {
+		depth := Depth{Percent: percent}
+		for _, unit := range book.OrderbookUnits {
+			if unit.BidPrice >= quote.MidPrice*(1-percent/100) {
+				depth.BidSize += unit.BidSize
+				depth.BidNotional += unit.BidSize * unit.BidPrice
+			}
+			if unit.AskPrice <= quote.MidPrice*(1+percent/100) {
+				depth.AskSize += unit.AskSize
+				depth.AskNotional += unit.AskSize * unit.AskPrice
+			}
+		}
+		quote.Depth = append(quote.Depth, depth)
+	}
+	return quote
+}
+
+// getOrderbook serves the orderbook from redis for orderbookTTL after each
+// fetch, so bursts of quotes don't hit Upbit's rate limit.
+func (a *App) getOrderbook(ctx context.Context, region UpbitRegion, market string) (Orderbook, error) {
+	var book Orderbook
+	res, hit := a.cacheGet(ctx, orderbookKeyPrefix+market)
+	countCache("orderbook", hit)
+	if hit && json.Unmarshal([]byte(res), &book) == nil {
+		return book, nil
+	}
+
+	q := url.Values{}
+	q.Add("markets", market)
+	req, err := http.NewRequestWithContext(ctx, "GET", region.Rest+"/v1/orderbook?"+q.Encode(), nil)
+	if err != nil {
+		return book, err
+	}
+	resp, err := providerClient("upbit").Do(req)
+	if err != nil {
+		return book, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return book, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return book, errors.New("Upbit orderbook status " + resp.Status)
+	}
+	var books []Orderbook
+	err = json.Unmarshal(respBody, &books)
+	if err != nil {
+		return book, err
+	}
+	if len(books) == 0 {
+		return book, errors.New("Empty orderbook for " + market)
+	}
+	book = books[0]
+	cached, _ := json.Marshal(book)
+	a.cacheSet(ctx, orderbookKeyPrefix+market, cached, orderbookTTL)
+	return book, nil
+}
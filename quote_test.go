@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestQuoteAmount(t *testing.T) {
+	srv := newTestServer(t, nil)
+	for _, amount := range []string{"", "0", "-1", "abc", "NaN", "Inf", "-Inf", "+Inf"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/api/BTC/quote?side=buy&amount="+amount, nil)
+		req.Header.Set("X-API-Key", testApiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("amount %q: status %d, want 400", amount, resp.StatusCode)
+		}
+	}
+}
+
+func TestWalkOrderbook(t *testing.T) {
+	book := Orderbook{Market: "KRW-BTC", OrderbookUnits: []OrderbookUnit{
+		{AskPrice: 101, BidPrice: 99, AskSize: 1, BidSize: 1},
+		{AskPrice: 102, BidPrice: 98, AskSize: 2, BidSize: 2},
+		{AskPrice: 104, BidPrice: 96, AskSize: 3, BidSize: 3},
+		{AskPrice: 110, BidPrice: 90, AskSize: 5, BidSize: 5},
+	}}
+	asksOnly := Orderbook{OrderbookUnits: []OrderbookUnit{
+		{AskPrice: 101, AskSize: 1},
+		{AskPrice: 102, AskSize: 2},
+	}}
+	for _, tc := range []struct {
+		name   string
+		book   Orderbook
+		side   string
+		amount float64
+		want   Quote
+	}{
+		{"buy full fill", book, "buy", 2, Quote{Filled: 2, Notional: 203, AveragePrice: 101.5, WorstPrice: 102, MidPrice: 100, Slippage: 1.5}},
+		{"sell full fill", book, "sell", 4, Quote{Filled: 4, Notional: 391, AveragePrice: 97.75, WorstPrice: 96, MidPrice: 100, Slippage: 2.25}},
+		{"buy partial fill", book, "buy", 20, Quote{Filled: 11, Unfilled: 9, Notional: 1167, AveragePrice: 1167.0 / 11, WorstPrice: 110, MidPrice: 100, Slippage: (1167.0/11 - 100)}},
+		{"sell into no bids", asksOnly, "sell", 1, Quote{Unfilled: 1, MidPrice: 101}},
+		{"buy against no bids", asksOnly, "buy", 1, Quote{Filled: 1, Notional: 101, AveragePrice: 101, WorstPrice: 101, MidPrice: 101}},
+		{"empty book", Orderbook{}, "buy", 1, Quote{Unfilled: 1}},
+	} {
+		got := walkOrderbook(tc.book, tc.side, tc.amount)
+		for _, field := range []struct {
+			name      string
+			got, want float64
+		}{
+			{"filled", got.Filled, tc.want.Filled},
+			{"unfilled", got.Unfilled, tc.want.Unfilled},
+			{"notional", got.Notional, tc.want.Notional},
+			{"averagePrice", got.AveragePrice, tc.want.AveragePrice},
+			{"worstPrice", got.WorstPrice, tc.want.WorstPrice},
+			{"midPrice", got.MidPrice, tc.want.MidPrice},
+			{"slippage", got.Slippage, tc.want.Slippage},
+		} {
+			if math.Abs(field.got-field.want) > 1e-9 {
+				t.Errorf("%s: %s = %v, want %v", tc.name, field.name, field.got, field.want)
+			}
+		}
+	}
+}
+
+func TestOrderbookDepth(t *testing.T) {
+	book := Orderbook{OrderbookUnits: []OrderbookUnit{
+		{AskPrice: 101, BidPrice: 99, AskSize: 1, BidSize: 1},
+		{AskPrice: 102, BidPrice: 98, AskSize: 2, BidSize: 2},
+		{AskPrice: 104, BidPrice: 96, AskSize: 3, BidSize: 3},
+		{AskPrice: 110, BidPrice: 90, AskSize: 5, BidSize: 5},
+	}}
+	want := []Depth{
+		{Percent: 1, BidSize: 1, BidNotional: 99, AskSize: 1, AskNotional: 101},
+		{Percent: 2, BidSize: 3, BidNotional: 295, AskSize: 3, AskNotional: 305},
+		{Percent: 5, BidSize: 6, BidNotional: 583, AskSize: 6, AskNotional: 617},
+	}
+	got := walkOrderbook(book, "buy", 1).Depth
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got depth %+v, want %+v", got, want)
+	}
+	if depth := walkOrderbook(Orderbook{}, "buy", 1).Depth; len(depth) != 0 {
+		t.Errorf("empty book has depth %+v", depth)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const ipLimitPrefix string = "iplimit:"
+
+type upstreamKey struct{}
+
+// RateLimitRule allows Requests per Window seconds; no requests means no
+// limit.
+type RateLimitRule struct {
+	Requests int `yaml:"requests"`
+	Window   int `yaml:"window"`
+}
+
+var trustedProxies = parseTrustedProxies(cfg.RateLimit.TrustedProxies)
+
+// slidingWindow records a request at now (ms) in the sorted set of the
+// window and refuses it when the window is full. It returns whether the
+// request is allowed and, if not, the milliseconds until the oldest request
+// leaves the window.
+var slidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], 0, now - window)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	return {0, tonumber(oldest[2]) + window - now}
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return {1, 0}
+`)
+
+// limitRequests limits the requests of each client IP over a sliding window
+// shared by every replica through Redis. Routes listed in the config have a
+// budget of their own, the others share the default one. Handlers about to
+// reach the upstream providers also spend the stricter upstream budget, see
+// allowUpstream.
+func (a *App) limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.RateLimit.Enabled || operationalPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		scope := "default"
+		rule := cfg.RateLimit.Default
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ := route.GetPathTemplate()
+			if routeRule, ok := cfg.RateLimit.Routes[template]; ok {
+				scope, rule = template, routeRule
+			}
+		}
+		ctx := r.Context()
+		allowed, retryAfter := a.allowRequest(ctx, ipLimitPrefix+scope+":"+ip, rule)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			writeErrorFor(w, r, http.StatusTooManyRequests, "Too many requests from "+ip)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, upstreamKey{}, ip)))
+	})
+}
+
+// allowUpstream spends a request of the client's upstream budget before a
+// handler makes calls to the providers, answering 429 when it is spent.
+func (a *App) allowUpstream(w http.ResponseWriter, r *http.Request, calls int) bool {
+	meter(r, func(event *UsageEvent) {
+		event.Cache = "miss"
+	})
+	ip, ok := r.Context().Value(upstreamKey{}).(string)
+	if !ok {
+		meterUpstream(r, calls)
+		return true
+	}
+	ctx := r.Context()
+	allowed, retryAfter := a.allowRequest(ctx, ipLimitPrefix+"upstream:"+ip, cfg.RateLimit.Upstream)
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusTooManyRequests, "Too many uncached requests from "+ip)
+		return false
+	}
+	meterUpstream(r, calls)
+	return true
+}
+
+// infoCached reports whether /info can answer symbol from the cache.
+func (a *App) infoCached(ctx context.Context, symbol string) bool {
+	return a.cacheExists(ctx, symbol)
+}
+
+// allowRequest returns whether key has room for a request under rule, and
+// the seconds to wait otherwise. While Redis is unreachable the replica
+// limits on its own, see localLimiter; other Redis errors let requests
+// through.
+func (a *App) allowRequest(ctx context.Context, key string, rule RateLimitRule) (bool, int) {
+	if rule.Requests <= 0 || rule.Window <= 0 {
+		return true, 0
+	}
+	if a.stores.isDown("redis") {
+		return a.limits.allow(key, rule, time.Now())
+	}
+	// The member only has to be unique across replicas, which the unseeded
+	// math/rand isn't.
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	member := strconv.FormatInt(now, 10) + "-" + hex.EncodeToString(nonce)
+	rds := a.Redis
+	res, err := slidingWindow.Run(ctx, rds, []string{key}, now, rule.Window*1000, rule.Requests, member).Result()
+	if err != nil {
+		cacheLog.Warn(ctx, "error checking rate limit", "key", key, "error", err)
+		if unreachable(ctx, err) {
+			countError("redis")
+			a.stores.markDown(ctx, "redis", err)
+			return a.limits.allow(key, rule, time.Now())
+		}
+		return true, 0
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 2 {
+		return true, 0
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, int((wait + 999) / 1000)
+}
+
+// clientIP is the remote address, or for requests relayed by trusted proxies
+// the last X-Forwarded-For address that isn't one of them.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTrustedProxies(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			serverLog.Error(context.Background(), "invalid trusted proxy", "cidr", cidr, "error", err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks := parseTrustedProxies([]string{"127.0.0.1", "172.17.0.0/16", "::1", "not-an-ip", "10.0.0.0/33"})
+	var got []string
+	for _, network := range networks {
+		got = append(got, network.String())
+	}
+	want := []string{"127.0.0.1/32", "172.17.0.0/16", "::1/128"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	trustedProxies = parseTrustedProxies([]string{"10.0.0.1", "172.17.0.0/16"})
+
+	for _, tc := range []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"spoofed by an untrusted peer", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:5000", "198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:5000", "198.51.100.1, 172.17.0.5", "198.51.100.1"},
+		{"spoofed hop before the proxies", "10.0.0.1:5000", "1.2.3.4, 198.51.100.1, 172.17.0.5", "198.51.100.1"},
+		{"trusted proxy without the header", "10.0.0.1:5000", "", "10.0.0.1"},
+		{"empty hops", "10.0.0.1:5000", "198.51.100.1, ,", "198.51.100.1"},
+		{"ipv6 peer", "[2001:db8::1]:5000", "198.51.100.1", "2001:db8::1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
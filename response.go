@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+func writeData(w http.ResponseWriter, res []Data) {
+	decorateMarket(res)
+	writeJSON(w, res)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	result, err := json.Marshal(v)
+	if err != nil {
+		serverLog.Error(context.Background(), "error encoding response", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// writeError answers with the errResult body, using its code as the HTTP
+// status as well.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	result, _ := json.Marshal(errResult{code, msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(result)
+}
+
+// errorRecorder stands in for the http.ResponseWriter the v1 /info code path
+// reports errResult bodies to, for callers that report errors their own way.
+type errorRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *errorRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *errorRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *errorRecorder) WriteHeader(int) {}
+
+func (r *errorRecorder) errResult() errResult {
+	result := errResult{400, "Api server error"}
+	json.NewDecoder(&r.body).Decode(&result)
+	return result
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Watchlists and portfolios are saved in the user database, keyed by the hash
+// of the client's API key and their name.
+
+const historyDateForm string = "2006-01-02"
+
+type Watchlist struct {
+	ApiKey    string    `bson:"apiKey" json:"-"`
+	Name      string    `bson:"name" json:"name"`
+	Symbols   []string  `bson:"symbols" json:"symbols"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+type Portfolio struct {
+	ApiKey           string `bson:"apiKey" json:"-"`
+	Name             string `bson:"name" json:"name"`
+	PortfolioRequest `bson:",inline"`
+	CreatedAt        time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt        time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// PortfolioHistory is the valuation of a portfolio on one day; the scheduled
+// valuation overwrites it until the day is over.
+type PortfolioHistory struct {
+	ApiKey        string             `bson:"apiKey" json:"-"`
+	Name          string             `bson:"name" json:"name"`
+	Date          string             `bson:"date" json:"date"`
+	Total         map[string]float64 `bson:"total" json:"total"`
+	CostBasis     map[string]float64 `bson:"costBasis" json:"costBasis"`
+	UnrealizedPnl map[string]float64 `bson:"unrealizedPnl" json:"unrealizedPnl"`
+	Time          time.Time          `bson:"time" json:"time"`
+}
+
+type SymbolPrice struct {
+	Symbol string             `json:"symbol"`
+	Price  map[string]float64 `json:"price"`
+}
+
+type WatchlistPrices struct {
+	Name      string        `json:"name"`
+	Prices    []SymbolPrice `json:"prices"`
+	Provider  string        `json:"provider"`
+	Timestamp int64         `json:"timestamp"`
+}
+
+// requestApiKey returns the API key of the request, from the X-API-Key header
+// or the api_key parameter.
+func requestApiKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	return key
+}
+
+// savedRequest returns the API key hash and the name of the route, answering
+// 401 when the request has no key.
+func savedRequest(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	key := requestApiKey(r)
+	if key == "" {
+		writeError(w, http.StatusUnauthorized, "API key required")
+		return "", "", false
+	}
+	return hashApiKey(key), mux.Vars(r)["name"], true
+}
+
+func (a *App) watchlistListHandler(w http.ResponseWriter, r *http.Request) {
+	key, _, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	co := a.Mongo
+	res := make([]Watchlist, 0)
+	if !findSaved(ctx, co.Database("user").Collection("watchlist"), bson.M{"apiKey": key}, &res) {
+		writeError(w, http.StatusInternalServerError, "Error reading watchlists")
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (a *App) watchlistGetHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	watchlist, ok := a.getWatchlist(w, r.Context(), key, name)
+	if !ok {
+		return
+	}
+	writeJSON(w, watchlist)
+}
+
+func (a *App) watchlistPutHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "can't read body")
+		return
+	}
+	var watchlist Watchlist
+	if json.Unmarshal(body, &watchlist) != nil || len(watchlist.Symbols) == 0 {
+		writeError(w, http.StatusBadRequest, "symbols are required")
+		return
+	}
+	seen := make(map[string]bool)
+	symbols := make([]string, 0, len(watchlist.Symbols))
+	for _, symbol := range watchlist.Symbols {
+		symbol = normalizeCode(symbol)
+		if symbol != "" && !seen[symbol] {
+			seen[symbol] = true
+			symbols = append(symbols, symbol)
+		}
+	}
+	ctx := r.Context()
+	co := a.Mongo
+	if !saveDoc(ctx, co.Database("user").Collection("watchlist"), key, name, bson.M{"symbols": symbols}, &watchlist) {
+		writeError(w, http.StatusInternalServerError, "Error saving watchlist")
+		return
+	}
+	writeJSON(w, watchlist)
+}
+
+func (a *App) watchlistDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	a.deleteSaved(w, r.Context(), "watchlist", key, name)
+}
+
+// watchlistPricesHandler prices every symbol of a watchlist from one Coinbase
+// rates snapshot. Symbols Coinbase doesn't know have a null price.
+func (a *App) watchlistPricesHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	watchlist, ok := a.getWatchlist(w, r.Context(), key, name)
+	if !ok {
+		return
+	}
+	currencyCode := splitParam(r.URL.Query().Get("currency"))
+	if len(currencyCode) == 0 {
+		currencyCode = currencyCodeDefault
+	}
+	meterCodes(r, watchlist.Symbols, currencyCode)
+	if !a.allowUpstream(w, r, 1) {
+		return
+	}
+	rates, err := getCoinBaseRates(r.Context(), "USD")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error getting exchange rates")
+		return
+	}
+	for _, code := range currencyCode {
+		if rates[code] == 0 {
+			writeError(w, http.StatusBadRequest, "Invalid currency "+code)
+			return
+		}
+	}
+	res := WatchlistPrices{Name: name, Prices: make([]SymbolPrice, 0, len(watchlist.Symbols)), Provider: "coinbase", Timestamp: time.Now().Unix()}
+	for _, symbol := range watchlist.Symbols {
+		price := SymbolPrice{Symbol: symbol}
+		if rates[symbol] != 0 {
+			price.Price = make(map[string]float64)
+			for _, code := range currencyCode {
+				price.Price[code] = rates[code] / rates[symbol]
+			}
+		}
+		res.Prices = append(res.Prices, price)
+	}
+	writeJSON(w, res)
+}
+
+func (a *App) portfolioListHandler(w http.ResponseWriter, r *http.Request) {
+	key, _, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	co := a.Mongo
+	res := make([]Portfolio, 0)
+	if !findSaved(ctx, co.Database("user").Collection("portfolio"), bson.M{"apiKey": key}, &res) {
+		writeError(w, http.StatusInternalServerError, "Error reading portfolios")
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (a *App) portfolioGetHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	portfolio, ok := a.getPortfolio(w, r.Context(), key, name)
+	if !ok {
+		return
+	}
+	writeJSON(w, portfolio)
+}
+
+func (a *App) portfolioPutHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "can't read body")
+		return
+	}
+	var req PortfolioRequest
+	if json.Unmarshal(body, &req) != nil {
+		writeError(w, http.StatusBadRequest, "holdings are required")
+		return
+	}
+	err = normalizePortfolio(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var portfolio Portfolio
+	ctx := r.Context()
+	co := a.Mongo
+	fields := bson.M{"holdings": req.Holdings, "currencyCode": req.CurrencyCode}
+	if !saveDoc(ctx, co.Database("user").Collection("portfolio"), key, name, fields, &portfolio) {
+		writeError(w, http.StatusInternalServerError, "Error saving portfolio")
+		return
+	}
+	writeJSON(w, portfolio)
+}
+
+// portfolioDeleteHandler deletes a portfolio along with its history.
+func (a *App) portfolioDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	if !a.deleteSaved(w, r.Context(), "portfolio", key, name) {
+		return
+	}
+	ctx := r.Context()
+	co := a.Mongo
+	_, err := co.Database("user").Collection("portfolio_history").DeleteMany(ctx, bson.M{"apiKey": key, "name": name})
+	if err != nil {
+		storeLog.Warn(ctx, "error deleting portfolio history", "portfolio", name, "error", err)
+	}
+}
+
+func (a *App) portfolioSavedValueHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	portfolio, ok := a.getPortfolio(w, r.Context(), key, name)
+	if !ok {
+		return
+	}
+	meterCodes(r, holdingSymbols(portfolio.Holdings), portfolio.CurrencyCode)
+	if !a.allowUpstream(w, r, 1) {
+		return
+	}
+	rates, err := getCoinBaseRates(r.Context(), "USD")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Error getting exchange rates")
+		return
+	}
+	code, msg := checkPortfolio(portfolio.PortfolioRequest, rates)
+	if code != 0 {
+		writeError(w, code, msg)
+		return
+	}
+	writeJSON(w, valuePortfolio(portfolio.Holdings, portfolio.CurrencyCode, rates))
+}
+
+// portfolioHistoryHandler lists the daily valuations of a portfolio, oldest
+// first, over the last ?days= days (30 by default).
+func (a *App) portfolioHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	key, name, ok := savedRequest(w, r)
+	if !ok {
+		return
+	}
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	ctx := r.Context()
+	if _, ok := a.getPortfolio(w, ctx, key, name); !ok {
+		return
+	}
+	co := a.Mongo
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format(historyDateForm)
+	filter := bson.M{"apiKey": key, "name": name, "date": bson.M{"$gte": since}}
+	res := make([]PortfolioHistory, 0)
+	cursor, err := co.Database("user").Collection("portfolio_history").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"date": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &res)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading portfolio history")
+		return
+	}
+	writeJSON(w, res)
+}
+
+// valuePortfolios records today's valuation of every saved portfolio, all
+// priced from the same rates snapshot.
+func (a *App) valuePortfolios() {
+	ctx := context.TODO()
+	rates, err := getCoinBaseRates(ctx, "USD")
+	if err != nil {
+		syncLog.Error(ctx, "error getting exchange rates for portfolios", "error", err)
+		return
+	}
+	co := a.Mongo
+	portfolios := make([]Portfolio, 0)
+	if !findSaved(ctx, co.Database("user").Collection("portfolio"), bson.M{}, &portfolios) {
+		syncLog.Error(ctx, "error reading portfolios")
+		return
+	}
+	now := time.Now().UTC()
+	collection := co.Database("user").Collection("portfolio_history")
+	for _, portfolio := range portfolios {
+		if code, _ := checkPortfolio(portfolio.PortfolioRequest, rates); code != 0 {
+			syncLog.Warn(ctx, "skipping portfolio with unknown codes", "portfolio", portfolio.Name)
+			continue
+		}
+		value := valuePortfolio(portfolio.Holdings, portfolio.CurrencyCode, rates)
+		history := PortfolioHistory{portfolio.ApiKey, portfolio.Name, now.Format(historyDateForm),
+			value.Total, value.CostBasis, value.UnrealizedPnl, now}
+		_, err := collection.ReplaceOne(ctx,
+			bson.M{"apiKey": history.ApiKey, "name": history.Name, "date": history.Date},
+			history, options.Replace().SetUpsert(true))
+		if err != nil {
+			syncLog.Warn(ctx, "error saving portfolio history", "portfolio", portfolio.Name, "error", err)
+		}
+	}
+}
+
+// migrateSavedKeys rehashes the documents saved before API keys were hashed,
+// which still hold the raw key. A document the key saved again since, under
+// its hash, wins over the raw one.
+func (a *App) migrateSavedKeys(ctx context.Context) {
+	co := a.Mongo
+	raw := bson.M{"apiKey": bson.M{"$not": primitive.Regex{Pattern: "^[0-9a-f]{64}$"}}}
+	for _, kind := range []string{"watchlist", "portfolio", "portfolio_history"} {
+		collection := co.Database("user").Collection(kind)
+		cursor, err := collection.Find(ctx, raw)
+		if err != nil {
+			storeLog.Warn(ctx, "error finding raw API keys", "collection", kind, "error", err)
+			continue
+		}
+		var docs []bson.M
+		err = cursor.All(ctx, &docs)
+		if err != nil {
+			storeLog.Warn(ctx, "error finding raw API keys", "collection", kind, "error", err)
+			continue
+		}
+		migrated := 0
+		for _, doc := range docs {
+			key, _ := doc["apiKey"].(string)
+			hashed := bson.M{"apiKey": hashApiKey(key), "name": doc["name"]}
+			if kind == "portfolio_history" {
+				hashed["date"] = doc["date"]
+			}
+			n, err := collection.CountDocuments(ctx, hashed)
+			if err == nil && n > 0 {
+				_, err = collection.DeleteOne(ctx, bson.M{"_id": doc["_id"]})
+			} else if err == nil {
+				_, err = collection.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": bson.M{"apiKey": hashed["apiKey"]}})
+			}
+			if err != nil {
+				storeLog.Warn(ctx, "error rehashing API key", "collection", kind, "name", doc["name"], "error", err)
+				continue
+			}
+			migrated++
+		}
+		if migrated > 0 {
+			storeLog.Info(ctx, "rehashed raw API keys", "collection", kind, "documents", migrated)
+		}
+	}
+}
+
+// ensureSavedIndexes keeps one document per key and name, and one history
+// point per portfolio and day.
+func (a *App) ensureSavedIndexes(ctx context.Context) {
+	co := a.Mongo
+	for kind, keys := range map[string]bson.D{
+		"watchlist":         {{Key: "apiKey", Value: 1}, {Key: "name", Value: 1}},
+		"portfolio":         {{Key: "apiKey", Value: 1}, {Key: "name", Value: 1}},
+		"portfolio_history": {{Key: "apiKey", Value: 1}, {Key: "name", Value: 1}, {Key: "date", Value: 1}},
+	} {
+		_, err := co.Database("user").Collection(kind).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    keys,
+			Options: options.Index().SetUnique(true),
+		})
+		if err != nil {
+			storeLog.Warn(ctx, "error creating saved index", "collection", kind, "error", err)
+		}
+	}
+}
+
+func (a *App) getWatchlist(w http.ResponseWriter, ctx context.Context, key string, name string) (Watchlist, bool) {
+	var watchlist Watchlist
+	ok := a.getSaved(w, ctx, "watchlist", key, name, &watchlist)
+	return watchlist, ok
+}
+
+func (a *App) getPortfolio(w http.ResponseWriter, ctx context.Context, key string, name string) (Portfolio, bool) {
+	var portfolio Portfolio
+	ok := a.getSaved(w, ctx, "portfolio", key, name, &portfolio)
+	return portfolio, ok
+}
+
+// getSaved decodes the named document of the key into v, answering 404 when
+// there is none.
+func (a *App) getSaved(w http.ResponseWriter, ctx context.Context, kind string, key string, name string, v interface{}) bool {
+	co := a.Mongo
+	err := co.Database("user").Collection(kind).FindOne(ctx, bson.M{"apiKey": key, "name": name}).Decode(v)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, kind+" "+name+" doesn't exist")
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading "+kind)
+		return false
+	}
+	return true
+}
+
+// saveDoc sets fields on the named document of the key, creating it if
+// needed, and decodes the saved document into v.
+func saveDoc(ctx context.Context, collection *mongo.Collection, key string, name string, fields bson.M, v interface{}) bool {
+	now := time.Now().UTC()
+	fields["updatedAt"] = now
+	update := bson.M{"$set": fields, "$setOnInsert": bson.M{"createdAt": now}}
+	err := collection.FindOneAndUpdate(ctx, bson.M{"apiKey": key, "name": name}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(v)
+	return err == nil
+}
+
+func findSaved(ctx context.Context, collection *mongo.Collection, filter bson.M, v interface{}) bool {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return false
+	}
+	return cursor.All(ctx, v) == nil
+}
+
+func (a *App) deleteSaved(w http.ResponseWriter, ctx context.Context, kind string, key string, name string) bool {
+	co := a.Mongo
+	res, err := co.Database("user").Collection(kind).DeleteOne(ctx, bson.M{"apiKey": key, "name": name})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error deleting "+kind)
+		return false
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, kind+" "+name+" doesn't exist")
+		return false
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
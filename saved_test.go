@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newMongoTestServer is newTestServer backed by the Mongo at
+// $UPBIT_TEST_MONGO_URI, whose user database it drops. Tests using it are
+// skipped without one. Auth is off, so any key header scopes the documents.
+func newMongoTestServer(t *testing.T) (*httptest.Server, *App) {
+	uri := os.Getenv("UPBIT_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("UPBIT_TEST_MONGO_URI not set")
+	}
+	app := newTestApp(t)
+	cfg.Mongo_Local.Uri = uri
+	cfg.Auth.Enabled = false
+	ctx := context.Background()
+	app.Mongo.Disconnect(ctx)
+	app.Mongo = initializeMongoLocalClient(ctx, cfg)
+	err := app.Mongo.Database("user").Drop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.ensureSavedIndexes(ctx)
+	srv := httptest.NewServer(newRouter(app))
+	t.Cleanup(srv.Close)
+	return srv, app
+}
+
+func savedCall(t *testing.T, srv *httptest.Server, key string, method string, path string, body string) (int, string) {
+	req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestV2EnvelopeNoContent(t *testing.T) {
+	h := v2Envelope(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/v2/watchlists/main", nil))
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("got %d %q, want an empty 204", w.Code, w.Body.String())
+	}
+}
+
+func TestWatchlistCRUD(t *testing.T) {
+	srv, _ := newMongoTestServer(t)
+	code, body := savedCall(t, srv, "key-a", "PUT", "/api/v2/watchlists/main", `{"symbols":["btc","eth","BTC"]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"symbols":["BTC","ETH"]`) {
+		t.Fatalf("put: %d %s", code, body)
+	}
+	code, body = savedCall(t, srv, "key-a", "PUT", "/api/v2/watchlists/main", `{"symbols":["xrp"]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"symbols":["XRP"]`) {
+		t.Fatalf("overwrite: %d %s", code, body)
+	}
+	code, body = savedCall(t, srv, "key-a", "GET", "/api/v2/watchlists", "")
+	if code != http.StatusOK || strings.Count(body, `"name":"main"`) != 1 {
+		t.Fatalf("list: %d %s, want the one watchlist", code, body)
+	}
+
+	// Another key sees none of it.
+	for _, call := range [][]string{{"GET", "/api/v2/watchlists/main"}, {"DELETE", "/api/v2/watchlists/main"}} {
+		if code, body := savedCall(t, srv, "key-b", call[0], call[1], ""); code != http.StatusNotFound {
+			t.Errorf("key-b %s: %d %s, want 404", call[0], code, body)
+		}
+	}
+	if code, body := savedCall(t, srv, "key-b", "GET", "/api/v2/watchlists", ""); !strings.Contains(body, `"data":[]`) {
+		t.Errorf("key-b list: %d %s, want empty", code, body)
+	}
+
+	if code, body := savedCall(t, srv, "key-a", "DELETE", "/api/v2/watchlists/main", ""); code != http.StatusNoContent || body != "" {
+		t.Fatalf("delete: %d %q, want an empty 204", code, body)
+	}
+	if code, _ := savedCall(t, srv, "key-a", "GET", "/api/v2/watchlists/main", ""); code != http.StatusNotFound {
+		t.Fatalf("get after delete: %d, want 404", code)
+	}
+}
+
+func TestPortfolioHistory(t *testing.T) {
+	srv, app := newMongoTestServer(t)
+	code, body := savedCall(t, srv, "key-a", "PUT", "/api/v2/portfolios/long", `{"holdings":[{"symbol":"BTC","quantity":2}],"currencyCode":["USD"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("put: %d %s", code, body)
+	}
+	// Valuing twice on one day keeps one point.
+	app.valuePortfolios()
+	app.valuePortfolios()
+	code, body = savedCall(t, srv, "key-a", "GET", "/api/v2/portfolios/long/history", "")
+	if code != http.StatusOK || strings.Count(body, `"date"`) != 1 || !strings.Contains(body, `"USD":100000`) {
+		t.Fatalf("history: %d %s, want today's valuation", code, body)
+	}
+	if code, _ := savedCall(t, srv, "key-b", "GET", "/api/v2/portfolios/long/history", ""); code != http.StatusNotFound {
+		t.Errorf("key-b history: %d, want 404", code)
+	}
+
+	if code, _ := savedCall(t, srv, "key-a", "DELETE", "/api/v2/portfolios/long", ""); code != http.StatusNoContent {
+		t.Fatalf("delete: %d, want 204", code)
+	}
+	n, err := app.Mongo.Database("user").Collection("portfolio_history").CountDocuments(context.Background(), map[string]string{"name": "long"})
+	if err != nil || n != 0 {
+		t.Fatalf("%d history points left: %v", n, err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/proto"
+)
+
+const historyEvents int64 = 100
+
+type blocksKey struct{}
+
+// responseBlocks collects the optional blocks a handler can offer for
+// ?include=, keyed by block name.
+type responseBlocks struct {
+	mu     sync.Mutex
+	blocks map[string]interface{}
+	proto  proto.Message
+}
+
+type jsonField struct {
+	Key   string
+	Value interface{}
+}
+
+// jsonObject is a decoded JSON object that keeps its key order, so shaped
+// responses list fields in the order the handler wrote them.
+type jsonObject []jsonField
+
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+type HistorySummary struct {
+	CurrencyCode string    `json:"currencyCode"`
+	Events       int       `json:"events"`
+	First        float64   `json:"first"`
+	Last         float64   `json:"last"`
+	Min          float64   `json:"min"`
+	Max          float64   `json:"max"`
+	Change       float64   `json:"change"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// setBlock offers value as the name block of the response; it is only sent
+// when the client asks for it with ?include=name.
+func setBlock(r *http.Request, name string, value interface{}) {
+	blocks, ok := r.Context().Value(blocksKey{}).(*responseBlocks)
+	if !ok {
+		return
+	}
+	blocks.mu.Lock()
+	blocks.blocks[name] = value
+	blocks.mu.Unlock()
+}
+
+// shapeResponse is the response layer shared by every route. ?fields=a,b.c
+// projects the JSON body (each element of a list body) down to the given
+// fields, dotted paths selecting inside nested objects and lists. ?include=
+// wraps the body as {"data": ...} next to the requested blocks: those set by
+// the handler (e.g. sources), plus history and metadata which are built here.
+// The result is then encoded in the negotiated format (see negotiateFormat).
+// The /api/v2 envelope is kept, with the blocks next to its data. Error
+// bodies and streaming requests are passed through untouched.
+func (a *App) shapeResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := splitFields(r.URL.Query().Get("fields"))
+		include := splitFields(r.URL.Query().Get("include"))
+		format := negotiateFormat(r)
+		if format == "" {
+			writeError(w, http.StatusBadRequest, "Unknown format "+r.URL.Query().Get("format"))
+			return
+		}
+		if (len(fields) == 0 && len(include) == 0 && format == formatJSON) || isStreaming(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		blocks := &responseBlocks{blocks: make(map[string]interface{})}
+		r = r.WithContext(context.WithValue(r.Context(), blocksKey{}, blocks))
+		bw := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+
+		data, err := decodeOrdered(bw.body.Bytes())
+		if err != nil || bw.status >= 400 || isErrResult(data) {
+			w.WriteHeader(bw.status)
+			w.Write(bw.body.Bytes())
+			return
+		}
+		v2 := isEnvelopeV2(data)
+		if v2 {
+			data, _ = data.(jsonObject).get("data")
+		}
+		var paths [][]string
+		for _, field := range fields {
+			paths = append(paths, strings.Split(field, "."))
+		}
+		if len(paths) > 0 {
+			data = project(data, paths)
+		}
+		body := data
+		if len(include) > 0 || v2 {
+			envelope := jsonObject{{"data", data}}
+			if v2 {
+				envelope = append(envelope, jsonField{"error", nil})
+			}
+			for _, name := range include {
+				switch name {
+				case "history":
+					envelope = append(envelope, jsonField{name, a.historySummary(r)})
+				case "metadata":
+					envelope = append(envelope, jsonField{name, map[string]interface{}{
+						"path":        r.URL.Path,
+						"generatedAt": time.Now().UTC(),
+						"latencyMs":   time.Since(start).Milliseconds(),
+					}})
+				default:
+					blocks.mu.Lock()
+					envelope = append(envelope, jsonField{name, blocks.blocks[name]})
+					blocks.mu.Unlock()
+				}
+			}
+			body = envelope
+		}
+		// CSV and Protobuf have no room for the included blocks.
+		if format == formatCSV || format == formatProtobuf {
+			body = data
+		}
+		blocks.mu.Lock()
+		m := blocks.proto
+		blocks.mu.Unlock()
+		result, err := encodeFormat(format, body, m, paths)
+		if err == errNotAcceptable {
+			writeError(w, http.StatusNotAcceptable, "Format "+format+" isn't available for this route")
+			return
+		}
+		if err != nil {
+			serverLog.Error(r.Context(), "error encoding shaped response", "format", format, "error", err)
+			w.WriteHeader(bw.status)
+			w.Write(bw.body.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", formatTypes[format])
+		w.WriteHeader(bw.status)
+		w.Write(result)
+	})
+}
+
+func project(v interface{}, paths [][]string) interface{} {
+	switch value := v.(type) {
+	case []interface{}:
+		res := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			res = append(res, project(item, paths))
+		}
+		return res
+	case jsonObject:
+		res := jsonObject{}
+		for _, field := range value {
+			var tails [][]string
+			whole := false
+			for _, path := range paths {
+				if path[0] != field.Key {
+					continue
+				}
+				if len(path) == 1 {
+					whole = true
+				} else {
+					tails = append(tails, path[1:])
+				}
+			}
+			if whole {
+				res = append(res, field)
+			} else if len(tails) > 0 {
+				res = append(res, jsonField{field.Key, project(field.Value, tails)})
+			}
+		}
+		return res
+	}
+	return v
+}
+
+// historySummary summarizes, per currency, the price events recorded for the
+// route's symbol.
+func (a *App) historySummary(r *http.Request) []HistorySummary {
+	res := make([]HistorySummary, 0)
+	symbol := normalizeCode(mux.Vars(r)["symbol"])
+	if symbol == "" {
+		return res
+	}
+	ctx := r.Context()
+	rds := a.Redis
+	msgs, err := rds.XRevRangeN(ctx, priceStreamPrefix+symbol, "+", "-", historyEvents).Result()
+	if err != nil {
+		cacheLog.Warn(ctx, "error reading price events", "symbol", symbol, "error", err)
+		return res
+	}
+	summaries := make(map[string]*HistorySummary)
+	var order []string
+	// XREVRANGE lists the newest event first.
+	for _, msg := range msgs {
+		payload, _ := msg.Values["data"].(string)
+		var data []Data
+		if json.Unmarshal([]byte(payload), &data) != nil {
+			continue
+		}
+		ms, _ := parseStreamId(msg.ID)
+		at := time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+		for _, d := range data {
+			summary, ok := summaries[d.CurrencyCode]
+			if !ok {
+				summary = &HistorySummary{CurrencyCode: d.CurrencyCode, Last: d.Price, Min: d.Price, Max: d.Price, To: at}
+				summaries[d.CurrencyCode] = summary
+				order = append(order, d.CurrencyCode)
+			}
+			summary.Events++
+			summary.First = d.Price
+			summary.From = at
+			summary.Min = math.Min(summary.Min, d.Price)
+			summary.Max = math.Max(summary.Max, d.Price)
+		}
+	}
+	for _, code := range order {
+		summary := summaries[code]
+		if summary.First != 0 {
+			summary.Change = (summary.Last/summary.First - 1) * 100
+		}
+		res = append(res, *summary)
+	}
+	return res
+}
+
+// isStreaming reports whether the request is served as a stream: the stream
+// routes whatever the client accepts, and upgrades or event streams anywhere.
+func isStreaming(r *http.Request) bool {
+	if r.URL.Path == "/api/stream" || r.URL.Path == "/api/ws" {
+		return true
+	}
+	return r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func isErrResult(v interface{}) bool {
+	object, ok := v.(jsonObject)
+	if !ok || len(object) != 2 {
+		return false
+	}
+	return object[0].Key == "code" && object[1].Key == "msg"
+}
+
+func isEnvelopeV2(v interface{}) bool {
+	object, ok := v.(jsonObject)
+	if !ok || len(object) != 2 {
+		return false
+	}
+	return object[0].Key == "data" && object[1].Key == "error" && object[1].Value == nil
+}
+
+func splitFields(param string) []string {
+	var fields []string
+	for _, field := range strings.Split(param, ",") {
+		if strings.TrimSpace(field) != "" {
+			fields = append(fields, strings.TrimSpace(field))
+		}
+	}
+	return fields
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (o jsonObject) get(key string) (interface{}, bool) {
+	for _, field := range o {
+		if field.Key == key {
+			return field.Value, true
+		}
+	}
+	return nil, false
+}
+
+func decodeOrdered(body []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	return decodeValue(dec)
+}
+
+func decodeValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+	switch delim {
+	case '{':
+		object := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonField{key.(string), value})
+		}
+		_, err = dec.Token()
+		return object, err
+	case '[':
+		list := make([]interface{}, 0)
+		for dec.More() {
+			value, err := decodeValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+	return nil, fmt.Errorf("unexpected delimiter %v", delim)
+}
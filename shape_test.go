@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProject(t *testing.T) {
+	body := `[{"symbol":"BTC","currencyCode":"KRW","price":90000000,"consensus":{"method":"median","price":89990000,"providers":["coinbase","upbit"]},` +
+		`"markets":[{"market":"KRW-BTC","premium":1.5},{"market":"BTC-X","premium":-0.5}]},{"symbol":"ETH","price":4000000}]`
+	for _, tc := range []struct {
+		name   string
+		fields string
+		want   string
+	}{
+		{"top level, in body order", "price,symbol",
+			`[{"symbol":"BTC","price":90000000},{"symbol":"ETH","price":4000000}]`},
+		{"nested path", "symbol,consensus.price",
+			`[{"symbol":"BTC","consensus":{"price":89990000}},{"symbol":"ETH"}]`},
+		{"path through a list", "markets.premium",
+			`[{"markets":[{"premium":1.5},{"premium":-0.5}]},{}]`},
+		{"whole field wins over its paths", "consensus.method,consensus",
+			`[{"consensus":{"method":"median","price":89990000,"providers":["coinbase","upbit"]}},{}]`},
+		{"sibling paths", "consensus.method,consensus.providers",
+			`[{"consensus":{"method":"median","providers":["coinbase","upbit"]}},{}]`},
+		{"unknown field and a path into a scalar", "nope,price.nope",
+			`[{"price":90000000},{"price":4000000}]`},
+	} {
+		decoded, err := decodeOrdered([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths [][]string
+		for _, field := range splitFields(tc.fields) {
+			paths = append(paths, strings.Split(field, "."))
+		}
+		got, _ := json.Marshal(project(decoded, paths))
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeOrdered(t *testing.T) {
+	for _, body := range []string{
+		`{"z":1,"a":{"y":"2","b":[true,false,null]},"m":[]}`,
+		`{"big":9007199254740993,"precise":1.50,"exp":1e-7,"unicode":"비트코인"}`,
+		`[{"b":1,"a":2},{"a":2,"b":1}]`,
+		`"scalar"`,
+		`{}`,
+	} {
+		decoded, err := decodeOrdered([]byte(body))
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		got, _ := json.Marshal(decoded)
+		if string(got) != body {
+			t.Errorf("got %s, want %s", got, body)
+		}
+	}
+	if _, err := decodeOrdered([]byte(`{"a":`)); err == nil {
+		t.Error("truncated body decoded")
+	}
+}
+
+func TestShapeResponse(t *testing.T) {
+	app := &App{}
+	handler := func(body string) http.Handler {
+		return app.shapeResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			setBlock(r, "sources", map[string]int{"coinbase": 1})
+			w.Write([]byte(body))
+		}))
+	}
+	list := `[{"symbol":"BTC","price":1,"provider":"coinbase"}]`
+	for _, tc := range []struct {
+		name  string
+		body  string
+		query string
+		want  string
+	}{
+		{"untouched", list, "", list},
+		{"fields", list, "fields=provider,symbol", `[{"symbol":"BTC","provider":"coinbase"}]`},
+		{"include in asked order", list, "include=nope,sources&fields=price",
+			`{"data":[{"price":1}],"nope":null,"sources":{"coinbase":1}}`},
+		{"v2 envelope kept", `{"data":` + list + `,"error":null}`, "fields=symbol&include=sources",
+			`{"data":[{"symbol":"BTC"}],"error":null,"sources":{"coinbase":1}}`},
+		{"errors untouched", `{"code":404,"msg":"nope"}`, "fields=symbol&include=sources", `{"code":404,"msg":"nope"}`},
+	} {
+		w := httptest.NewRecorder()
+		handler(tc.body).ServeHTTP(w, httptest.NewRequest("GET", "/api/BTC/info?"+tc.query, nil))
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(list).ServeHTTP(w, httptest.NewRequest("GET", "/api/BTC/info?include=metadata", nil))
+	decoded, _ := decodeOrdered(w.Body.Bytes())
+	metadata, _ := decoded.(jsonObject).get("metadata")
+	path, _ := metadata.(jsonObject).get("path")
+	if path != "/api/BTC/info" {
+		t.Errorf("metadata %v, want the request path", metadata)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// Every cache refresh is published on priceChannelPrefix+SYMBOL so that any
+// replica can push it to its own subscribers, and appended to a capped redis
+// stream so that reconnecting clients can resume from their last event id.
+const (
+	priceChannelPrefix string = "price:"
+	priceStreamPrefix  string = "events:"
+	priceStreamLen     int64  = 500
+	heartbeatInterval         = 15 * time.Second
+	subscriberBuffer          = 64
+)
+
+var (
+	hub      = &priceHub{subs: make(map[*subscriber]struct{}), closing: make(chan struct{})}
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin,
+	}
+)
+
+type PriceEvent struct {
+	Id     string `json:"id"`
+	Symbol string `json:"symbol"`
+	Data   []Data `json:"data"`
+}
+
+type wsMessage struct {
+	Action       string   `json:"action"`
+	Symbols      []string `json:"symbols"`
+	CurrencyCode []string `json:"currencyCode"`
+	LastEventId  string   `json:"lastEventId"`
+}
+
+type subscriber struct {
+	mu         sync.RWMutex
+	symbols    map[string]bool
+	currencies map[string]bool
+	lastId     string
+	sent       map[string]string
+	events     chan PriceEvent
+}
+
+// closing is closed on shutdown, ending the streams so that the server can
+// drain.
+type priceHub struct {
+	mu        sync.RWMutex
+	subs      map[*subscriber]struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func publishPrice(ctx context.Context, rds redis.UniversalClient, symbol string, res []Data) {
+	payload, err := json.Marshal(res)
+	if err != nil {
+		streamLog.Error(ctx, "error encoding price event", "symbol", symbol, "error", err)
+		return
+	}
+	id, err := rds.XAdd(ctx, &redis.XAddArgs{
+		Stream: priceStreamPrefix + symbol,
+		MaxLen: priceStreamLen,
+		Approx: true,
+		Values: map[string]interface{}{"data": payload},
+	}).Result()
+	if err != nil {
+		streamLog.Warn(ctx, "error appending price event", "symbol", symbol, "error", err)
+		return
+	}
+	event, err := json.Marshal(PriceEvent{id, symbol, res})
+	if err != nil {
+		streamLog.Error(ctx, "error encoding price event", "symbol", symbol, "error", err)
+		return
+	}
+	err = rds.Publish(ctx, priceChannelPrefix+symbol, event).Err()
+	if err != nil {
+		streamLog.Warn(ctx, "error publishing price event", "symbol", symbol, "error", err)
+	}
+}
+
+// run relays the redis pub/sub feed to the local subscribers. go-redis
+// resubscribes on its own when the connection drops.
+func (h *priceHub) run(ctx context.Context, rds redis.UniversalClient) {
+	ps := rds.PSubscribe(ctx, priceChannelPrefix+"*")
+	defer ps.Close()
+	channel := ps.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-channel:
+			if !ok {
+				return
+			}
+			var event PriceEvent
+			err := json.Unmarshal([]byte(msg.Payload), &event)
+			if err != nil {
+				streamLog.Warn(ctx, "error decoding price event", "channel", msg.Channel, "error", err)
+				continue
+			}
+			h.broadcast(event)
+		}
+	}
+}
+
+func (h *priceHub) close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+func (h *priceHub) add(sub *subscriber) {
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *priceHub) remove(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+func (h *priceHub) broadcast(event PriceEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		sub.deliver(event)
+	}
+}
+
+func newSubscriber(symbols []string, currencies []string, lastId string) *subscriber {
+	sub := &subscriber{
+		symbols:    make(map[string]bool),
+		currencies: make(map[string]bool),
+		lastId:     lastId,
+		sent:       make(map[string]string),
+		events:     make(chan PriceEvent, subscriberBuffer),
+	}
+	sub.subscribe(symbols, currencies)
+	return sub
+}
+
+func (s *subscriber) subscribe(symbols []string, currencies []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, symbol := range symbols {
+		s.symbols[normalizeCode(symbol)] = true
+	}
+	for _, code := range currencies {
+		s.currencies[normalizeCode(code)] = true
+	}
+}
+
+func (s *subscriber) unsubscribe(symbols []string, currencies []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, symbol := range symbols {
+		delete(s.symbols, normalizeCode(symbol))
+	}
+	for _, code := range currencies {
+		delete(s.currencies, normalizeCode(code))
+	}
+}
+
+func (s *subscriber) watching() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var symbols []string
+	for symbol := range s.symbols {
+		symbols = append(symbols, symbol)
+	}
+	return symbols
+}
+
+// filter narrows the event down to the subscribed currencies.
+func (s *subscriber) filter(event PriceEvent) (PriceEvent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.symbols[event.Symbol] {
+		return event, false
+	}
+	var data []Data
+	for _, d := range event.Data {
+		if len(s.currencies) == 0 || s.currencies[d.CurrencyCode] {
+			data = append(data, d)
+		}
+	}
+	event.Data = data
+	return event, len(data) > 0
+}
+
+// deliver queues a live event and drops it when the client is too slow; the
+// client can catch up with its last id.
+func (s *subscriber) deliver(event PriceEvent) {
+	event, ok := s.filter(event)
+	if !ok {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		streamLog.Warn(context.Background(), "subscriber too slow, dropping event", "event", event.Id)
+	}
+}
+
+// next reports whether event is newer than the last one of its symbol sent to
+// the client and records it, so replayed and live events are not sent twice.
+// Only the writing goroutine calls it.
+func (s *subscriber) next(event PriceEvent) bool {
+	last, ok := s.sent[event.Symbol]
+	if !ok {
+		last = s.lastId
+	}
+	if last != "" && compareStreamId(event.Id, last) <= 0 {
+		return false
+	}
+	s.sent[event.Symbol] = event.Id
+	return true
+}
+
+// resume moves the cursor of symbols back to lastId, for clients that
+// subscribe to more symbols with their own last event id.
+func (s *subscriber) resume(symbols []string, lastId string) {
+	for _, symbol := range symbols {
+		s.sent[normalizeCode(symbol)] = lastId
+	}
+}
+
+// replay returns the events stored after lastId for symbols, oldest first.
+// Handlers attach to the hub before calling it and write the replayed events
+// straight to the client, so they neither queue behind live events nor
+// overflow the subscriber buffer; live events already replayed are then
+// skipped by next.
+func (s *subscriber) replay(ctx context.Context, rds redis.UniversalClient, symbols []string, lastId string) []PriceEvent {
+	if lastId == "" {
+		return nil
+	}
+	var events []PriceEvent
+	for _, symbol := range symbols {
+		symbol = normalizeCode(symbol)
+		msgs, err := rds.XRange(ctx, priceStreamPrefix+symbol, lastId, "+").Result()
+		if err != nil {
+			streamLog.Warn(ctx, "error reading price events", "symbol", symbol, "error", err)
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.ID == lastId {
+				continue
+			}
+			payload, _ := msg.Values["data"].(string)
+			var data []Data
+			err := json.Unmarshal([]byte(payload), &data)
+			if err != nil {
+				streamLog.Warn(ctx, "error decoding price event", "symbol", symbol, "event", msg.ID, "error", err)
+				continue
+			}
+			event, ok := s.filter(PriceEvent{msg.ID, symbol, data})
+			if ok {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return compareStreamId(events[i].Id, events[j].Id) < 0
+	})
+	return events
+}
+
+func (a *App) streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	symbols := splitParam(r.URL.Query().Get("symbols"))
+	if len(symbols) == 0 {
+		msg, _ := json.Marshal(errResult{400, "No symbols to subscribe"})
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(msg)
+		return
+	}
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("lastEventId")
+	}
+	sub := newSubscriber(symbols, splitParam(r.URL.Query().Get("currency")), lastId)
+	hub.add(sub)
+	defer hub.remove(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	send := func(event PriceEvent) {
+		if !sub.next(event) {
+			return
+		}
+		payload, err := json.Marshal(event.Data)
+		if err != nil {
+			streamLog.Error(ctx, "error encoding price event", "event", event.Id, "error", err)
+			return
+		}
+		fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Symbol, payload)
+		flusher.Flush()
+	}
+	for _, event := range sub.replay(ctx, a.Redis, sub.watching(), lastId) {
+		send(event)
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hub.closing:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event := <-sub.events:
+			send(event)
+		}
+	}
+}
+
+// checkOrigin accepts WebSocket upgrades from clients that send no Origin,
+// such as servers, from pages of the API's own host, and from the origins of
+// stream.allowed_origins. Other sites could otherwise open streams with the
+// credentials of their visitors.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range cfg.Stream.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *App) wsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		streamLog.Warn(r.Context(), "error upgrading websocket", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	rds := a.Redis
+
+	lastId := r.URL.Query().Get("lastEventId")
+	sub := newSubscriber(splitParam(r.URL.Query().Get("symbols")), splitParam(r.URL.Query().Get("currency")), lastId)
+	hub.add(sub)
+	defer hub.remove(sub)
+	send := func(event PriceEvent) error {
+		if !sub.next(event) {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		return conn.WriteJSON(event)
+	}
+	replay := func(symbols []string, lastId string) error {
+		for _, event := range sub.replay(ctx, rds, symbols, lastId) {
+			err := send(event)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if replay(sub.watching(), lastId) != nil {
+		return
+	}
+
+	// Subscriptions are applied by the writing loop, so that their replay
+	// goes out before any live event of the new symbols.
+	subscriptions := make(chan wsMessage)
+	conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+	})
+	go func() {
+		defer cancel()
+		for {
+			var msg wsMessage
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				return
+			}
+			switch msg.Action {
+			case "subscribe":
+				select {
+				case subscriptions <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case "unsubscribe":
+				sub.unsubscribe(msg.Symbols, msg.CurrencyCode)
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hub.closing:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			return
+		case <-heartbeat.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+			if err != nil {
+				return
+			}
+		case msg := <-subscriptions:
+			sub.subscribe(msg.Symbols, msg.CurrencyCode)
+			if msg.LastEventId != "" {
+				sub.resume(msg.Symbols, msg.LastEventId)
+			}
+			if replay(msg.Symbols, msg.LastEventId) != nil {
+				return
+			}
+		case event := <-sub.events:
+			if send(event) != nil {
+				return
+			}
+		}
+	}
+}
+
+func compareStreamId(a string, b string) int {
+	aMs, aSeq := parseStreamId(a)
+	bMs, bSeq := parseStreamId(b)
+	switch {
+	case aMs != bMs && aMs < bMs:
+		return -1
+	case aMs != bMs:
+		return 1
+	case aSeq < bSeq:
+		return -1
+	case aSeq > bSeq:
+		return 1
+	}
+	return 0
+}
+
+func parseStreamId(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	var seq uint64
+	if len(parts) == 2 {
+		seq, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	return ms, seq
+}
+
+func splitParam(param string) []string {
+	var values []string
+	for _, v := range strings.Split(param, ",") {
+		if strings.TrimSpace(v) != "" {
+			values = append(values, normalizeCode(v))
+		}
+	}
+	return values
+}
+
+func normalizeCode(code string) string {
+	return strings.TrimSpace(strings.ToUpper(code))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func krwEvent(price float64) []Data {
+	return []Data{{CurrencyCode: "KRW", Price: price}, {CurrencyCode: "USD", Price: price / 1400}}
+}
+
+// TestStreamReplay resumes from an early id with more stored events than the
+// subscriber buffer holds, while live events, one already replayed, arrive.
+func TestStreamReplay(t *testing.T) {
+	fake, rds := newFakeRedis(t)
+	var ids []string
+	for i := 0; i < 2*subscriberBuffer; i++ {
+		ids = append(ids, fake.addEvent("BTC", krwEvent(float64(i))))
+	}
+	srv := httptest.NewServer(http.HandlerFunc((&App{Redis: rds}).streamHandler))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?symbols=btc&currency=krw", nil)
+	req.Header.Set("Last-Event-ID", ids[9])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var got []string
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "data: ") && !strings.Contains(line, `"currencyCode":"KRW"`) ||
+			strings.Contains(line, `"USD"`) {
+			t.Fatalf("event not filtered to KRW: %s", line)
+		}
+		if !strings.HasPrefix(line, "id: ") {
+			continue
+		}
+		got = append(got, strings.TrimPrefix(line, "id: "))
+		if len(got) == 1 {
+			hub.broadcast(PriceEvent{Id: ids[50], Symbol: "BTC", Data: krwEvent(50)})
+			hub.broadcast(PriceEvent{Id: "999-0", Symbol: "BTC", Data: krwEvent(999)})
+		}
+		if got[len(got)-1] == "999-0" {
+			break
+		}
+	}
+	want := append(append([]string{}, ids[10:]...), "999-0")
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got ids %v, want %v", got, want)
+	}
+}
+
+// TestWebsocketSubscribeReplay subscribes to a second symbol with its own
+// last event id after a live event of the first.
+func TestWebsocketSubscribeReplay(t *testing.T) {
+	fake, rds := newFakeRedis(t)
+	first := fake.addEvent("ETH", krwEvent(1))
+	second := fake.addEvent("ETH", krwEvent(2))
+	srv := httptest.NewServer(http.HandlerFunc((&App{Redis: rds}).wsHandler))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?symbols=BTC", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make(chan struct{})
+	go func() {
+		for seq := 1000; ; seq++ {
+			hub.broadcast(PriceEvent{Id: strconv.Itoa(seq) + "-0", Symbol: "BTC", Data: krwEvent(1)})
+			select {
+			case <-received:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+	var event PriceEvent
+	err = conn.ReadJSON(&event)
+	close(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.WriteJSON(wsMessage{Action: "subscribe", Symbols: []string{"eth"}, LastEventId: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for event.Symbol != "ETH" {
+		err = conn.ReadJSON(&event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if event.Id != second || event.Data[0].Price != 2 {
+		t.Fatalf("got %+v, want the ETH event after %s", event, first)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	saved := cfg.Stream
+	defer func() { cfg.Stream = saved }()
+	cfg.Stream.AllowedOrigins = []string{"https://app.example.com/"}
+	for _, tc := range []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://api.example.com", true},
+		{"https://app.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://api.example.com.evil.com", false},
+		{"null", false},
+	} {
+		r := httptest.NewRequest("GET", "http://api.example.com/api/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := checkOrigin(r); got != tc.want {
+			t.Errorf("origin %q: got %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+	cfg.Stream.AllowedOrigins = []string{"*"}
+	r := httptest.NewRequest("GET", "http://api.example.com/api/ws", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !checkOrigin(r) {
+		t.Errorf(`"*" refused an origin`)
+	}
+}
+
+// TestStreamWithoutAccept streams through the whole middleware chain to a
+// client that doesn't ask for text/event-stream.
+func TestStreamWithoutAccept(t *testing.T) {
+	srv := newTestServer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/stream?symbols=btc", nil)
+	req.Header.Set("X-API-Key", testApiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("status %d, content type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
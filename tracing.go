@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Spans follow the OpenTelemetry model and are exported either as JSON lines
+// on stdout or to an OTLP/HTTP collector in its JSON encoding. Traces are
+// continued from the W3C traceparent header of incoming requests.
+
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+const (
+	tracingStdout = "stdout"
+	tracingOtlp   = "otlp"
+)
+
+var spanKinds = []string{"", "internal", "server", "client"}
+
+var finishedSpans = make(chan *Span, 10000)
+
+type spanKey struct{}
+
+type Span struct {
+	TraceId    string
+	SpanId     string
+	ParentId   string
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes jsonObject
+	Error      string
+
+	mu      sync.Mutex
+	sampled bool
+}
+
+// startSpan starts a span, the child of the span of ctx if there is one.
+// The span is nil, and its methods no-ops, when tracing is disabled.
+func startSpan(ctx context.Context, name string, kind int, kv ...interface{}) (context.Context, *Span) {
+	if !cfg.Tracing.Enabled {
+		return ctx, nil
+	}
+	span := &Span{SpanId: newTraceId(8), Name: name, Kind: kind, Start: time.Now()}
+	if parent := spanFromContext(ctx); parent != nil {
+		span.TraceId, span.ParentId, span.sampled = parent.TraceId, parent.SpanId, parent.sampled
+	} else {
+		span.TraceId = newTraceId(16)
+		span.sampled = sampleTrace(span.TraceId)
+	}
+	span.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startChildSpan starts a span only within a trace, so that background
+// work like the ticker flushes doesn't start traces of its own.
+func startChildSpan(ctx context.Context, name string, kind int, kv ...interface{}) (context.Context, *Span) {
+	if spanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return startSpan(ctx, name, kind, kv...)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, _ := kv[i].(string)
+		s.Attributes = append(s.Attributes, jsonField{key, kv[i+1]})
+	}
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	select {
+	case finishedSpans <- s:
+	default:
+	}
+}
+
+func newTraceId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sampleTrace keeps the configured ratio of traces, deciding on the trace ID
+// so that every replica decides alike.
+func sampleTrace(traceId string) bool {
+	ratio := cfg.Tracing.SampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	n, err := strconv.ParseUint(traceId[len(traceId)-16:], 16, 64)
+	return err == nil && float64(n) < ratio*math.MaxUint64
+}
+
+// withTraceparent continues the trace of a W3C traceparent header. Headers
+// of the invalid version ff, or with all-zero IDs, start a new trace.
+func withTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	if _, err := hex.DecodeString(strings.Join(parts, "")); err != nil || parts[0] == "ff" {
+		return ctx
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return ctx
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	remote := &Span{TraceId: parts[1], SpanId: parts[2], sampled: flags&1 == 1}
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+func traceparent(span *Span) string {
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	return "00-" + span.TraceId + "-" + span.SpanId + "-" + flags
+}
+
+// traceRequests runs every request in a server span and answers with its
+// traceparent.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Tracing.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		ctx := withTraceparent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := startSpan(ctx, r.Method+" "+route, spanServer,
+			"http.method", r.Method,
+			"http.route", route,
+			"http.target", r.URL.RequestURI(),
+			"request.id", requestId(ctx))
+		if symbol := mux.Vars(r)["symbol"]; symbol != "" {
+			span.SetAttributes("symbol", normalizeCode(symbol))
+		}
+		w.Header().Set("traceparent", traceparent(span))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		if isStreaming(r) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+		} else {
+			next.ServeHTTP(sw, r.WithContext(ctx))
+		}
+		span.SetAttributes("http.status_code", sw.status)
+		if sw.status >= 500 {
+			span.SetError(errors.New(http.StatusText(sw.status)))
+		}
+		span.Finish()
+	})
+}
+
+// redisTracing traces the commands of a Redis client run within a trace.
+type redisTracing struct{}
+
+func (redisTracing) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	ctx, _ = startChildSpan(ctx, "redis "+cmd.Name(), spanClient,
+		"db.system", "redis",
+		"db.statement", redisStatement(cmd))
+	return ctx, nil
+}
+
+func (redisTracing) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	span := spanFromContext(ctx)
+	if span != nil && span.Name == "redis "+cmd.Name() {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			span.SetError(err)
+		}
+		span.Finish()
+	}
+	return nil
+}
+
+func (redisTracing) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	names := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name())
+	}
+	ctx, _ = startChildSpan(ctx, "redis pipeline", spanClient,
+		"db.system", "redis",
+		"db.statement", strings.Join(names, " "))
+	return ctx, nil
+}
+
+func (redisTracing) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	span := spanFromContext(ctx)
+	if span != nil && span.Name == "redis pipeline" {
+		for _, cmd := range cmds {
+			if err := cmd.Err(); err != nil && err != redis.Nil {
+				span.SetError(err)
+			}
+		}
+		span.Finish()
+	}
+	return nil
+}
+
+// redisStatement is the command with its key, leaving out values.
+func redisStatement(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) > 1 {
+		if key, ok := args[1].(string); ok {
+			return cmd.Name() + " " + key
+		}
+	}
+	return cmd.Name()
+}
+
+var mongoSpans sync.Map
+
+// mongoCommandMonitor traces the Mongo commands run within a trace.
+var mongoCommandMonitor = &event.CommandMonitor{
+	Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		collection, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+		_, span := startChildSpan(ctx, "mongo "+e.CommandName, spanClient,
+			"db.system", "mongodb",
+			"db.name", e.DatabaseName,
+			"db.mongodb.collection", collection)
+		if span != nil {
+			mongoSpans.Store(e.RequestID, span)
+		}
+	},
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		if span, ok := mongoSpans.LoadAndDelete(e.RequestID); ok {
+			span.(*Span).Finish()
+		}
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		if span, ok := mongoSpans.LoadAndDelete(e.RequestID); ok {
+			span.(*Span).SetError(errors.New(e.Failure))
+			span.(*Span).Finish()
+		}
+	},
+}
+
+// runSpanExporter exports finished spans in batches every flush interval, or
+// sooner once a batch is full, until ctx is done and the spans finished so far
+// are exported.
+func runSpanExporter(ctx context.Context) {
+	interval := time.Duration(cfg.Tracing.FlushInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	batchSize := cfg.Tracing.BatchSize
+	if batchSize <= 0 {
+		batchSize = 512
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case <-ctx.Done():
+			for len(finishedSpans) > 0 {
+				batch = append(batch, <-finishedSpans)
+			}
+			exportSpans(batch)
+			return
+		case span := <-finishedSpans:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				exportSpans(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				exportSpans(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+func exportSpans(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	if cfg.Tracing.Exporter == tracingOtlp {
+		exportOtlp(batch)
+		return
+	}
+	var buf bytes.Buffer
+	for _, span := range batch {
+		line, err := json.Marshal(stdoutSpan(span))
+		if err != nil {
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	logMu.Lock()
+	logOut.Write(buf.Bytes())
+	logMu.Unlock()
+}
+
+func stdoutSpan(span *Span) jsonObject {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	entry := jsonObject{
+		{"time", span.Start.UTC().Format(time.RFC3339Nano)},
+		{"level", "trace"},
+		{"traceId", span.TraceId},
+		{"spanId", span.SpanId},
+	}
+	if span.ParentId != "" {
+		entry = append(entry, jsonField{"parentSpanId", span.ParentId})
+	}
+	entry = append(entry,
+		jsonField{"name", span.Name},
+		jsonField{"kind", spanKinds[span.Kind]},
+		jsonField{"durationMs", float64(span.End.Sub(span.Start).Microseconds()) / 1000},
+		jsonField{"attributes", span.Attributes})
+	if span.Error != "" {
+		entry = append(entry, jsonField{"error", span.Error})
+	}
+	return entry
+}
+
+// exportOtlp posts the spans to the collector as an OTLP/HTTP JSON
+// ExportTraceServiceRequest.
+func exportOtlp(batch []*Span) {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, otlpSpan(span))
+	}
+	serviceName := cfg.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "upbit"
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(jsonObject{{"service.name", serviceName}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "upbit"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(cfg.Tracing.Endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		serverLog.Warn(context.Background(), "error exporting spans", "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		serverLog.Warn(context.Background(), "error exporting spans", "spans", len(batch), "status", resp.StatusCode)
+	}
+}
+
+func otlpSpan(span *Span) map[string]interface{} {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	res := map[string]interface{}{
+		"traceId":           span.TraceId,
+		"spanId":            span.SpanId,
+		"name":              span.Name,
+		"kind":              span.Kind,
+		"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+		"attributes":        otlpAttributes(span.Attributes),
+	}
+	if span.ParentId != "" {
+		res["parentSpanId"] = span.ParentId
+	}
+	if span.Error != "" {
+		res["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+	}
+	return res
+}
+
+func otlpAttributes(attributes jsonObject) []interface{} {
+	res := make([]interface{}, 0, len(attributes))
+	for _, attribute := range attributes {
+		var value map[string]interface{}
+		switch v := attribute.Value.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case []string:
+			values := make([]interface{}, 0, len(v))
+			for _, s := range v {
+				values = append(values, map[string]interface{}{"stringValue": s})
+			}
+			value = map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+		default:
+			encoded, _ := json.Marshal(v)
+			value = map[string]interface{}{"stringValue": string(encoded)}
+		}
+		res = append(res, map[string]interface{}{"key": attribute.Key, "value": value})
+	}
+	return res
+}
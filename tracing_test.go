@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withTracing(t *testing.T, ratio float64) {
+	saved := cfg
+	cfg.Tracing.Enabled = true
+	cfg.Tracing.SampleRatio = ratio
+	t.Cleanup(func() { cfg = saved })
+}
+
+func TestWithTraceparent(t *testing.T) {
+	const traceId, spanId = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	for _, tc := range []struct {
+		name    string
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceId + "-" + spanId + "-01", true, true},
+		{"not sampled", "00-" + traceId + "-" + spanId + "-00", true, false},
+		{"other flags set", "00-" + traceId + "-" + spanId + "-03", true, true},
+		{"other flags only", "00-" + traceId + "-" + spanId + "-02", true, false},
+		{"empty", "", false, false},
+		{"all-zero trace id", "00-00000000000000000000000000000000-" + spanId + "-01", false, false},
+		{"all-zero span id", "00-" + traceId + "-0000000000000000-01", false, false},
+		{"version ff", "ff-" + traceId + "-" + spanId + "-01", false, false},
+		{"not hex", "00-" + strings.Repeat("z", 32) + "-" + spanId + "-01", false, false},
+		{"not hex flags", "00-" + traceId + "-" + spanId + "-0x", false, false},
+		{"short trace id", "00-" + traceId[1:] + "-" + spanId + "-01", false, false},
+		{"short span id", "00-" + traceId + "-" + spanId[1:] + "-01", false, false},
+		{"long version", "000-" + traceId + "-" + spanId + "-01", false, false},
+		{"missing flags", "00-" + traceId + "-" + spanId, false, false},
+	} {
+		span := spanFromContext(withTraceparent(context.Background(), tc.header))
+		if (span != nil) != tc.valid {
+			t.Errorf("%s: continued %v, want %v", tc.name, span != nil, tc.valid)
+			continue
+		}
+		if span == nil {
+			continue
+		}
+		if span.TraceId != traceId || span.SpanId != spanId || span.sampled != tc.sampled {
+			t.Errorf("%s: span %s %s sampled %v", tc.name, span.TraceId, span.SpanId, span.sampled)
+		}
+	}
+}
+
+func TestSampleTrace(t *testing.T) {
+	const low, high = "0000000000000000" + "0000000000000001", "0000000000000000" + "ffffffffffffffff"
+	const middle = "ffffffffffffffff" + "7000000000000000"
+	for _, tc := range []struct {
+		ratio   float64
+		traceId string
+		want    bool
+	}{
+		{1, high, true},
+		{2, high, true},
+		{0, low, false},
+		{0, high, false},
+		{0.5, low, true},
+		{0.5, middle, true},
+		{0.5, high, false},
+		{0.25, middle, false},
+	} {
+		withTracing(t, tc.ratio)
+		if got := sampleTrace(tc.traceId); got != tc.want {
+			t.Errorf("ratio %v trace %s: sampled %v, want %v", tc.ratio, tc.traceId, got, tc.want)
+		}
+	}
+}
+
+func TestStartSpanSampling(t *testing.T) {
+	withTracing(t, 0)
+	_, root := startSpan(context.Background(), "root", spanInternal)
+	if root.sampled {
+		t.Error("root sampled at ratio 0")
+	}
+
+	// A sampled parent keeps its children sampled whatever the local ratio.
+	ctx := withTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, child := startSpan(ctx, "child", spanInternal)
+	if !child.sampled || child.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || child.ParentId != "00f067aa0ba902b7" {
+		t.Errorf("child %s of %s sampled %v", child.TraceId, child.ParentId, child.sampled)
+	}
+
+	if _, span := startChildSpan(context.Background(), "orphan", spanClient); span != nil {
+		t.Error("started a child span outside of a trace")
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	withTracing(t, 1)
+	h := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		header, prefix, flags string
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "00-4bf92f3577b34da6a3ce929d0e0e4736-", "-00"},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-00", "00-", "-01"},
+	} {
+		req := httptest.NewRequest("GET", "/api/BTC/info", nil)
+		req.Header.Set("traceparent", tc.header)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		got := w.Header().Get("traceparent")
+		if !strings.HasPrefix(got, tc.prefix) || !strings.HasSuffix(got, tc.flags) || strings.Contains(got, "00000000000000000000000000000000") || len(got) != 55 {
+			t.Errorf("traceparent %s answered %s", tc.header, got)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	upbitTickerKey   string = "upbit:ticker"
+	upbitFlushPeriod        = 500 * time.Millisecond
+	upbitPingPeriod         = 30 * time.Second
+	upbitMinBackoff         = time.Second
+	upbitMaxBackoff         = time.Minute
+	upbitSyncTimeout        = 2 * time.Minute
+)
+
+var priceBook = &upbitPriceBook{
+	tickers: make(map[string]UpbitTicker),
+	dirty:   make(map[string]bool),
+}
+
+// UpbitRegion is one of the Upbit exchanges (KRW, IDR, SGD, THB) with its
+// REST and WebSocket endpoints; pointing them at a local stand-in is enough
+// to run the ingestion worker offline.
+type UpbitRegion struct {
+	Quote     string `yaml:"quote"`
+	Rest      string `yaml:"rest"`
+	Websocket string `yaml:"websocket"`
+}
+
+type UpbitMarket struct {
+	Market        string `json:"market"`
+	KoreanName    string `json:"korean_name"`
+	EnglishName   string `json:"english_name"`
+	MarketWarning string `json:"market_warning"`
+}
+
+// UpbitTicker holds the ticker fields shared by the WebSocket feed (code) and
+// the REST /v1/ticker response (market).
+type UpbitTicker struct {
+	Code              string  `json:"code"`
+	Market            string  `json:"market"`
+	TradePrice        float64 `json:"trade_price"`
+	HighPrice         float64 `json:"high_price"`
+	LowPrice          float64 `json:"low_price"`
+	SignedChangeRate  float64 `json:"signed_change_rate"`
+	AccTradePrice24H  float64 `json:"acc_trade_price_24h"`
+	AccTradeVolume24H float64 `json:"acc_trade_volume_24h"`
+	Timestamp         int64   `json:"timestamp"`
+}
+
+type upbitPriceBook struct {
+	mu      sync.RWMutex
+	tickers map[string]UpbitTicker
+	dirty   map[string]bool
+}
+
+func (b *upbitPriceBook) set(ticker UpbitTicker) {
+	b.mu.Lock()
+	b.tickers[ticker.Code] = ticker
+	b.dirty[ticker.Code] = true
+	b.mu.Unlock()
+}
+
+func (b *upbitPriceBook) get(market string) (UpbitTicker, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ticker, ok := b.tickers[market]
+	return ticker, ok
+}
+
+// flush writes the tickers changed since the last flush to redis so replicas
+// without a live connection can serve them too.
+func (b *upbitPriceBook) flush(ctx context.Context, rds redis.UniversalClient) {
+	b.mu.Lock()
+	var values []interface{}
+	for code := range b.dirty {
+		ticker, err := json.Marshal(b.tickers[code])
+		if err == nil {
+			values = append(values, code, ticker)
+		}
+	}
+	b.dirty = make(map[string]bool)
+	b.mu.Unlock()
+	if len(values) == 0 {
+		return
+	}
+	err := rds.HSet(ctx, upbitTickerKey, values...).Err()
+	if err != nil {
+		cacheLog.Warn(ctx, "error caching Upbit tickers", "error", err)
+	}
+}
+
+// getUpbitTicker returns the latest ticker for symbol on the quote market,
+// from the local price book or, when that one is missing or stale, from the
+// redis hash other replicas keep up to date, unless both have gone stale.
+func getUpbitTicker(ctx context.Context, rds redis.UniversalClient, symbol string, quote string) (UpbitTicker, bool) {
+	market := quote + "-" + symbol
+	ticker, ok := priceBook.get(market)
+	if ok && freshTicker(ticker) {
+		return ticker, true
+	}
+	res, err := rds.HGet(ctx, upbitTickerKey, market).Result()
+	if err != nil {
+		return UpbitTicker{}, false
+	}
+	err = json.Unmarshal([]byte(res), &ticker)
+	if err != nil {
+		cacheLog.Warn(ctx, "error decoding Upbit ticker", "market", market, "error", err)
+		return UpbitTicker{}, false
+	}
+	if !freshTicker(ticker) {
+		return UpbitTicker{}, false
+	}
+	return ticker, true
+}
+
+func freshTicker(ticker UpbitTicker) bool {
+	staleAfter := time.Duration(cfg.Upbit.StaleAfter) * time.Second
+	return staleAfter <= 0 || time.Since(time.Unix(0, ticker.Timestamp*int64(time.Millisecond))) <= staleAfter
+}
+
+// overrideUpbitPrices replaces the prices of currencies quoted on Upbit with
+// the live Upbit trade price.
+func overrideUpbitPrices(ctx context.Context, rds redis.UniversalClient, symbol string, currencyPrice map[string]float64) {
+	for code := range currencyPrice {
+		ticker, ok := getUpbitTicker(ctx, rds, symbol, code)
+		if ok {
+			currencyPrice[code] = ticker.TradePrice
+		}
+	}
+}
+
+func getUpbitMarkets(ctx context.Context, region UpbitRegion, details bool) ([]UpbitMarket, error) {
+	q := url.Values{}
+	q.Add("isDetails", strconv.FormatBool(details))
+	req, err := http.NewRequestWithContext(ctx, "GET", region.Rest+"/v1/market/all?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := providerClient("upbit").Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Upbit market list status " + resp.Status)
+	}
+	var markets []UpbitMarket
+	err = json.Unmarshal(respBody, &markets)
+	if err != nil {
+		return nil, err
+	}
+	var res []UpbitMarket
+	for _, market := range markets {
+		if strings.HasPrefix(market.Market, region.Quote+"-") {
+			res = append(res, market)
+		}
+	}
+	return res, nil
+}
+
+// runUpbitIngestion streams every region's tickers into the price book and
+// flushes it to redis until ctx is done, then flushes it a last time.
+func (a *App) runUpbitIngestion(ctx context.Context) {
+	for _, region := range cfg.Upbit.Markets {
+		go runTickerWorker(ctx, region)
+	}
+	ticker := time.NewTicker(upbitFlushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			priceBook.flush(context.Background(), a.Redis)
+			return
+		case <-ticker.C:
+			priceBook.flush(ctx, a.Redis)
+		}
+	}
+}
+
+// runTickerWorker keeps one WebSocket subscription per region alive,
+// reconnecting with exponential backoff until ctx is done.
+func runTickerWorker(ctx context.Context, region UpbitRegion) {
+	backoff := upbitMinBackoff
+	for {
+		start := time.Now()
+		err := consumeTickers(ctx, region)
+		if ctx.Err() != nil {
+			return
+		}
+		streamLog.Warn(ctx, "Upbit ticker stream error", "quote", region.Quote, "error", err)
+		if time.Since(start) > upbitMaxBackoff {
+			backoff = upbitMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > upbitMaxBackoff {
+			backoff = upbitMaxBackoff
+		}
+	}
+}
+
+func consumeTickers(ctx context.Context, region UpbitRegion) error {
+	markets, err := getUpbitMarkets(ctx, region, false)
+	if err != nil {
+		return err
+	}
+	var codes []string
+	for _, market := range markets {
+		codes = append(codes, market.Market)
+	}
+	if len(codes) == 0 {
+		return errors.New("no " + region.Quote + " markets")
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, region.Websocket, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	subscription := []map[string]interface{}{
+		{"ticket": "upbit-api-" + strconv.FormatInt(time.Now().UnixNano(), 36)},
+		{"type": "ticker", "codes": codes},
+		{"format": "DEFAULT"},
+	}
+	err = conn.WriteJSON(subscription)
+	if err != nil {
+		return err
+	}
+	streamLog.Info(ctx, "subscribed to Upbit tickers", "quote", region.Quote, "tickers", len(codes))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(upbitPingPeriod)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ping.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+			}
+		}
+	}()
+
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * upbitPingPeriod))
+	})
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * upbitPingPeriod))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var ticker UpbitTicker
+		err = json.Unmarshal(msg, &ticker)
+		if err != nil || ticker.Code == "" {
+			continue
+		}
+		priceBook.set(ticker)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newUpbitStandIn serves /v1/market/all and the ticker WebSocket of one
+// region. Each connection gets the next batch of frames and is then closed,
+// so the worker has to reconnect for the next.
+func newUpbitStandIn(t *testing.T, batches [][]UpbitTicker) UpbitRegion {
+	var conns int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/market/all", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"market":"KRW-TST"},{"market":"KRW-TST2"},{"market":"BTC-TST"}]`))
+	})
+	mux.HandleFunc("/websocket/v1", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		var subscription []map[string]interface{}
+		err = conn.ReadJSON(&subscription)
+		if err != nil || len(subscription) != 3 {
+			t.Errorf("unexpected subscription %v: %v", subscription, err)
+			return
+		}
+		codes, _ := json.Marshal(subscription[1]["codes"])
+		if string(codes) != `["KRW-TST","KRW-TST2"]` {
+			t.Errorf("subscribed to %s, want the KRW markets only", codes)
+		}
+		n := int(atomic.AddInt32(&conns, 1)) - 1
+		if n >= len(batches) {
+			time.Sleep(time.Minute)
+			return
+		}
+		for _, ticker := range batches[n] {
+			frame, _ := json.Marshal(ticker)
+			conn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+		conn.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"status"}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return UpbitRegion{
+		Quote:     "KRW",
+		Rest:      srv.URL,
+		Websocket: "ws" + strings.TrimPrefix(srv.URL, "http") + "/websocket/v1",
+	}
+}
+
+func waitForTicker(t *testing.T, market string, price float64) UpbitTicker {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ticker, ok := priceBook.get(market)
+		if ok && ticker.TradePrice == price {
+			return ticker
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never reached %v", market, price)
+	return UpbitTicker{}
+}
+
+func TestTickerWorker(t *testing.T) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	region := newUpbitStandIn(t, [][]UpbitTicker{
+		{{Code: "KRW-TST", TradePrice: 100, Timestamp: now}, {Code: "KRW-TST2", TradePrice: 5, Timestamp: now}},
+		{{Code: "KRW-TST", TradePrice: 101, Timestamp: now}},
+	})
+	fake, rds := newFakeRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runTickerWorker(ctx, region)
+
+	waitForTicker(t, "KRW-TST2", 5)
+	waitForTicker(t, "KRW-TST", 100)
+	priceBook.flush(ctx, rds)
+	var cached UpbitTicker
+	raw, _ := fake.hashes[upbitTickerKey]["KRW-TST"]
+	err := json.Unmarshal([]byte(raw), &cached)
+	if err != nil || cached.TradePrice != 100 {
+		t.Fatalf("cached ticker %q: %v", raw, err)
+	}
+
+	// The stand-in hangs up after each batch; the worker reconnects.
+	waitForTicker(t, "KRW-TST", 101)
+	priceBook.flush(ctx, rds)
+	ticker, ok := getUpbitTicker(ctx, rds, "TST", "KRW")
+	if !ok || ticker.TradePrice != 101 {
+		t.Fatalf("got %+v, %v, want the reconnected price", ticker, ok)
+	}
+}
+
+func TestGetUpbitTickerStale(t *testing.T) {
+	saved := cfg
+	cfg.Upbit.StaleAfter = 60
+	t.Cleanup(func() { cfg = saved })
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	stale := now - int64(2*time.Minute/time.Millisecond)
+	_, rds := newFakeRedis(t)
+	ctx := context.Background()
+	store := func(ticker UpbitTicker) {
+		raw, _ := json.Marshal(ticker)
+		rds.HSet(ctx, upbitTickerKey, ticker.Code, raw)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		symbol string
+		local  *UpbitTicker
+		shared *UpbitTicker
+		price  float64
+		ok     bool
+	}{
+		{"fresh locally", "STA", &UpbitTicker{TradePrice: 1, Timestamp: now}, &UpbitTicker{TradePrice: 2, Timestamp: now}, 1, true},
+		{"stale locally, fresh in redis", "STB", &UpbitTicker{TradePrice: 1, Timestamp: stale}, &UpbitTicker{TradePrice: 2, Timestamp: now}, 2, true},
+		{"only in redis", "STC", nil, &UpbitTicker{TradePrice: 2, Timestamp: now}, 2, true},
+		{"stale everywhere", "STD", &UpbitTicker{TradePrice: 1, Timestamp: stale}, &UpbitTicker{TradePrice: 2, Timestamp: stale}, 0, false},
+		{"stale locally, not in redis", "STE", &UpbitTicker{TradePrice: 1, Timestamp: stale}, nil, 0, false},
+	} {
+		market := "KRW-" + tc.symbol
+		if tc.local != nil {
+			tc.local.Code = market
+			priceBook.set(*tc.local)
+		}
+		if tc.shared != nil {
+			tc.shared.Code = market
+			store(*tc.shared)
+		}
+		ticker, ok := getUpbitTicker(ctx, rds, tc.symbol, "KRW")
+		if ok != tc.ok || ticker.TradePrice != tc.price {
+			t.Errorf("%s: got %v at %v, want %v at %v", tc.name, ok, ticker.TradePrice, tc.ok, tc.price)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const usageBuffer = 10000
+
+var usageEvents = make(chan UsageEvent, usageBuffer)
+
+type usageKey struct{}
+
+// UsageEvent is one request as recorded in usage.events. Cache is hit or miss
+// on routes with a cache or reaching the providers, and empty otherwise.
+type UsageEvent struct {
+	Time          time.Time `bson:"time" json:"time"`
+	ApiKey        string    `bson:"apiKey" json:"apiKey"`
+	KeyName       string    `bson:"keyName" json:"keyName"`
+	Route         string    `bson:"route" json:"route"`
+	Method        string    `bson:"method" json:"method"`
+	Status        int       `bson:"status" json:"status"`
+	Symbols       []string  `bson:"symbols" json:"symbols"`
+	Currencies    []string  `bson:"currencies" json:"currencies"`
+	Cache         string    `bson:"cache" json:"cache"`
+	UpstreamCalls int       `bson:"upstreamCalls" json:"upstreamCalls"`
+	LatencyMs     int64     `bson:"latencyMs" json:"latencyMs"`
+}
+
+// usageRecord is the event of the request being served, filled in by the
+// middleware and handlers down the chain.
+type usageRecord struct {
+	mu    sync.Mutex
+	event UsageEvent
+}
+
+// UsageDaily is the rollup of a day's requests of one key on one route, in
+// usage.daily.
+type UsageDaily struct {
+	Date          string `bson:"date" json:"date"`
+	ApiKey        string `bson:"apiKey" json:"apiKey"`
+	KeyName       string `bson:"keyName" json:"keyName"`
+	Route         string `bson:"route" json:"route"`
+	Requests      int64  `bson:"requests" json:"requests"`
+	Errors        int64  `bson:"errors" json:"errors"`
+	CacheHits     int64  `bson:"cacheHits" json:"cacheHits"`
+	CacheMisses   int64  `bson:"cacheMisses" json:"cacheMisses"`
+	UpstreamCalls int64  `bson:"upstreamCalls" json:"upstreamCalls"`
+	LatencyMs     int64  `bson:"latencyMs" json:"latencyMs"`
+}
+
+type UsageCount struct {
+	Key      string `bson:"_id" json:"key"`
+	Name     string `bson:"name,omitempty" json:"name,omitempty"`
+	Requests int64  `bson:"requests" json:"requests"`
+}
+
+type CacheRatio struct {
+	Date   string  `bson:"_id" json:"date"`
+	Hits   int64   `bson:"hits" json:"hits"`
+	Misses int64   `bson:"misses" json:"misses"`
+	Ratio  float64 `bson:"-" json:"ratio"`
+}
+
+type UsageReport struct {
+	From          string       `json:"from"`
+	To            string       `json:"to"`
+	TopSymbols    []UsageCount `json:"topSymbols"`
+	TopClients    []UsageCount `json:"topClients"`
+	CacheHitRatio []CacheRatio `json:"cacheHitRatio"`
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// meterUsage records every request as a usage event once it is served.
+// Streaming requests keep their writer and are recorded when they end.
+func meterUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.Usage.Enabled || operationalPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		record := &usageRecord{event: UsageEvent{
+			Time:       start.UTC(),
+			Method:     r.Method,
+			Currencies: splitParam(r.URL.Query().Get("currency")),
+		}}
+		if route := mux.CurrentRoute(r); route != nil {
+			record.event.Route, _ = route.GetPathTemplate()
+		}
+		if symbol := normalizeCode(mux.Vars(r)["symbol"]); symbol != "" {
+			record.event.Symbols = []string{symbol}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), usageKey{}, record))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		if isStreaming(r) {
+			next.ServeHTTP(w, r)
+		} else {
+			next.ServeHTTP(sw, r)
+		}
+		record.mu.Lock()
+		event := record.event
+		record.mu.Unlock()
+		event.Status = sw.status
+		event.LatencyMs = time.Since(start).Milliseconds()
+		recordUsage(event)
+	})
+}
+
+func recordUsage(event UsageEvent) {
+	select {
+	case usageEvents <- event:
+	default:
+		usageLog.Warn(context.Background(), "usage buffer full, dropping event", "route", event.Route)
+	}
+}
+
+// meter calls fn with the usage event of the request, if it is metered.
+func meter(r *http.Request, fn func(event *UsageEvent)) {
+	record, ok := r.Context().Value(usageKey{}).(*usageRecord)
+	if !ok {
+		return
+	}
+	record.mu.Lock()
+	fn(&record.event)
+	record.mu.Unlock()
+}
+
+func meterCache(r *http.Request, hit bool) {
+	meter(r, func(event *UsageEvent) {
+		event.Cache = cacheOutcome(hit)
+	})
+}
+
+func meterUpstream(r *http.Request, calls int) {
+	meter(r, func(event *UsageEvent) {
+		event.UpstreamCalls += calls
+	})
+}
+
+func meterCodes(r *http.Request, symbols []string, currencies []string) {
+	meter(r, func(event *UsageEvent) {
+		if len(symbols) > 0 {
+			event.Symbols = symbols
+		}
+		if len(currencies) > 0 {
+			event.Currencies = currencies
+		}
+	})
+}
+
+// runUsageBatcher writes usage events to Mongo every flush interval, or
+// sooner once a batch is full, until ctx is done and the events queued so far
+// are written.
+func (a *App) runUsageBatcher(ctx context.Context) {
+	interval := time.Duration(cfg.Usage.FlushInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	batchSize := cfg.Usage.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	a.ensureUsageIndexes()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []UsageEvent
+	for {
+		select {
+		case <-ctx.Done():
+			for len(usageEvents) > 0 {
+				batch = append(batch, <-usageEvents)
+			}
+			a.flushUsage(batch)
+			return
+		case event := <-usageEvents:
+			batch = append(batch, event)
+			if len(batch) >= batchSize {
+				a.flushUsage(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				a.flushUsage(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+// ensureUsageIndexes expires raw events after the retention period; the
+// daily rollups are kept.
+func (a *App) ensureUsageIndexes() {
+	if cfg.Usage.RetentionDays <= 0 {
+		return
+	}
+	ctx := context.TODO()
+	co := a.Mongo
+	_, err := co.Database("usage").Collection("events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"time": 1},
+		Options: options.Index().SetExpireAfterSeconds(int32(cfg.Usage.RetentionDays * 24 * 3600)),
+	})
+	if err != nil {
+		usageLog.Warn(ctx, "error creating usage index", "error", err)
+	}
+}
+
+// flushUsage inserts the events and adds them to the daily rollups of keys
+// and routes (usage.daily) and of symbols (usage.daily_symbols).
+func (a *App) flushUsage(batch []UsageEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx := context.TODO()
+	co := a.Mongo
+	docs := make([]interface{}, 0, len(batch))
+	for _, event := range batch {
+		docs = append(docs, event)
+	}
+	daily, symbols := rollupUsage(batch)
+	_, err := co.Database("usage").Collection("events").InsertMany(ctx, docs)
+	if err != nil {
+		usageLog.Warn(ctx, "error inserting usage events", "events", len(docs), "error", err)
+	}
+
+	var models []mongo.WriteModel
+	for _, rollup := range daily {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"date": rollup.Date, "apiKey": rollup.ApiKey, "route": rollup.Route}).
+			SetUpdate(bson.M{
+				"$set": bson.M{"keyName": rollup.KeyName},
+				"$inc": bson.M{
+					"requests":      rollup.Requests,
+					"errors":        rollup.Errors,
+					"cacheHits":     rollup.CacheHits,
+					"cacheMisses":   rollup.CacheMisses,
+					"upstreamCalls": rollup.UpstreamCalls,
+					"latencyMs":     rollup.LatencyMs,
+				},
+			}).SetUpsert(true))
+	}
+	_, err = co.Database("usage").Collection("daily").BulkWrite(ctx, models)
+	if err != nil {
+		usageLog.Warn(ctx, "error updating usage rollups", "error", err)
+	}
+	if len(symbols) == 0 {
+		return
+	}
+	models = nil
+	for key, requests := range symbols {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"date": key[0], "symbol": key[1]}).
+			SetUpdate(bson.M{"$inc": bson.M{"requests": requests}}).
+			SetUpsert(true))
+	}
+	_, err = co.Database("usage").Collection("daily_symbols").BulkWrite(ctx, models)
+	if err != nil {
+		usageLog.Warn(ctx, "error updating symbol usage rollups", "error", err)
+	}
+}
+
+// rollupUsage sums a batch of events by day, key and route, and by day and
+// symbol.
+func rollupUsage(batch []UsageEvent) (map[[3]string]*UsageDaily, map[[2]string]int64) {
+	daily := make(map[[3]string]*UsageDaily)
+	symbols := make(map[[2]string]int64)
+	for _, event := range batch {
+		date := event.Time.Format(historyDateForm)
+		key := [3]string{date, event.ApiKey, event.Route}
+		rollup, ok := daily[key]
+		if !ok {
+			rollup = &UsageDaily{Date: date, ApiKey: event.ApiKey, KeyName: event.KeyName, Route: event.Route}
+			daily[key] = rollup
+		}
+		rollup.Requests++
+		if event.Status >= 400 {
+			rollup.Errors++
+		}
+		switch event.Cache {
+		case "hit":
+			rollup.CacheHits++
+		case "miss":
+			rollup.CacheMisses++
+		}
+		rollup.UpstreamCalls += int64(event.UpstreamCalls)
+		rollup.LatencyMs += event.LatencyMs
+		for _, symbol := range event.Symbols {
+			symbols[[2]string{date, symbol}]++
+		}
+	}
+	return daily, symbols
+}
+
+// usageReportHandler reports, over the last ?days= days (7 by default), the
+// most requested symbols, the busiest clients and the daily cache hit ratio.
+func (a *App) usageReportHandler(w http.ResponseWriter, r *http.Request) {
+	from, to := usageRange(r, 7)
+	limit, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	ctx := r.Context()
+	co := a.Mongo
+	res := UsageReport{From: from, To: to, TopSymbols: make([]UsageCount, 0),
+		TopClients: make([]UsageCount, 0), CacheHitRatio: make([]CacheRatio, 0)}
+
+	symbols, clients, ratios := usageReportPipelines(from, to, limit)
+	ok := aggregate(ctx, co.Database("usage").Collection("daily_symbols"), symbols, &res.TopSymbols)
+	ok = ok && aggregate(ctx, co.Database("usage").Collection("daily"), clients, &res.TopClients)
+	ok = ok && aggregate(ctx, co.Database("usage").Collection("daily"), ratios, &res.CacheHitRatio)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Error reading usage")
+		return
+	}
+	fillCacheRatios(res.CacheHitRatio)
+	writeJSON(w, res)
+}
+
+// usageReportPipelines returns the aggregations of the top symbols, the top
+// clients and the daily cache hit ratio. The clients' rollups are sorted by
+// date before grouping, so that a key is named as it was last.
+func usageReportPipelines(from, to string, limit int64) ([]bson.M, []bson.M, []bson.M) {
+	match := bson.M{"$match": bson.M{"date": bson.M{"$gte": from, "$lte": to}}}
+	symbols := []bson.M{match,
+		{"$group": bson.M{"_id": "$symbol", "requests": bson.M{"$sum": "$requests"}}},
+		{"$sort": bson.M{"requests": -1}},
+		{"$limit": limit},
+	}
+	clients := []bson.M{match,
+		{"$sort": bson.M{"date": 1}},
+		{"$group": bson.M{"_id": "$apiKey", "name": bson.M{"$last": "$keyName"}, "requests": bson.M{"$sum": "$requests"}}},
+		{"$sort": bson.M{"requests": -1}},
+		{"$limit": limit},
+	}
+	ratios := []bson.M{match,
+		{"$group": bson.M{"_id": "$date", "hits": bson.M{"$sum": "$cacheHits"}, "misses": bson.M{"$sum": "$cacheMisses"}}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	return symbols, clients, ratios
+}
+
+func fillCacheRatios(ratios []CacheRatio) {
+	for i, ratio := range ratios {
+		if ratio.Hits+ratio.Misses > 0 {
+			ratios[i].Ratio = float64(ratio.Hits) / float64(ratio.Hits+ratio.Misses)
+		}
+	}
+}
+
+// usageExportHandler exports the daily rollups between ?from= and ?to= (the
+// last 30 days by default) as CSV, one row per day, key and route.
+func (a *App) usageExportHandler(w http.ResponseWriter, r *http.Request) {
+	from, to := usageRange(r, 30)
+	ctx := r.Context()
+	co := a.Mongo
+	rows := make([]UsageDaily, 0)
+	cursor, err := co.Database("usage").Collection("daily").Find(ctx,
+		bson.M{"date": bson.M{"$gte": from, "$lte": to}})
+	if err == nil {
+		err = cursor.All(ctx, &rows)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error reading usage")
+		return
+	}
+	raw, err := usageCSV(rows)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error encoding usage")
+		return
+	}
+	w.Header().Set("Content-Type", formatTypes[formatCSV])
+	w.Header().Set("Content-Disposition", "attachment; filename=usage-"+from+"-"+to+".csv")
+	w.Write(raw)
+}
+
+// usageCSV encodes the rollups as CSV, ordered by day, key and route.
+func usageCSV(rows []UsageDaily) ([]byte, error) {
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Date != rows[j].Date {
+			return rows[i].Date < rows[j].Date
+		}
+		if rows[i].ApiKey != rows[j].ApiKey {
+			return rows[i].ApiKey < rows[j].ApiKey
+		}
+		return rows[i].Route < rows[j].Route
+	})
+	raw, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeOrdered(raw)
+	if err != nil {
+		return nil, err
+	}
+	return encodeCSV(decoded)
+}
+
+// usageRange returns the ?from= and ?to= dates, defaulting to the last days
+// days up to today.
+func usageRange(r *http.Request, days int) (string, string) {
+	now := time.Now().UTC()
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if _, err := time.Parse(historyDateForm, to); err != nil {
+		to = now.Format(historyDateForm)
+	}
+	if _, err := time.Parse(historyDateForm, from); err != nil {
+		if n, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && n > 0 {
+			days = n
+		}
+		from = now.AddDate(0, 0, -days+1).Format(historyDateForm)
+	}
+	return from, to
+}
+
+func aggregate(ctx context.Context, collection *mongo.Collection, pipeline []bson.M, v interface{}) bool {
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return false
+	}
+	return cursor.All(ctx, v) == nil
+}
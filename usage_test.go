@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRollupUsage(t *testing.T) {
+	day := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	next := day.Add(2 * time.Minute)
+	daily, symbols := rollupUsage([]UsageEvent{
+		{Time: day, ApiKey: "a", KeyName: "app", Route: "/api/{symbol}/info", Status: 200, Symbols: []string{"BTC"}, Cache: "hit", LatencyMs: 3},
+		{Time: day, ApiKey: "a", KeyName: "app", Route: "/api/{symbol}/info", Status: 502, Symbols: []string{"BTC"}, Cache: "miss", UpstreamCalls: 3, LatencyMs: 40},
+		{Time: day, ApiKey: "a", KeyName: "app", Route: "/api/prices", Status: 429, Symbols: []string{"BTC", "ETH"}},
+		{Time: day, ApiKey: "b", KeyName: "web", Route: "/api/{symbol}/info", Status: 404, Cache: "miss", UpstreamCalls: 1},
+		{Time: next, ApiKey: "a", KeyName: "app", Route: "/api/{symbol}/info", Status: 200, Symbols: []string{"BTC"}, Cache: "hit", LatencyMs: 2},
+	})
+	want := map[[3]string]UsageDaily{
+		{"2024-05-01", "a", "/api/{symbol}/info"}: {Date: "2024-05-01", ApiKey: "a", KeyName: "app", Route: "/api/{symbol}/info",
+			Requests: 2, Errors: 1, CacheHits: 1, CacheMisses: 1, UpstreamCalls: 3, LatencyMs: 43},
+		{"2024-05-01", "a", "/api/prices"}: {Date: "2024-05-01", ApiKey: "a", KeyName: "app", Route: "/api/prices", Requests: 1, Errors: 1},
+		{"2024-05-01", "b", "/api/{symbol}/info"}: {Date: "2024-05-01", ApiKey: "b", KeyName: "web", Route: "/api/{symbol}/info",
+			Requests: 1, Errors: 1, CacheMisses: 1, UpstreamCalls: 1},
+		{"2024-05-02", "a", "/api/{symbol}/info"}: {Date: "2024-05-02", ApiKey: "a", KeyName: "app", Route: "/api/{symbol}/info",
+			Requests: 1, CacheHits: 1, LatencyMs: 2},
+	}
+	if len(daily) != len(want) {
+		t.Errorf("%d rollups, want %d", len(daily), len(want))
+	}
+	for key, rollup := range want {
+		if got, ok := daily[key]; !ok || *got != rollup {
+			t.Errorf("%v: rollup %+v, want %+v", key, got, rollup)
+		}
+	}
+	wantSymbols := map[[2]string]int64{
+		{"2024-05-01", "BTC"}: 3,
+		{"2024-05-01", "ETH"}: 1,
+		{"2024-05-02", "BTC"}: 1,
+	}
+	if !reflect.DeepEqual(symbols, wantSymbols) {
+		t.Errorf("symbols %v, want %v", symbols, wantSymbols)
+	}
+}
+
+func TestUsageReportPipelines(t *testing.T) {
+	symbols, clients, ratios := usageReportPipelines("2024-05-01", "2024-05-07", 5)
+	match := bson.M{"$match": bson.M{"date": bson.M{"$gte": "2024-05-01", "$lte": "2024-05-07"}}}
+	for name, pipeline := range map[string][]bson.M{"symbols": symbols, "clients": clients, "ratios": ratios} {
+		if !reflect.DeepEqual(pipeline[0], match) {
+			t.Errorf("%s: first stage %v, want %v", name, pipeline[0], match)
+		}
+	}
+	// $last names a key as it was last only over rollups sorted by date.
+	group := -1
+	for i, stage := range clients {
+		if _, ok := stage["$group"]; ok {
+			group = i
+			break
+		}
+	}
+	if group < 1 || !reflect.DeepEqual(clients[group-1], bson.M{"$sort": bson.M{"date": 1}}) {
+		t.Errorf("clients: stages %v don't sort by date before grouping", clients)
+	}
+	if limit := clients[len(clients)-1]; !reflect.DeepEqual(limit, bson.M{"$limit": int64(5)}) {
+		t.Errorf("clients: last stage %v", limit)
+	}
+	if limit := symbols[len(symbols)-1]; !reflect.DeepEqual(limit, bson.M{"$limit": int64(5)}) {
+		t.Errorf("symbols: last stage %v", limit)
+	}
+}
+
+func TestFillCacheRatios(t *testing.T) {
+	ratios := []CacheRatio{
+		{Date: "2024-05-01", Hits: 3, Misses: 1},
+		{Date: "2024-05-02", Hits: 0, Misses: 2},
+		{Date: "2024-05-03"},
+	}
+	fillCacheRatios(ratios)
+	for i, want := range []float64{0.75, 0, 0} {
+		if ratios[i].Ratio != want {
+			t.Errorf("%s: ratio %v, want %v", ratios[i].Date, ratios[i].Ratio, want)
+		}
+	}
+}
+
+func TestUsageCSV(t *testing.T) {
+	raw, err := usageCSV([]UsageDaily{
+		{Date: "2024-05-02", ApiKey: "a", KeyName: "app", Route: "/api/prices", Requests: 1},
+		{Date: "2024-05-01", ApiKey: "b", KeyName: "web, beta", Route: "/api/{symbol}/info", Requests: 2, Errors: 1},
+		{Date: "2024-05-01", ApiKey: "a", KeyName: "app", Route: "/api/{symbol}/info", Requests: 3, CacheHits: 2, CacheMisses: 1, UpstreamCalls: 3, LatencyMs: 12},
+		{Date: "2024-05-01", ApiKey: "a", KeyName: "app", Route: "/api/prices", Requests: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"date,apiKey,keyName,route,requests,errors,cacheHits,cacheMisses,upstreamCalls,latencyMs",
+		"2024-05-01,a,app,/api/prices,4,0,0,0,0,0",
+		"2024-05-01,a,app,/api/{symbol}/info,3,0,2,1,3,12",
+		`2024-05-01,b,"web, beta",/api/{symbol}/info,2,1,0,0,0,0`,
+		"2024-05-02,a,app,/api/prices,1,0,0,0,0,0",
+	}
+	if got := strings.Split(strings.TrimSpace(string(raw)), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("csv\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	upbitpb "Upbit/proto"
+)
+
+// openapiSpec describes both the frozen v1 routes and /api/v2.
+//go:embed openapi.json
+var openapiSpec []byte
+
+// DataV2 is Data with typed nullable fields: a value no provider supplied is
+// null rather than 0, "" or the v1 provider string "error".
+type DataV2 struct {
+	Symbol               string     `json:"symbol"`
+	CurrencyCode         string     `json:"currencyCode"`
+	Price                float64    `json:"price"`
+	MarketCap            float64    `json:"marketCap"`
+	AccTradePrice24H     *float64   `json:"accTradePrice24h"`
+	CirculatingSupply    float64    `json:"circulatingSupply"`
+	MaxSupply            *float64   `json:"maxSupply"`
+	Provider             *string    `json:"provider"`
+	LastUpdatedTimestamp string     `json:"lastUpdatedTimestamp"`
+	KoreanName           *string    `json:"koreanName"`
+	EnglishName          *string    `json:"englishName"`
+	UpbitWarning         bool       `json:"upbitWarning"`
+	Consensus            *Consensus `json:"consensus"`
+}
+
+type ErrorV2 struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// EnvelopeV2 is the body of every /api/v2 response: data on success, error
+// otherwise, with the HTTP status matching error.code. Degraded lists the
+// datastores whose fallbacks answered instead.
+type EnvelopeV2 struct {
+	Data     interface{} `json:"data"`
+	Error    *ErrorV2    `json:"error"`
+	Degraded []string    `json:"degraded,omitempty"`
+}
+
+// v2Envelope wraps the bodies of the routes mounted under /api/v2. Routes
+// shared with v1 keep their handler; errResult bodies become the error.
+func v2Envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+		if bw.status == http.StatusNoContent {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var result errResult
+		err := json.Unmarshal(bw.body.Bytes(), &result)
+		if bw.status >= 400 || (err == nil && result.Msg != "") {
+			if result.Code == 0 {
+				result.Code = bw.status
+			}
+			if result.Msg == "" {
+				result.Msg = http.StatusText(bw.status)
+			}
+			writeV2(w, result.Code, EnvelopeV2{nil, &ErrorV2{result.Code, result.Msg}, degradedFrom(w)})
+			return
+		}
+		var data interface{}
+		if bw.body.Len() > 0 {
+			data = json.RawMessage(bw.body.Bytes())
+		}
+		writeV2(w, bw.status, EnvelopeV2{data, nil, degradedFrom(w)})
+	})
+}
+
+// writeErrorFor is writeError for middleware running ahead of v2Envelope,
+// answering /api/v2 routes with the envelope.
+func writeErrorFor(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeV2(w, code, EnvelopeV2{nil, &ErrorV2{code, msg}, degradedFrom(w)})
+		return
+	}
+	writeError(w, code, msg)
+}
+
+func writeV2(w http.ResponseWriter, status int, envelope EnvelopeV2) {
+	result, _ := json.Marshal(envelope)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(result)
+}
+
+// handlerV2 answers /api/v2/{symbol}/info through the v1 code path. The
+// currencies come from ?currency= or, as in v1, the JSON body.
+func (a *App) handlerV2(w http.ResponseWriter, r *http.Request) {
+	symbolPro := normalizeCode(mux.Vars(r)["symbol"])
+	currencyCode := splitParam(r.URL.Query().Get("currency"))
+	if len(currencyCode) == 0 {
+		currencyCode = currencyCodeDefault
+		body, err := ioutil.ReadAll(r.Body)
+		var requestBody RequestBody
+		if err == nil && json.Unmarshal(body, &requestBody) == nil && len(requestBody.CurrencyCode) > 0 {
+			currencyCode = requestBody.CurrencyCode
+		}
+	}
+	method, ok := consensusMethod(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Unknown consensus method, use "+consensusMethods)
+		return
+	}
+	cached := a.infoCached(r.Context(), symbolPro)
+	meterCache(r, cached)
+	meterCodes(r, nil, currencyCode)
+	if !cached && !a.allowUpstream(w, r, len(currencyCode)+2) {
+		return
+	}
+	rec := &errorRecorder{header: make(http.Header)}
+	data, sources, ok := a.getInfo(r.Context(), rec, symbolPro, currencyCode, method)
+	if !ok {
+		result := rec.errResult()
+		writeError(w, result.Code, result.Msg)
+		return
+	}
+	decorateMarket(data)
+	setBlock(r, "sources", sources)
+	setProtoMessage(r, &upbitpb.DataList{Data: protoData(data)})
+	res := make([]DataV2, 0, len(data))
+	for _, d := range data {
+		res = append(res, toV2(d))
+	}
+	writeJSON(w, res)
+}
+
+func toV2(d Data) DataV2 {
+	v2 := DataV2{
+		Symbol:               d.Symbol,
+		CurrencyCode:         d.CurrencyCode,
+		Price:                d.Price,
+		MarketCap:            d.MarketCap,
+		CirculatingSupply:    d.CirculatingSupply,
+		LastUpdatedTimestamp: d.LastUpdatedTimestamp,
+		UpbitWarning:         d.UpbitWarning,
+		Consensus:            d.Consensus,
+	}
+	if accTradePrice, ok := d.AccTradePrice24H.(float64); ok {
+		v2.AccTradePrice24H = &accTradePrice
+	}
+	if maxSupply, ok := d.MaxSupply.(float64); ok {
+		v2.MaxSupply = &maxSupply
+	}
+	if d.Provider != "" && d.Provider != "error" {
+		v2.Provider = &d.Provider
+	}
+	if d.KoreanName != "" {
+		v2.KoreanName = &d.KoreanName
+	}
+	if d.EnglishName != "" {
+		v2.EnglishName = &d.EnglishName
+	}
+	return v2
+}
+
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiSpec)
+}